@@ -0,0 +1,182 @@
+package confed
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+const (
+	DEFAULT_CONFIG_FILE_MODE = 0644
+	ATOMIC_TEMP_PATTERN      = ".confed-*.tmp"
+	XATTR_BUFFER_SIZE        = 4096
+)
+
+// Filesystem operations used by writeFileAtomic.
+// They are variables so that tests can simulate failures
+// at every step of the write.
+var (
+	atomicCreateTemp = os.CreateTemp
+	atomicWrite      = func(f *os.File, data []byte) (int, error) { return f.Write(data) }
+	atomicSyncFile   = func(f *os.File) error { return f.Sync() }
+	atomicCopyAttrs  = copyFileAttrs
+	atomicClose      = func(f *os.File) error { return f.Close() }
+	atomicRename     = os.Rename
+	atomicSyncDir    = syncDir
+)
+
+// writeFileAtomic replaces the file at path with data so that
+// the file always contains either the old or the new content,
+// even if the power is lost in the middle of the write.
+// The data is written to a temporary file in the same directory,
+// synced to disk, given the owner, mode and extended attributes
+// of the original file and then renamed over it.
+// If the file doesn't exist yet, it's created with the specified mode.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) (err error) {
+	// don't replace symlinks (e.g. /etc/resolv.conf) with regular files
+	if target, err := filepath.EvalSymlinks(path); err == nil {
+		path = target
+	}
+
+	var orig os.FileInfo
+	orig, err = os.Stat(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return
+		}
+		orig = nil
+	}
+
+	dir := filepath.Dir(path)
+	tmp, err := atomicCreateTemp(dir, ATOMIC_TEMP_PATTERN)
+	if err != nil {
+		return fmt.Errorf("failed to create temporary file in %s: %w", dir, err)
+	}
+	tmpPath := tmp.Name()
+	closed, renamed := false, false
+	defer func() {
+		if err == nil || renamed {
+			return
+		}
+		if !closed {
+			tmp.Close()
+		}
+		os.Remove(tmpPath)
+	}()
+
+	if _, err = atomicWrite(tmp, data); err != nil {
+		return fmt.Errorf("failed to write %s: %w", tmpPath, err)
+	}
+	if err = atomicSyncFile(tmp); err != nil {
+		return fmt.Errorf("failed to sync %s: %w", tmpPath, err)
+	}
+	if orig != nil {
+		err = atomicCopyAttrs(tmp, path, orig)
+	} else {
+		err = tmp.Chmod(perm)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to set attributes of %s: %w", tmpPath, err)
+	}
+	closed = true
+	if err = atomicClose(tmp); err != nil {
+		return fmt.Errorf("failed to close %s: %w", tmpPath, err)
+	}
+	if err = atomicRename(tmpPath, path); err != nil {
+		return fmt.Errorf("failed to rename %s to %s: %w", tmpPath, path, err)
+	}
+	renamed = true
+
+	if err = atomicSyncDir(dir); err != nil {
+		return fmt.Errorf("failed to sync directory %s: %w", dir, err)
+	}
+	return nil
+}
+
+func syncDir(path string) error {
+	dir, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer dir.Close() // not writing the directory itself, so we can ignore Close() errors here
+	return dir.Sync()
+}
+
+// copyFileAttrs applies the mode, the owner and the extended attributes
+// of the file at origPath to f.
+func copyFileAttrs(f *os.File, origPath string, orig os.FileInfo) error {
+	if err := f.Chmod(orig.Mode().Perm()); err != nil {
+		return err
+	}
+	if st, ok := orig.Sys().(*syscall.Stat_t); ok {
+		if int(st.Uid) != os.Geteuid() || int(st.Gid) != os.Getegid() {
+			if err := f.Chown(int(st.Uid), int(st.Gid)); err != nil {
+				return err
+			}
+		}
+	}
+	return copyXattrs(f.Name(), origPath)
+}
+
+func copyXattrs(dst, src string) error {
+	names, err := listXattrs(src)
+	if err != nil {
+		if errors.Is(err, syscall.ENOTSUP) {
+			return nil
+		}
+		return err
+	}
+	for _, name := range names {
+		// security labels are managed by the system
+		if strings.HasPrefix(name, "security.") {
+			continue
+		}
+		value, err := getXattr(src, name)
+		if err != nil {
+			return err
+		}
+		if err = syscall.Setxattr(dst, name, value, 0); err != nil {
+			return fmt.Errorf("failed to copy xattr %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+func listXattrs(path string) ([]string, error) {
+	buf := make([]byte, XATTR_BUFFER_SIZE)
+	for {
+		n, err := syscall.Listxattr(path, buf)
+		if err == syscall.ERANGE {
+			buf = make([]byte, len(buf)*2)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		var names []string
+		for _, name := range strings.Split(string(buf[:n]), "\x00") {
+			if name != "" {
+				names = append(names, name)
+			}
+		}
+		return names, nil
+	}
+}
+
+func getXattr(path, name string) ([]byte, error) {
+	buf := make([]byte, XATTR_BUFFER_SIZE)
+	for {
+		n, err := syscall.Getxattr(path, name, buf)
+		if err == syscall.ERANGE {
+			buf = make([]byte, len(buf)*2)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return buf[:n], nil
+	}
+}
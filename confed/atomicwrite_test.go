@@ -0,0 +1,178 @@
+package confed
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+const (
+	ORIGINAL_CONTENT = "{\"old\": true}\n"
+	NEW_CONTENT      = "{\"new\": true}\n"
+)
+
+var errSimulated = errors.New("simulated failure")
+
+func prepareAtomicWriteDir(t *testing.T) (dir, path string) {
+	dir = t.TempDir()
+	path = filepath.Join(dir, "test.conf")
+	if err := os.WriteFile(path, []byte(ORIGINAL_CONTENT), 0640); err != nil {
+		t.Fatalf("failed to write %s: %v", path, err)
+	}
+	return
+}
+
+func verifyFileContent(t *testing.T, path, expected string) {
+	t.Helper()
+	bs, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read %s: %v", path, err)
+	}
+	if string(bs) != expected {
+		t.Errorf("unexpected content of %s: %q", path, string(bs))
+	}
+}
+
+func verifyNoTempFiles(t *testing.T, dir string) {
+	t.Helper()
+	matches, err := filepath.Glob(filepath.Join(dir, ATOMIC_TEMP_PATTERN))
+	if err != nil {
+		t.Fatalf("glob failed: %v", err)
+	}
+	if len(matches) != 0 {
+		t.Errorf("temporary files left: %v", matches)
+	}
+}
+
+func TestWriteFileAtomic(t *testing.T) {
+	dir, path := prepareAtomicWriteDir(t)
+	xattrSupported := syscall.Setxattr(path, "user.confed.test", []byte("42"), 0) == nil
+
+	if err := writeFileAtomic(path, []byte(NEW_CONTENT), DEFAULT_CONFIG_FILE_MODE); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	verifyFileContent(t, path, NEW_CONTENT)
+	verifyNoTempFiles(t, dir)
+
+	st, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("stat failed: %v", err)
+	}
+	if st.Mode().Perm() != 0640 {
+		t.Errorf("file mode is not preserved: %o", st.Mode().Perm())
+	}
+	if xattrSupported {
+		value, err := getXattr(path, "user.confed.test")
+		if err != nil || string(value) != "42" {
+			t.Errorf("xattr is not preserved: %q, %v", string(value), err)
+		}
+	}
+}
+
+func TestWriteFileAtomicNewFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "new.conf")
+	if err := writeFileAtomic(path, []byte(NEW_CONTENT), 0600); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	verifyFileContent(t, path, NEW_CONTENT)
+	st, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("stat failed: %v", err)
+	}
+	if st.Mode().Perm() != 0600 {
+		t.Errorf("unexpected file mode: %o", st.Mode().Perm())
+	}
+}
+
+func TestWriteFileAtomicSymlink(t *testing.T) {
+	dir, path := prepareAtomicWriteDir(t)
+	link := filepath.Join(dir, "link.conf")
+	if err := os.Symlink(path, link); err != nil {
+		t.Fatalf("symlink failed: %v", err)
+	}
+	if err := writeFileAtomic(link, []byte(NEW_CONTENT), DEFAULT_CONFIG_FILE_MODE); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	st, err := os.Lstat(link)
+	if err != nil {
+		t.Fatalf("lstat failed: %v", err)
+	}
+	if st.Mode()&os.ModeSymlink == 0 {
+		t.Errorf("symlink is replaced with a regular file")
+	}
+	verifyFileContent(t, path, NEW_CONTENT)
+}
+
+func TestWriteFileAtomicFailures(t *testing.T) {
+	origCreateTemp, origWrite, origSyncFile := atomicCreateTemp, atomicWrite, atomicSyncFile
+	origCopyAttrs, origClose, origRename := atomicCopyAttrs, atomicClose, atomicRename
+	defer func() {
+		atomicCreateTemp, atomicWrite, atomicSyncFile = origCreateTemp, origWrite, origSyncFile
+		atomicCopyAttrs, atomicClose, atomicRename = origCopyAttrs, origClose, origRename
+	}()
+
+	steps := []struct {
+		name   string
+		inject func()
+	}{
+		{"create", func() {
+			atomicCreateTemp = func(string, string) (*os.File, error) { return nil, errSimulated }
+		}},
+		{"write", func() {
+			atomicWrite = func(f *os.File, data []byte) (int, error) {
+				// simulate a partial write
+				n, _ := f.Write(data[:len(data)/2])
+				return n, errSimulated
+			}
+		}},
+		{"fsync", func() {
+			atomicSyncFile = func(*os.File) error { return errSimulated }
+		}},
+		{"attrs", func() {
+			atomicCopyAttrs = func(*os.File, string, os.FileInfo) error { return errSimulated }
+		}},
+		{"close", func() {
+			atomicClose = func(f *os.File) error {
+				f.Close()
+				return errSimulated
+			}
+		}},
+		{"rename", func() {
+			atomicRename = func(string, string) error { return errSimulated }
+		}},
+	}
+
+	for _, step := range steps {
+		t.Run(step.name, func(t *testing.T) {
+			atomicCreateTemp, atomicWrite, atomicSyncFile = origCreateTemp, origWrite, origSyncFile
+			atomicCopyAttrs, atomicClose, atomicRename = origCopyAttrs, origClose, origRename
+			step.inject()
+
+			dir, path := prepareAtomicWriteDir(t)
+			err := writeFileAtomic(path, []byte(NEW_CONTENT), DEFAULT_CONFIG_FILE_MODE)
+			if !errors.Is(err, errSimulated) {
+				t.Fatalf("simulated error expected, got %v", err)
+			}
+			verifyFileContent(t, path, ORIGINAL_CONTENT)
+			verifyNoTempFiles(t, dir)
+		})
+	}
+}
+
+func TestWriteFileAtomicDirSyncFailure(t *testing.T) {
+	origSyncDir := atomicSyncDir
+	defer func() { atomicSyncDir = origSyncDir }()
+	atomicSyncDir = func(string) error { return errSimulated }
+
+	dir, path := prepareAtomicWriteDir(t)
+	err := writeFileAtomic(path, []byte(NEW_CONTENT), DEFAULT_CONFIG_FILE_MODE)
+	if !errors.Is(err, errSimulated) {
+		t.Fatalf("simulated error expected, got %v", err)
+	}
+	// the file is already renamed when the directory is synced
+	verifyFileContent(t, path, NEW_CONTENT)
+	verifyNoTempFiles(t, dir)
+}
@@ -0,0 +1,124 @@
+package confed
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// the prefix of toJSON and fromJSON values referencing
+// the converters built into wb-mqtt-confed, e.g. "builtin:ntp"
+const BUILTIN_CONVERTER_PREFIX = "builtin:"
+
+// Converter converts the config file to JSON and back
+// without running external commands
+type Converter interface {
+	ToJSON(raw []byte) ([]byte, error)
+	// orig is the current content of the config file or nil if there's no file
+	FromJSON(content, orig []byte) ([]byte, error)
+}
+
+var (
+	convertersMtx sync.RWMutex
+	converters    = map[string]Converter{
+		"ntp":     ntpConverter{},
+		"network": &networkConverter{serialFile: WB_SERIAL_FILE},
+	}
+)
+
+// RegisterConverter makes the converter available to the schemas
+// as "builtin:<name>" toJSON and fromJSON commands
+func RegisterConverter(name string, converter Converter) {
+	convertersMtx.Lock()
+	defer convertersMtx.Unlock()
+	converters[name] = converter
+}
+
+// lookupConverter returns the built-in converter referenced by toJSON
+// or fromJSON command or nil if the command is an external one
+func lookupConverter(command []string) (Converter, error) {
+	if len(command) != 1 || !strings.HasPrefix(command[0], BUILTIN_CONVERTER_PREFIX) {
+		return nil, nil
+	}
+	name := strings.TrimPrefix(command[0], BUILTIN_CONVERTER_PREFIX)
+	convertersMtx.RLock()
+	defer convertersMtx.RUnlock()
+	converter, found := converters[name]
+	if !found {
+		return nil, fmt.Errorf("unknown built-in converter %q", name)
+	}
+	return converter, nil
+}
+
+// pyTruth reports whether the JSON value is true in python,
+// the built-in converters follow the scripts they replace
+func pyTruth(v any) bool {
+	switch t := v.(type) {
+	case nil:
+		return false
+	case bool:
+		return t
+	case string:
+		return t != ""
+	case json.Number:
+		f, err := t.Float64()
+		return err != nil || f != 0
+	case []any:
+		return len(t) != 0
+	case map[string]any:
+		return len(t) != 0
+	default:
+		return true
+	}
+}
+
+// pyStr formats the scalar JSON value like python's str()
+func pyStr(v any) (string, error) {
+	switch t := v.(type) {
+	case nil:
+		return "None", nil
+	case bool:
+		if t {
+			return "True", nil
+		}
+		return "False", nil
+	case string:
+		return t, nil
+	case json.Number:
+		return pyNumberString(t), nil
+	default:
+		return "", fmt.Errorf("unsupported value %v", v)
+	}
+}
+
+func pyNumberString(n json.Number) string {
+	s := n.String()
+	if !strings.ContainsAny(s, ".eE") {
+		if s == "-0" {
+			return "0"
+		}
+		return s
+	}
+	f, err := n.Float64()
+	switch {
+	case math.IsInf(f, 1):
+		return "inf"
+	case math.IsInf(f, -1):
+		return "-inf"
+	case err != nil:
+		return s
+	}
+	// python's repr uses the positional notation for the exponents from -4 to 15
+	s = strconv.FormatFloat(f, 'e', -1, 64)
+	if exp, _ := strconv.Atoi(s[strings.IndexByte(s, 'e')+1:]); exp < -4 || exp >= 16 {
+		return s
+	}
+	s = strconv.FormatFloat(f, 'f', -1, 64)
+	if !strings.Contains(s, ".") {
+		s += ".0"
+	}
+	return s
+}
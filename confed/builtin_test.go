@@ -0,0 +1,256 @@
+package confed
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func verifyConverterToJSON(t *testing.T, converter Converter, raw, expected string) {
+	t.Helper()
+	res, err := converter.ToJSON([]byte(raw))
+	if err != nil {
+		t.Fatalf("ToJSON: %s", err)
+	}
+	var expectedValue, actual any
+	if err = json.Unmarshal([]byte(expected), &expectedValue); err != nil {
+		t.Fatal(err)
+	}
+	if err = json.Unmarshal(res, &actual); err != nil || !reflect.DeepEqual(expectedValue, actual) {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, res)
+	}
+}
+
+func verifyConverterFromJSON(t *testing.T, converter Converter, content, expected string) {
+	t.Helper()
+	res, err := converter.FromJSON([]byte(content), nil)
+	if err != nil {
+		t.Fatalf("FromJSON: %s", err)
+	}
+	if string(res) != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, res)
+	}
+}
+
+func TestNTPConverter(t *testing.T) {
+	conf := "# ntp.conf\ndriftfile /var/lib/ntp/ntp.drift\n\n" +
+		"pool 0.debian.pool.ntp.org iburst\n" +
+		"server 192.168.1.1 key 5 prefer minpoll 4 maxpoll 10\n" +
+		"restrict default kod\n"
+	content := `{
+		"data": [
+			{"type": "pool", "address": "0.debian.pool.ntp.org", "iburst": true},
+			{"type": "server", "address": "192.168.1.1", "key": 5, "prefer": true, "minpoll": 4, "maxpoll": 10}
+		],
+		"etc": ["# ntp.conf", "driftfile /var/lib/ntp/ntp.drift", "", "` + NTP_SERVERS_MARKER + `", "restrict default kod"]
+	}`
+	converter, err := lookupConverter([]string{"builtin:ntp"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifyConverterToJSON(t, converter, conf, content)
+	verifyConverterFromJSON(t, converter, content, conf)
+
+	verifyConverterToJSON(t, converter, "", `{"data": [], "etc": []}`)
+	if _, err = converter.ToJSON([]byte("server 10.0.0.1 version x\n")); err == nil {
+		t.Error("bad version must not be accepted")
+	}
+	if _, err = converter.FromJSON([]byte(`{"data": []}`), nil); err == nil {
+		t.Error("config without etc must not be accepted")
+	}
+}
+
+func TestNetworkConverter(t *testing.T) {
+	dir := t.TempDir()
+	converter := &networkConverter{serialFile: filepath.Join(dir, "serial.conf")}
+	conf := "# interfaces(5) file\nauto lo\niface lo inet loopback\n\n" +
+		"auto eth0\niface eth0 inet static\n  address 192.168.1.2\n\tnetmask 255.255.255.0 # mask\n" +
+		"  post-up ip route add  10.0.0.0/8 dev eth0\n\n" +
+		"allow-hotplug wlan0\niface wlan0 inet dhcp\n"
+	content := `{
+		"interfaces": [
+			{"name": "lo", "auto": true, "mode": "inet", "method": "loopback", "options": {}},
+			{"name": "eth0", "auto": true, "mode": "inet", "method": "static", "options": {
+				"address": "192.168.1.2",
+				"netmask": "255.255.255.0 # mask",
+				"post-up": "ip route add  10.0.0.0/8 dev eth0"
+			}},
+			{"name": "wlan0", "auto": false, "allow-hotplug": true, "mode": "inet", "method": "dhcp", "options": {}}
+		]
+	}`
+	verifyConverterToJSON(t, converter, conf, content)
+	verifyConverterFromJSON(t, converter, content,
+		"auto lo\niface lo inet loopback\n\n"+
+			"auto eth0\niface eth0 inet static\n  address 192.168.1.2\n  netmask 255.255.255.0 # mask\n"+
+			"  post-up ip route add  10.0.0.0/8 dev eth0\n\n"+
+			"allow-hotplug wlan0\niface wlan0 inet dhcp\n\n")
+
+	// the controller's serial is shown as hwaddress of eth0
+	if err := os.WriteFile(converter.serialFile, []byte("00:11:22:33:44:55\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	verifyConverterToJSON(t, converter, "auto eth0\niface eth0 inet dhcp\n", `{
+		"interfaces": [{"name": "eth0", "auto": true, "mode": "inet", "method": "dhcp", "options": {"hwaddress": "00:11:22:33:44:55"}}]
+	}`)
+
+	// the values are written like python's str() does
+	verifyConverterFromJSON(t, converter, `{"interfaces": [
+		{"name": "eth0:42", "auto": true},
+		{"name": "can0", "auto": 1, "options": {"bitrate": 125000, "mtu": 1.5e20, "metric": null, "hostname": "", "up": true}}
+	]}`, "auto can0\niface can0 inet manual\n  bitrate 125000\n  mtu 1.5e+20\n  up True\n\n")
+	// the rest of the file is dropped after the first unsupported line like the script does
+	verifyConverterToJSON(t, converter, "auto lo eth0\niface lo inet loopback\n",
+		`{"interfaces": [{"name": "lo", "auto": true}]}`)
+	verifyConverterToJSON(t, converter, "iface eth0 inet static\n  foo bar\n  address 1.2.3.4\n", `{
+		"interfaces": [{"name": "eth0", "auto": false, "mode": "inet", "method": "static", "options": {"hwaddress": "00:11:22:33:44:55"}}]
+	}`)
+	for _, raw := range []string{
+		"",
+		"# no interfaces\n",
+		"source /etc/network/interfaces.d/*\nauto lo\n",
+		"  address 1.2.3.4\n",
+		"iface eth0 inet6 static\n",
+	} {
+		if _, err := converter.ToJSON([]byte(raw)); err == nil {
+			t.Errorf("%q must not be accepted", raw)
+		}
+	}
+	for _, content := range []string{
+		`{}`,
+		`{"interfaces": {}}`,
+		`{"interfaces": [{"auto": true}]}`,
+		`{"interfaces": [{"name": 42}]}`,
+		`{"interfaces": [{"name": "eth0", "options": []}]}`,
+		`{"interfaces": [{"name": "eth0", "options": null}]}`,
+	} {
+		if _, err := converter.FromJSON([]byte(content), nil); err == nil {
+			t.Errorf("%s must not be accepted", content)
+		}
+	}
+}
+
+// runParserScript runs the script which is replaced by the built-in converter,
+// the test is skipped if the script can't be run here
+func runParserScript(t *testing.T, name, modules string, input []byte, args ...string) []byte {
+	t.Helper()
+	if err := exec.Command("python3", "-c", "import "+modules).Run(); err != nil {
+		t.Skipf("can't run %s: %s", name, err)
+	}
+	path, err := filepath.Abs(filepath.Join("..", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command("python3", append([]string{path}, args...)...)
+	cmd.Stdin = bytes.NewReader(input)
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("%s %v: %s", name, args, err)
+	}
+	return out
+}
+
+func verifySameAsParserScript(t *testing.T, converter Converter, name, modules string, raw []byte) {
+	t.Helper()
+	js := runParserScript(t, name, modules, raw)
+	verifyConverterToJSON(t, converter, string(raw), string(js))
+	verifyConverterFromJSON(t, converter, string(js), string(runParserScript(t, name, modules, js, "-s")))
+}
+
+func TestNetworkConverterUnsupportedLines(t *testing.T) {
+	converter := &networkConverter{serialFile: filepath.Join(t.TempDir(), "serial.conf")}
+	raw, err := os.ReadFile("interfaces-unsupported")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// wlan0 options end at wireless-mode, the rest of the file is dropped
+	verifyConverterToJSON(t, converter, string(raw), `{
+		"interfaces": [
+			{"name": "lo", "auto": true, "mode": "inet", "method": "loopback", "options": {}},
+			{"name": "eth0", "auto": true, "mode": "inet", "method": "dhcp", "options": {"hostname": "WirenBoard"}},
+			{"name": "wlan0", "auto": true, "mode": "inet", "method": "static", "options": {
+				"address": "192.168.42.1",
+				"netmask": "255.255.255.0"
+			}}
+		]
+	}`)
+}
+
+func TestNetworkConverterMatchesParser(t *testing.T) {
+	// the script reads the serial from the same file
+	converter := &networkConverter{serialFile: WB_SERIAL_FILE}
+	raw, err := os.ReadFile("interfaces")
+	if err != nil {
+		t.Fatal(err)
+	}
+	unsupported, err := os.ReadFile("interfaces-unsupported")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, conf := range []string{
+		string(raw),
+		string(unsupported),
+		"# interfaces(5) file used by ifup(8) and ifdown(8)\n" +
+			"auto lo\niface lo inet loopback\n\n" +
+			"allow-hotplug eth0\niface eth0 inet dhcp\n" +
+			"\thostname WirenBoard  # the name\n" +
+			"    pre-up wb-set-mac # set the address\n" +
+			"# the options go on after the comment\n" +
+			"  dns-nameservers 8.8.8.8 8.8.4.4\n\n" +
+			"auto wlan0\niface wlan0 inet static\n  address 192.168.42.1\n  netmask 255.255.255.0\n" +
+			"  wpa-ssid Wiren\tBoard\n\n" +
+			"mapping hotplug\n" +
+			"auto can0\niface can0 can static\n    bitrate 125000\n" +
+			"    post-up ip link set can0 txqueuelen 100",
+		"iface ppp0 inet ppp\n  provider gsm\nauto ppp0\niface ppp0 inet ppp\n  provider modem\n",
+	} {
+		verifySameAsParserScript(t, converter, "networkparser", "pyparsing, netaddr", []byte(conf))
+	}
+}
+
+func TestNTPConverterMatchesParser(t *testing.T) {
+	raw, err := os.ReadFile("ntp.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, conf := range []string{
+		string(raw),
+		"",
+		"\n",
+		"driftfile /var/lib/ntp/ntp.drift\r\n\tpool  0.pool.ntp.org   iburst\r\nserver 10.0.0.1 ttl +0_1 unknown\r\n# end",
+	} {
+		verifySameAsParserScript(t, ntpConverter{}, "ntpparser", "json", []byte(conf))
+	}
+}
+
+type upperConverter struct{}
+
+func (upperConverter) ToJSON(raw []byte) ([]byte, error) {
+	return json.Marshal(map[string]string{"value": string(raw)})
+}
+
+func (upperConverter) FromJSON(content, orig []byte) ([]byte, error) {
+	var v map[string]string
+	err := json.Unmarshal(content, &v)
+	return []byte(v["value"]), err
+}
+
+func TestConverterRegistry(t *testing.T) {
+	for _, command := range [][]string{nil, {"builtin:ntp", "-s"}, {"/usr/bin/builtin:ntp"}} {
+		if converter, err := lookupConverter(command); converter != nil || err != nil {
+			t.Errorf("%v is an external command", command)
+		}
+	}
+	if _, err := lookupConverter([]string{"builtin:no-such-converter"}); err == nil {
+		t.Error("unknown converter must not be found")
+	}
+
+	RegisterConverter("test-value", upperConverter{})
+	converter, err := lookupConverter([]string{"builtin:test-value"})
+	if err != nil || converter != (upperConverter{}) {
+		t.Errorf("registered converter isn't found: %v, %v", converter, err)
+	}
+}
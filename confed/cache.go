@@ -0,0 +1,109 @@
+package confed
+
+import (
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"syscall"
+)
+
+// fileStamp identifies the version of the file without reading it
+type fileStamp struct {
+	dev, ino uint64
+	mtime    int64
+	size     int64
+}
+
+func fileStampOf(fi os.FileInfo) fileStamp {
+	stamp := fileStamp{mtime: fi.ModTime().UnixNano(), size: fi.Size()}
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		stamp.dev, stamp.ino = uint64(st.Dev), st.Ino
+	}
+	return stamp
+}
+
+// toJSONCache keeps the last config of the schema converted to JSON.
+// The cache is dropped with the schema on reload.
+type toJSONCache struct {
+	mtx    sync.Mutex
+	valid  bool
+	stamp  fileStamp
+	result LoadConfigResult
+}
+
+// CacheStats is the hit rate of toJSON cache of all the configs
+type CacheStats struct {
+	Hits    int64   `json:"hits"`
+	Misses  int64   `json:"misses"`
+	HitRate float64 `json:"hitRate"`
+}
+
+var toJSONCacheHits, toJSONCacheMisses atomic.Int64
+
+func toJSONCacheStats() CacheStats {
+	stats := CacheStats{Hits: toJSONCacheHits.Load(), Misses: toJSONCacheMisses.Load()}
+	if total := stats.Hits + stats.Misses; total != 0 {
+		stats.HitRate = float64(stats.Hits) / float64(total)
+	}
+	return stats
+}
+
+// lookup returns the cached result if the file isn't changed
+func (c *toJSONCache) lookup(stamp fileStamp) (LoadConfigResult, bool) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.result, c.valid && c.stamp == stamp
+}
+
+// lookupRevision returns the cached result if the file is touched
+// or replaced but its content is the same
+func (c *toJSONCache) lookupRevision(stamp fileStamp, revision string) (LoadConfigResult, bool) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if !c.valid || c.result.revision != revision {
+		return c.result, false
+	}
+	c.stamp = stamp
+	return c.result, true
+}
+
+func (c *toJSONCache) store(stamp fileStamp, res LoadConfigResult) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.valid, c.stamp, c.result = true, stamp, res
+}
+
+// loadCachedConfig reads the config file of the schema and converts it to JSON
+// unless the same file is already converted. Failed conversions aren't cached.
+func loadCachedConfig(schema *JSONSchema, cache *toJSONCache) (res LoadConfigResult, err error) {
+	f, err := os.Open(schema.PhysicalConfigPath())
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return
+	}
+	// the stamp is taken before reading, so the file changed while being read
+	// doesn't match the stamp next time
+	stamp := fileStampOf(fi)
+	if res, ok := cache.lookup(stamp); ok {
+		toJSONCacheHits.Add(1)
+		return res, nil
+	}
+	raw, err := io.ReadAll(f)
+	if err != nil {
+		return
+	}
+	if res, ok := cache.lookupRevision(stamp, contentHash(raw)); ok {
+		toJSONCacheHits.Add(1)
+		return res, nil
+	}
+	toJSONCacheMisses.Add(1)
+	if res, err = convertConfigToJSON(schema, raw); err == nil {
+		cache.store(stamp, res)
+	}
+	return
+}
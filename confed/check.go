@@ -0,0 +1,155 @@
+package confed
+
+import (
+	"encoding/json"
+	"os"
+	"sort"
+
+	"github.com/wirenboard/wbgong"
+)
+
+const (
+	CONFIG_CHECK_OK                 = "ok"
+	CONFIG_CHECK_MISSING            = "missing"
+	CONFIG_CHECK_READ_ERROR         = "readError"
+	CONFIG_CHECK_PREPROCESSOR_ERROR = "preprocessorError"
+	CONFIG_CHECK_SYNTAX_ERROR       = "syntaxError"
+	CONFIG_CHECK_INVALID            = "invalid"
+)
+
+// ConfigCheckResult is the health report of a single config file
+type ConfigCheckResult struct {
+	ConfigPath string `json:"configPath"`
+	SchemaPath string `json:"schemaPath"`
+	Status     string `json:"status"`
+	Error      string `json:"error,omitempty"`
+	// stderr of toJSON command
+	PreprocessorErrors string            `json:"preprocessorErrors,omitempty"`
+	Errors             []ValidationError `json:"errors,omitempty"`
+}
+
+func (r *ConfigCheckResult) Ok() bool {
+	return r.Status == CONFIG_CHECK_OK
+}
+
+// checkConfig loads the config file of the schema the same way
+// as Load does and reports the first problem found
+func checkConfig(schema *JSONSchema) ConfigCheckResult {
+	res := ConfigCheckResult{
+		ConfigPath: schema.ConfigPath(),
+		SchemaPath: schema.Path(),
+		Status:     CONFIG_CHECK_OK,
+	}
+
+	raw, err := os.ReadFile(schema.PhysicalConfigPath())
+	if err != nil {
+		res.Status = CONFIG_CHECK_READ_ERROR
+		if os.IsNotExist(err) {
+			res.Status = CONFIG_CHECK_MISSING
+		}
+		res.Error = err.Error()
+		return res
+	}
+
+	bs, err := convertConfigToJSON(schema, raw)
+	res.PreprocessorErrors = bs.preprocessorErrors
+	if err != nil {
+		res.Status = CONFIG_CHECK_PREPROCESSOR_ERROR
+		if schema.ConfigFormat() != "" {
+			// the natively converted config can only be unparsable
+			res.Status = CONFIG_CHECK_SYNTAX_ERROR
+		}
+		res.Error = err.Error()
+		return res
+	}
+
+	var parsed any
+	if err = json.Unmarshal(bs.content, &parsed); err != nil {
+		res.Status = CONFIG_CHECK_SYNTAX_ERROR
+		res.Error = err.Error()
+		return res
+	}
+
+	if schema.ShouldValidate() {
+		r, err := schema.ValidateContent(bs.content)
+		if err != nil {
+			res.Status = CONFIG_CHECK_INVALID
+			res.Error = err.Error()
+			return res
+		}
+		if !r.Valid() {
+			res.Status = CONFIG_CHECK_INVALID
+			res.Errors = r.Errors()
+		}
+	}
+	return res
+}
+
+type EditorCheckArgs struct {
+	// If set, only the config with this path is checked
+	Path string `json:"path,omitempty"`
+}
+
+// schemasToCheck returns the schemas of the config with the path
+// or all the schemas if the path is empty
+func (editor *Editor) schemasToCheck(path string) ([]*JSONSchema, error) {
+	editor.mtx.Lock()
+	defer editor.mtx.Unlock()
+
+	if path != "" {
+		schema, err := editor.locateSchema(path)
+		if err != nil {
+			return nil, err
+		}
+		return append([]*JSONSchema(nil), editor.schemasByConfigPath[schema.ConfigPath()]...), nil
+	}
+	schemas := make([]*JSONSchema, 0, len(editor.schemasBySchemaPath))
+	for _, schema := range editor.schemasBySchemaPath {
+		schemas = append(schemas, schema)
+	}
+	return schemas, nil
+}
+
+// configChecked records the check result in the config state
+// unless the config was changed or the schema was reloaded
+// or removed during the check
+func (editor *Editor) configChecked(schema *JSONSchema, version int, valid bool) {
+	editor.mtx.Lock()
+	defer editor.mtx.Unlock()
+
+	if editor.schemasBySchemaPath[schema.Path()] != schema || editor.events.version(schema) != version {
+		return
+	}
+	if state := editor.configStates[schema.Path()]; state != nil {
+		state.valid = boolPtr(valid)
+	}
+}
+
+// Check validates all the managed config files or the specified one.
+// The configs are checked without the editor lock, as toJSON commands
+// may take a long time.
+func (editor *Editor) Check(args *EditorCheckArgs, reply *[]ConfigCheckResult) error {
+	schemas, err := editor.schemasToCheck(args.Path)
+	if err != nil {
+		return err
+	}
+
+	*reply = make([]ConfigCheckResult, 0, len(schemas))
+	for _, schema := range schemas {
+		version := editor.events.version(schema)
+		res := checkConfig(schema)
+		if !res.Ok() {
+			wbgong.Warn.Printf("config %s check failed: %s %s", schema.PhysicalConfigPath(), res.Status, res.Error)
+		}
+		editor.configChecked(schema, version, res.Ok())
+		*reply = append(*reply, res)
+	}
+	sort.Slice(*reply, func(i, j int) bool {
+		a, b := (*reply)[i], (*reply)[j]
+		if a.ConfigPath == b.ConfigPath {
+			return a.SchemaPath < b.SchemaPath
+		}
+		return a.ConfigPath < b.ConfigPath
+	})
+	return nil
+}
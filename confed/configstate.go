@@ -0,0 +1,159 @@
+package confed
+
+import (
+	"encoding/json"
+	"os"
+	"time"
+
+	"github.com/wirenboard/wbgong"
+)
+
+// ConfigFileState describes the physical config file
+// as it's returned by Editor/List
+type ConfigFileState struct {
+	Exists   bool       `json:"exists"`
+	Modified *time.Time `json:"modified,omitempty"`
+	// false if the file was changed bypassing confed
+	// after it was last written by confed
+	ModifiedByConfed bool `json:"modifiedByConfed"`
+	// nil if the config was not validated since confed start
+	Valid *bool `json:"valid,omitempty"`
+}
+
+// configState is the part of ConfigFileState
+// which can't be obtained from the file itself
+type configState struct {
+	modifiedByConfed bool
+	valid            *bool
+}
+
+func boolPtr(v bool) *bool {
+	return &v
+}
+
+// initialConfigState finds out whether the config file is the latest
+// version written by confed using the config history
+func (editor *Editor) initialConfigState(schema *JSONSchema) *configState {
+	state := &configState{}
+	history := editor.history(schema)
+	if !history.enabled() {
+		return state
+	}
+	entries, err := history.List()
+	bs := readConfigFile(schema.PhysicalConfigPath())
+	if err == nil && len(entries) > 0 && bs != nil {
+		// the latest history entry is always the content written by confed
+		state.modifiedByConfed = entries[0].Hash == contentHash(bs)
+	}
+	return state
+}
+
+// configWritten updates the state of the schemas of the config written by confed.
+// valid is nil if the content was not validated.
+// Must be called with editor.mtx locked.
+func (editor *Editor) configWritten(schema *JSONSchema, valid *bool) {
+	for _, s := range editor.schemasByConfigPath[schema.ConfigPath()] {
+		state := editor.configStates[s.Path()]
+		if state == nil {
+			continue
+		}
+		state.modifiedByConfed = true
+		state.valid = nil
+		if s == schema {
+			state.valid = valid
+		}
+	}
+}
+
+// configChangedExternally marks the config as modified bypassing confed
+// and validates it. It's run in a separate goroutine, so the watcher
+// isn't blocked waiting for the editor lock. The config is converted
+// and validated without the lock, as toJSON command may take a long time.
+// converted is the new content of the changed schema's config already
+// converted to JSON, the other schemas of the config convert it themselves.
+func (editor *Editor) configChangedExternally(changed *JSONSchema, version int, converted LoadConfigResult, convertErr error) {
+	editor.mtx.Lock()
+	var schemas []*JSONSchema
+	for _, schema := range editor.schemasByConfigPath[changed.ConfigPath()] {
+		state := editor.configStates[schema.Path()]
+		// skip the state if the config was changed again since then
+		if state == nil || editor.events.version(schema) != version {
+			continue
+		}
+		state.modifiedByConfed = false
+		state.valid = nil
+		schemas = append(schemas, schema)
+	}
+	editor.mtx.Unlock()
+
+	for _, schema := range schemas {
+		var valid bool
+		var err error
+		if schema == changed {
+			valid, err = validateLoadedConfig(schema, converted, convertErr)
+		} else {
+			valid, err = validateConfigFile(schema)
+		}
+		if err != nil {
+			wbgong.Warn.Printf("failed to validate %s: %s", schema.PhysicalConfigPath(), err)
+			continue
+		}
+		editor.configValidated(schema, version, valid)
+	}
+}
+
+// configValidated records the validation result of the externally changed config
+// unless the config was changed again or the schema was reloaded since then
+func (editor *Editor) configValidated(schema *JSONSchema, version int, valid bool) {
+	editor.mtx.Lock()
+	defer editor.mtx.Unlock()
+
+	if editor.schemasBySchemaPath[schema.Path()] != schema || editor.events.version(schema) != version {
+		return
+	}
+	if state := editor.configStates[schema.Path()]; state != nil {
+		state.valid = boolPtr(valid)
+	}
+}
+
+// validateConfigFile checks the physical config file against the schema.
+// If the validation is disabled for the schema, only JSON syntax is checked.
+func validateConfigFile(schema *JSONSchema) (bool, error) {
+	bs, err := loadSchemaConfig(schema)
+	return validateLoadedConfig(schema, bs, err)
+}
+
+// validateLoadedConfig checks the config converted to JSON against the schema,
+// err is the error of loading the config
+func validateLoadedConfig(schema *JSONSchema, bs LoadConfigResult, err error) (bool, error) {
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if !schema.ShouldValidate() {
+		return json.Valid(bs.content), nil
+	}
+	r, err := schema.ValidateContent(bs.content)
+	if err != nil {
+		return false, err
+	}
+	return r.Valid(), nil
+}
+
+// configFileState returns the state of the schema's config file.
+// Must be called with editor.mtx locked.
+func (editor *Editor) configFileState(schema *JSONSchema) *ConfigFileState {
+	res := &ConfigFileState{}
+	if st, err := os.Stat(schema.PhysicalConfigPath()); err == nil {
+		modified := st.ModTime().UTC()
+		res.Exists = true
+		res.Modified = &modified
+	}
+	if state := editor.configStates[schema.Path()]; state != nil {
+		res.ModifiedByConfed = state.modifiedByConfed
+		res.Valid = state.valid
+	}
+	return res
+}
@@ -0,0 +1,183 @@
+package confed
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"unsafe"
+
+	"github.com/wirenboard/wbgong"
+)
+
+const (
+	// the events of the file being written, replaced or removed
+	CONFIG_WATCH_MASK = syscall.IN_CLOSE_WRITE | syscall.IN_CREATE | syscall.IN_MOVED_TO |
+		syscall.IN_MOVED_FROM | syscall.IN_DELETE
+	CONFIG_WATCH_BUFFER_SIZE = 64 * 1024
+)
+
+// configWatcher watches the config files using inotify.
+// Every directory is watched once for all the config files in it,
+// the events of the other files are dropped. The subdirectories
+// aren't watched, as the configs are often placed in big trees like /etc.
+type configWatcher struct {
+	mtx  sync.Mutex
+	fd   int
+	file *os.File
+	dirs map[string]*watchedConfigDir
+	byWd map[int32]*watchedConfigDir
+	// called with the path of the changed file
+	onChange func(path string)
+}
+
+type watchedConfigDir struct {
+	path string
+	wd   int32
+	// the number of watches of every file in the directory
+	files map[string]int
+}
+
+func newConfigWatcher(onChange func(path string)) *configWatcher {
+	return &configWatcher{
+		dirs:     make(map[string]*watchedConfigDir),
+		byWd:     make(map[int32]*watchedConfigDir),
+		onChange: onChange,
+	}
+}
+
+// watch starts watching the file, the file may be watched several times
+func (w *configWatcher) watch(path string) error {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+
+	if w.file == nil {
+		fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+		if err != nil {
+			return os.NewSyscallError("inotify_init1", err)
+		}
+		// the non-blocking file is read via the runtime poller,
+		// so closing it stops the reading goroutine
+		w.fd, w.file = fd, os.NewFile(uintptr(fd), "inotify")
+		go w.readEvents(w.file)
+	}
+
+	dirPath, name := filepath.Dir(path), filepath.Base(path)
+	dir, found := w.dirs[dirPath]
+	if !found {
+		wd, err := syscall.InotifyAddWatch(w.fd, dirPath, CONFIG_WATCH_MASK)
+		if err != nil {
+			return fmt.Errorf("can't watch %s: %w", dirPath, err)
+		}
+		dir = &watchedConfigDir{path: dirPath, wd: int32(wd), files: make(map[string]int)}
+		w.dirs[dirPath] = dir
+		w.byWd[dir.wd] = dir
+	}
+	dir.files[name]++
+	return nil
+}
+
+// unwatch stops one of the watches of the file
+func (w *configWatcher) unwatch(path string) {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+
+	dir, found := w.dirs[filepath.Dir(path)]
+	if !found {
+		return
+	}
+	name := filepath.Base(path)
+	if dir.files[name]--; dir.files[name] <= 0 {
+		delete(dir.files, name)
+	}
+	if len(dir.files) == 0 {
+		w.removeDir(dir)
+	}
+}
+
+// must be called with w.mtx locked
+func (w *configWatcher) removeDir(dir *watchedConfigDir) {
+	if w.byWd[dir.wd] == dir {
+		syscall.InotifyRmWatch(w.fd, uint32(dir.wd))
+		delete(w.byWd, dir.wd)
+	}
+	delete(w.dirs, dir.path)
+}
+
+// stop stops watching all the files
+func (w *configWatcher) stop() {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+
+	if w.file != nil {
+		w.file.Close()
+		w.file = nil
+	}
+	w.dirs = make(map[string]*watchedConfigDir)
+	w.byWd = make(map[int32]*watchedConfigDir)
+}
+
+func (w *configWatcher) readEvents(file *os.File) {
+	buf := make([]byte, CONFIG_WATCH_BUFFER_SIZE)
+	for {
+		n, err := file.Read(buf)
+		if err != nil {
+			if !errors.Is(err, os.ErrClosed) {
+				wbgong.Error.Printf("error reading config file events: %s", err)
+			}
+			return
+		}
+		for _, path := range w.changedFiles(buf[:n]) {
+			w.onChange(path)
+		}
+	}
+}
+
+// changedFiles returns the watched files mentioned in the events
+func (w *configWatcher) changedFiles(buf []byte) (paths []string) {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+
+	seen := make(map[string]bool)
+	add := func(path string) {
+		if !seen[path] {
+			seen[path] = true
+			paths = append(paths, path)
+		}
+	}
+	for offset := 0; offset+syscall.SizeofInotifyEvent <= len(buf); {
+		event := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+		start := offset + syscall.SizeofInotifyEvent
+		offset = start + int(event.Len)
+		if offset > len(buf) {
+			break
+		}
+		if event.Mask&syscall.IN_Q_OVERFLOW != 0 {
+			// the events are lost, so all the files may be changed
+			for _, dir := range w.dirs {
+				for name := range dir.files {
+					add(filepath.Join(dir.path, name))
+				}
+			}
+			continue
+		}
+		dir := w.byWd[event.Wd]
+		if dir == nil {
+			continue
+		}
+		if event.Mask&syscall.IN_IGNORED != 0 {
+			// the directory is removed
+			delete(w.byWd, dir.wd)
+			delete(w.dirs, dir.path)
+			continue
+		}
+		name := strings.TrimRight(string(buf[start:offset]), "\x00")
+		if dir.files[name] > 0 {
+			add(filepath.Join(dir.path, name))
+		}
+	}
+	return
+}
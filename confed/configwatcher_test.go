@@ -0,0 +1,135 @@
+package confed
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const CONFIG_WATCHER_TEST_TIMEOUT = 2 * time.Second
+
+func newTestConfigWatcher(t *testing.T) (*configWatcher, chan string) {
+	t.Helper()
+	changes := make(chan string, 100)
+	w := newConfigWatcher(func(path string) { changes <- path })
+	t.Cleanup(w.stop)
+	return w, changes
+}
+
+func watchConfigFile(t *testing.T, w *configWatcher, path string) {
+	t.Helper()
+	if err := w.watch(path); err != nil {
+		t.Fatalf("watch(%s) failed: %v", path, err)
+	}
+}
+
+func writeWatchedFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatalf("WriteFile() failed: %v", err)
+	}
+}
+
+func expectConfigChange(t *testing.T, changes chan string, path string) {
+	t.Helper()
+	select {
+	case changed := <-changes:
+		if changed != path {
+			t.Fatalf("change of %s expected, got %s", path, changed)
+		}
+	case <-time.After(CONFIG_WATCHER_TEST_TIMEOUT):
+		t.Fatalf("change of %s expected", path)
+	}
+}
+
+func expectNoConfigChanges(t *testing.T, changes chan string) {
+	t.Helper()
+	select {
+	case changed := <-changes:
+		t.Fatalf("unexpected change of %s", changed)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestConfigWatcherSharesDirectories(t *testing.T) {
+	dir := t.TempDir()
+	first, second := filepath.Join(dir, "first.conf"), filepath.Join(dir, "second.conf")
+	// the files are created before watching, so every write is a single event
+	writeWatchedFile(t, first, "0")
+	writeWatchedFile(t, second, "0")
+	w, changes := newTestConfigWatcher(t)
+	watchConfigFile(t, w, first)
+	watchConfigFile(t, w, first)
+	watchConfigFile(t, w, second)
+	if len(w.dirs) != 1 || len(w.byWd) != 1 {
+		t.Fatalf("the directory must be watched once, got %d watches", len(w.byWd))
+	}
+
+	// the file watched twice is reported once
+	writeWatchedFile(t, first, "1")
+	expectConfigChange(t, changes, first)
+	expectNoConfigChanges(t, changes)
+
+	w.unwatch(first)
+	writeWatchedFile(t, first, "2")
+	expectConfigChange(t, changes, first)
+
+	w.unwatch(first)
+	writeWatchedFile(t, first, "3")
+	expectNoConfigChanges(t, changes)
+	writeWatchedFile(t, second, "1")
+	expectConfigChange(t, changes, second)
+
+	w.unwatch(second)
+	if len(w.dirs) != 0 || len(w.byWd) != 0 {
+		t.Errorf("the directory must not be watched")
+	}
+}
+
+func TestConfigWatcherIgnoresOtherFiles(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "test.conf")
+	if err := os.Mkdir(filepath.Join(dir, "sub"), 0755); err != nil {
+		t.Fatalf("Mkdir() failed: %v", err)
+	}
+	w, changes := newTestConfigWatcher(t)
+	watchConfigFile(t, w, path)
+
+	writeWatchedFile(t, filepath.Join(dir, "other.conf"), "1")
+	// the subdirectories aren't watched
+	writeWatchedFile(t, filepath.Join(dir, "sub", "test.conf"), "1")
+	expectNoConfigChanges(t, changes)
+}
+
+func TestConfigWatcherEvents(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "test.conf")
+	writeWatchedFile(t, path, "0")
+	w, changes := newTestConfigWatcher(t)
+	watchConfigFile(t, w, path)
+
+	writeWatchedFile(t, path, "1")
+	expectConfigChange(t, changes, path)
+
+	tmp := filepath.Join(dir, "test.conf.tmp")
+	writeWatchedFile(t, tmp, "2")
+	if err := os.Rename(tmp, path); err != nil {
+		t.Fatalf("Rename() failed: %v", err)
+	}
+	expectConfigChange(t, changes, path)
+
+	if err := os.Remove(path); err != nil {
+		t.Fatalf("Remove() failed: %v", err)
+	}
+	expectConfigChange(t, changes, path)
+
+	w.stop()
+	writeWatchedFile(t, path, "3")
+	expectNoConfigChanges(t, changes)
+
+	// the watcher is restarted by the next watch
+	watchConfigFile(t, w, path)
+	writeWatchedFile(t, path, "4")
+	expectConfigChange(t, changes, path)
+}
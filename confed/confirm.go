@@ -0,0 +1,122 @@
+package confed
+
+import (
+	"os"
+	"time"
+
+	"github.com/wirenboard/wbgong"
+)
+
+const (
+	CONFIRM_TIMEOUT_CLIENT_ID = "confirmTimeout"
+)
+
+// pendingConfirmation is a config saved in confirm-or-revert mode.
+// Unless it's confirmed before the deadline, the previous content
+// of the config is restored and the services are restarted.
+type pendingConfirmation struct {
+	id       string
+	deadline time.Time
+	schema   *JSONSchema
+	// content of the config before the first unconfirmed save,
+	// nil if there was no config file
+	old      []byte
+	revision string
+	timer    *time.Timer
+}
+
+// armConfirmation starts waiting for the confirmation of the written config.
+// If there's a pending confirmation already, it's replaced by the new one,
+// but the content to restore is kept, so the timeout reverts all the unconfirmed saves.
+// Must be called with editor.mtx locked.
+func (editor *Editor) armConfirmation(schema *JSONSchema, old, written []byte, timeout time.Duration) *pendingConfirmation {
+	if prev, found := editor.confirmations[schema.ConfigPath()]; found {
+		prev.timer.Stop()
+		old = prev.old
+	}
+	p := &pendingConfirmation{
+		id:       newJobId(),
+		deadline: time.Now().UTC().Add(timeout),
+		schema:   schema,
+		old:      old,
+		revision: contentHash(written),
+	}
+	editor.confirmations[schema.ConfigPath()] = p
+	p.timer = time.AfterFunc(timeout, func() {
+		editor.confirmationTimedOut(schema.ConfigPath(), p.id)
+	})
+	return p
+}
+
+// cancelConfirmation drops the pending confirmation, if any.
+// Must be called with editor.mtx locked.
+func (editor *Editor) cancelConfirmation(configPath string) *pendingConfirmation {
+	p, found := editor.confirmations[configPath]
+	if !found {
+		return nil
+	}
+	p.timer.Stop()
+	delete(editor.confirmations, configPath)
+	return p
+}
+
+func (editor *Editor) confirmationTimedOut(configPath, id string) {
+	editor.mtx.Lock()
+	defer editor.mtx.Unlock()
+
+	p, found := editor.confirmations[configPath]
+	if !found || p.id != id {
+		return
+	}
+	delete(editor.confirmations, configPath)
+
+	schema := p.schema
+	// don't touch the config if it was changed bypassing confed
+	if err := checkRevision(schema, p.revision); err != nil {
+		wbgong.Warn.Printf("%s is not confirmed, but it was changed, not reverting it", schema.PhysicalConfigPath())
+		return
+	}
+	wbgong.Warn.Printf("%s is not confirmed in time, reverting it", schema.PhysicalConfigPath())
+	if p.old == nil {
+		known, err := editor.events.write(schema, nil, nil, func() error {
+			return os.Remove(schema.PhysicalConfigPath())
+		})
+		if err != nil {
+			wbgong.Error.Printf("error removing %s: %s", schema.PhysicalConfigPath(), err)
+			return
+		}
+		editor.events.publish(schema, known, nil, []string{""}, CONFIRM_TIMEOUT_CLIENT_ID, false)
+		editor.configWritten(schema, nil)
+	} else if _, err := editor.writeConfig(schema, p.old, CONFIRM_TIMEOUT_CLIENT_ID, nil); err != nil {
+		return
+	}
+	if jobId := editor.scheduleRestart(schema, nil); jobId != "" {
+		wbgong.Info.Printf("restarting services after reverting %s, job %s", schema.PhysicalConfigPath(), jobId)
+	}
+}
+
+type EditorConfirmArgs struct {
+	Path string `json:"path"`
+	// ConfirmId returned by Save. If empty,
+	// the pending confirmation of the config is confirmed
+	ConfirmId string `json:"confirmId,omitempty"`
+}
+
+// Confirm keeps the config saved in confirm-or-revert mode
+func (editor *Editor) Confirm(args *EditorConfirmArgs, reply *EditorPathResponse) error {
+	editor.mtx.Lock()
+	defer editor.mtx.Unlock()
+
+	schema, err := editor.locateSchema(args.Path)
+	if err != nil {
+		return err
+	}
+	p, found := editor.confirmations[schema.ConfigPath()]
+	if !found || (args.ConfirmId != "" && args.ConfirmId != p.id) {
+		return noPendingConfirmationError
+	}
+	editor.cancelConfirmation(schema.ConfigPath())
+	reply.Path = args.Path
+	reply.Revision = p.revision
+	return nil
+}
@@ -0,0 +1,219 @@
+package confed
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"os/user"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	DEFAULT_CONVERTER_TIMEOUT_MS      = 30000
+	DEFAULT_CONVERTER_MAX_OUTPUT_SIZE = 16 * 1024 * 1024
+	// PATH of the toJSON and fromJSON commands
+	CONVERTER_PATH = "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+	// the time to wait for the output to be closed after the converter
+	// is killed or exits, e.g. by the background processes it started
+	CONVERTER_WAIT_DELAY = time.Second
+)
+
+var (
+	errConverterTimeout        = errors.New("config converter timed out")
+	errConverterOutputTooLarge = errors.New("config converter output is too large")
+)
+
+// converterOptions limit toJSON and fromJSON commands
+type converterOptions struct {
+	timeout       time.Duration
+	maxOutputSize int
+	// the variables added to the environment
+	env map[string]string
+	// the user to run the command as, if not empty
+	user string
+}
+
+func defaultConverterOptions() *converterOptions {
+	return &converterOptions{
+		timeout:       DEFAULT_CONVERTER_TIMEOUT_MS * time.Millisecond,
+		maxOutputSize: DEFAULT_CONVERTER_MAX_OUTPUT_SIZE,
+	}
+}
+
+func extractConverterOptions(configFile map[string]any) (*converterOptions, error) {
+	// A configFile section could contain "converter" property
+	// limiting toJSON and fromJSON commands:
+	// "converter": {
+	//     "timeoutMS": 10000,
+	//     "maxOutputSize": 1048576,
+	//     "env": {"LANG": "C.UTF-8"},
+	//     "user": "nobody"
+	// }
+	opts := defaultConverterOptions()
+	v, found := configFile["converter"]
+	if !found {
+		return opts, nil
+	}
+	converter, ok := v.(map[string]any)
+	if !ok {
+		return nil, errors.New("bad converter options")
+	}
+	if v, found := converter["timeoutMS"]; found {
+		timeoutMS, ok := v.(float64)
+		if !ok || timeoutMS <= 0 {
+			return nil, fmt.Errorf("bad converter timeout %v", v)
+		}
+		opts.timeout = time.Duration(timeoutMS) * time.Millisecond
+	}
+	if v, found := converter["maxOutputSize"]; found {
+		size, ok := v.(float64)
+		if !ok || size <= 0 {
+			return nil, fmt.Errorf("bad converter output size limit %v", v)
+		}
+		opts.maxOutputSize = int(size)
+	}
+	if v, found := converter["env"]; found {
+		env, ok := v.(map[string]any)
+		if !ok {
+			return nil, errors.New("converter env must be an object")
+		}
+		opts.env = make(map[string]string, len(env))
+		for name, value := range env {
+			if opts.env[name], ok = value.(string); !ok || name == "" || strings.Contains(name, "=") {
+				return nil, fmt.Errorf("bad converter environment variable %q", name)
+			}
+		}
+	}
+	if v, found := converter["user"]; found {
+		if opts.user, ok = v.(string); !ok || opts.user == "" {
+			return nil, fmt.Errorf("bad converter user %v", v)
+		}
+	}
+	return opts, nil
+}
+
+// limitedBuffer stops the command when its output exceeds the limit
+type limitedBuffer struct {
+	buf      *bytes.Buffer
+	limit    int
+	exceeded bool
+	stop     func()
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if b.buf.Len()+len(p) > b.limit {
+		b.exceeded = true
+		b.stop()
+		return 0, errConverterOutputTooLarge
+	}
+	return b.buf.Write(p)
+}
+
+// setConverterUser makes the command run as the user
+// with the user's home directory in the environment
+func setConverterUser(cmd *exec.Cmd, name string) error {
+	u, err := user.Lookup(name)
+	if err != nil {
+		return err
+	}
+	uid, err := strconv.ParseUint(u.Uid, 10, 32)
+	if err != nil {
+		return err
+	}
+	gid, err := strconv.ParseUint(u.Gid, 10, 32)
+	if err != nil {
+		return err
+	}
+	cmd.SysProcAttr.Credential = &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid)}
+	cmd.Env = append(cmd.Env, "HOME="+u.HomeDir, "USER="+u.Username, "LOGNAME="+u.Username)
+	return nil
+}
+
+// setupConverterCmd makes the command run in its own process group
+// with the environment and the user set by the options
+func setupConverterCmd(cmd *exec.Cmd, opts *converterOptions) error {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Env = []string{"PATH=" + CONVERTER_PATH}
+	if opts.user != "" {
+		if err := setConverterUser(cmd, opts.user); err != nil {
+			return err
+		}
+	}
+	names := make([]string, 0, len(opts.env))
+	for name := range opts.env {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		cmd.Env = append(cmd.Env, name+"="+opts.env[name])
+	}
+	return nil
+}
+
+// runConverter runs toJSON or fromJSON command with the limited time and output.
+// The command runs in its own process group which is killed on timeout,
+// so the processes started by the command are killed too.
+// The command doesn't inherit the environment of wb-mqtt-confed.
+func runConverter(opts *converterOptions, commandAndArgs []string, in []byte) (res RunCommandResult, err error) {
+	if len(commandAndArgs) < 1 {
+		return res, errors.New("commandAndArgs must not be empty")
+	}
+	if opts == nil {
+		opts = defaultConverterOptions()
+	}
+	command, args := commandAndArgs[0], commandAndArgs[1:]
+
+	ctx, cancel := context.WithTimeout(context.Background(), opts.timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, command, args...)
+	if err = setupConverterCmd(cmd, opts); err != nil {
+		res.exitCode = -1
+		return res, fmt.Errorf("can't run %s as %s: %w", command, opts.user, err)
+	}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+	cmd.WaitDelay = CONVERTER_WAIT_DELAY
+
+	cmd.Stdin = bytes.NewReader(in)
+	stdout := &limitedBuffer{buf: &res.stdout, limit: opts.maxOutputSize, stop: cancel}
+	stderr := &limitedBuffer{buf: &res.stderr, limit: opts.maxOutputSize, stop: cancel}
+	cmd.Stdout, cmd.Stderr = stdout, stderr
+
+	err = cmd.Run()
+	switch {
+	case stdout.exceeded || stderr.exceeded:
+		res.exitCode = -1
+		err = fmt.Errorf("%w: %s %s produced more than %d bytes",
+			errConverterOutputTooLarge, command, strings.Join(args, " "), opts.maxOutputSize)
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		res.exitCode = -1
+		err = fmt.Errorf("%w: %s %s didn't finish in %s",
+			errConverterTimeout, command, strings.Join(args, " "), opts.timeout)
+	case err != nil:
+		res.exitCode, err = commandError(err, res.stderr.String(), command, args)
+	}
+	return
+}
+
+// commandError adds the exit status and stderr output to the error
+// of the finished command
+func commandError(err error, stderr, command string, args []string) (int, error) {
+	exitErr, ok := err.(*exec.ExitError)
+	if !ok {
+		return -1, err
+	}
+	status := -1 // FIXME
+	ws, ok := exitErr.Sys().(syscall.WaitStatus)
+	if ok {
+		status = ws.ExitStatus()
+	}
+	return status, fmt.Errorf("exit status %d from %s %s: %s",
+		status, command, strings.Join(args, " "), stderr)
+}
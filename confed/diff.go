@@ -0,0 +1,96 @@
+package confed
+
+import (
+	"encoding/json"
+	"os"
+
+	"github.com/pmezard/go-difflib/difflib"
+	"github.com/wirenboard/wbgong"
+)
+
+const DIFF_CONTEXT_LINES = 3
+
+type EditorDiffArgs struct {
+	Path    string           `json:"path"`
+	Content *json.RawMessage `json:"content"`
+	// If set, the unified diff of the physical config file
+	// produced by fromJSON command is returned as well
+	Text bool `json:"text,omitempty"`
+}
+
+type EditorDiffResponse struct {
+	ConfigPath string `json:"configPath"`
+	// revision of the current config, may be passed to Save
+	// to make sure that the config is not changed since the diff
+	Revision string       `json:"revision"`
+	Changes  []JSONChange `json:"changes"`
+	TextDiff string       `json:"textDiff,omitempty"`
+}
+
+// Diff compares the proposed content with the current config
+// without saving it. If the config file doesn't exist,
+// the whole content is reported as added.
+func (editor *Editor) Diff(args *EditorDiffArgs, reply *EditorDiffResponse) error {
+	editor.mtx.Lock()
+	defer editor.mtx.Unlock()
+
+	schema, err := editor.locateSchema(args.Path)
+	if err != nil {
+		return err
+	}
+	if args.Content == nil {
+		return invalidConfigError
+	}
+	var proposed any
+	if err = json.Unmarshal(*args.Content, &proposed); err != nil {
+		return invalidConfigError
+	}
+
+	reply.ConfigPath = schema.ConfigPath()
+	current, err := loadCurrentConfig(schema)
+	switch {
+	case err == fileNotFoundError:
+		reply.Changes = []JSONChange{{Op: JSON_CHANGE_ADD, Path: "", Value: proposed}}
+	case err != nil:
+		return err
+	default:
+		var currentDoc any
+		if err = json.Unmarshal(current.content, &currentDoc); err != nil {
+			wbgong.Error.Printf("Failed to parse config file %s: %s", schema.PhysicalConfigPath(), err)
+			return invalidConfigError
+		}
+		reply.Revision = current.revision
+		reply.Changes = diffJSON(currentDoc, proposed)
+	}
+
+	if args.Text {
+		if reply.TextDiff, err = configTextDiff(schema, *args.Content); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// configTextDiff returns the unified diff between the physical
+// config file and the file which would be written by Save
+func configTextDiff(schema *JSONSchema, content []byte) (string, error) {
+	old, err := os.ReadFile(schema.PhysicalConfigPath())
+	if err != nil && !os.IsNotExist(err) {
+		wbgong.Error.Printf("Failed to read config file %s: %s", schema.PhysicalConfigPath(), err)
+		return "", invalidConfigError
+	}
+	new, err := convertConfigFromJSON(schema, content)
+	if err != nil {
+		wbgong.Error.Printf("Failed to convert content of %s: %s", schema.PhysicalConfigPath(), err)
+		return "", conversionError(err, invalidConfigError)
+	}
+	printPreprocessorErrors(schema.PhysicalConfigPath(), new.preprocessorErrors)
+
+	return difflib.GetUnifiedDiffString(difflib.UnifiedDiff{
+		A:        difflib.SplitLines(string(old)),
+		B:        difflib.SplitLines(string(new.content)),
+		FromFile: schema.ConfigPath(),
+		ToFile:   schema.ConfigPath(),
+		Context:  DIFF_CONTEXT_LINES,
+	})
+}
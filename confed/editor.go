@@ -1,14 +1,15 @@
 package confed
 
 import (
-	"bytes"
 	"encoding/json"
+	"errors"
 	"os"
 	"path/filepath"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/wirenboard/wbgong"
 )
@@ -54,20 +55,25 @@ type RequestType int64
 
 const (
 	Sleep RequestType = iota
-	Sync
 	Restart
 )
 
 type Request struct {
 	requestType RequestType
 	properties  map[string]string
+	job         *RestartJob
 }
 
 type Editor struct {
 	mtx                 sync.Mutex
 	root                string
+	historyRoot         string
 	schemasByConfigPath map[string][]*JSONSchema
 	schemasBySchemaPath map[string]*JSONSchema
+	jobs                *jobTracker
+	confirmations       map[string]*pendingConfirmation
+	events              *configEvents
+	configStates        map[string]*configState
 	RequestCh           chan Request
 }
 
@@ -84,18 +90,70 @@ func (err *EditorError) ErrorCode() int32 {
 	return err.code
 }
 
+// RPC clients get only the code and the message of the error
+// (wbgong RPC server sends the error type name in its data field),
+// so the reason is added to the message
+func newInvalidPatchError(err error) *EditorError {
+	return &EditorError{EDITOR_ERROR_INVALID_PATCH, invalidPatchError.message + ": " + err.Error()}
+}
+
+func newInvalidPointerError(err error) *EditorError {
+	return &EditorError{EDITOR_ERROR_INVALID_POINTER, invalidPointerError.message + ": " + err.Error()}
+}
+
+// newInvalidConfigError adds the validation errors with the invalid values
+// to the message as JSON array after "Invalid config file: "
+func newInvalidConfigError(errs []ValidationError) *EditorError {
+	bs, err := json.Marshal(errs)
+	if err != nil {
+		return invalidConfigError
+	}
+	return &EditorError{EDITOR_ERROR_INVALID_CONFIG, invalidConfigError.message + ": " + string(bs)}
+}
+
+// newRoundTripError lists JSON Pointers of the values
+// changed by converting the config to its file format and back
+func newRoundTripError(pointers []string) *EditorError {
+	return &EditorError{EDITOR_ERROR_ROUND_TRIP, roundTripError.message + ": " + strings.Join(pointers, ", ")}
+}
+
+// conversionError reports the timed out toJSON or fromJSON command
+// distinctly from the other conversion errors
+func conversionError(err error, other *EditorError) *EditorError {
+	if errors.Is(err, errConverterTimeout) {
+		return converterTimeoutError
+	}
+	return other
+}
+
 const (
 	// no iota here because these values may be used
 	// by external software
-	EDITOR_ERROR_WRITE          = 1002
-	EDITOR_ERROR_FILE_NOT_FOUND = 1003
-	EDITOR_ERROR_INVALID_CONFIG = 1006
+	EDITOR_ERROR_WRITE             = 1002
+	EDITOR_ERROR_FILE_NOT_FOUND    = 1003
+	EDITOR_ERROR_INVALID_CONFIG    = 1006
+	EDITOR_ERROR_HISTORY           = 1007
+	EDITOR_ERROR_CONFLICT          = 1008
+	EDITOR_ERROR_JOB_NOT_FOUND     = 1009
+	EDITOR_ERROR_NO_CONFIRM        = 1010
+	EDITOR_ERROR_INVALID_PATCH     = 1011
+	EDITOR_ERROR_INVALID_POINTER   = 1012
+	EDITOR_ERROR_CONVERTER_TIMEOUT = 1013
+	EDITOR_ERROR_ROUND_TRIP        = 1014
 )
 
 var (
-	writeError         = &EditorError{EDITOR_ERROR_WRITE, "Error writing the file"}
-	fileNotFoundError  = &EditorError{EDITOR_ERROR_FILE_NOT_FOUND, "File not found"}
-	invalidConfigError = &EditorError{EDITOR_ERROR_INVALID_CONFIG, "Invalid config file"}
+	writeError                 = &EditorError{EDITOR_ERROR_WRITE, "Error writing the file"}
+	fileNotFoundError          = &EditorError{EDITOR_ERROR_FILE_NOT_FOUND, "File not found"}
+	invalidConfigError         = &EditorError{EDITOR_ERROR_INVALID_CONFIG, "Invalid config file"}
+	historyError               = &EditorError{EDITOR_ERROR_HISTORY, "Error accessing config history"}
+	conflictError              = &EditorError{EDITOR_ERROR_CONFLICT, "Config file was changed since it was loaded"}
+	jobNotFoundError           = &EditorError{EDITOR_ERROR_JOB_NOT_FOUND, "Job not found"}
+	noPendingConfirmationError = &EditorError{EDITOR_ERROR_NO_CONFIRM, "No pending confirmation"}
+	invalidPatchError          = &EditorError{EDITOR_ERROR_INVALID_PATCH, "Invalid patch"}
+	invalidPointerError        = &EditorError{EDITOR_ERROR_INVALID_POINTER, "Invalid JSON Pointer"}
+	converterTimeoutError      = &EditorError{EDITOR_ERROR_CONVERTER_TIMEOUT, "Config converter timed out"}
+	roundTripError             = &EditorError{EDITOR_ERROR_ROUND_TRIP, "Config isn't read back as saved"}
 )
 
 func NewEditor(root string) *Editor {
@@ -104,12 +162,40 @@ func NewEditor(root string) *Editor {
 		wbgong.Error.Printf("invalid root path %s, using /", root)
 		confRoot = root
 	}
-	return &Editor{
+	historyRoot, _, err := fakeRootPath(confRoot, HISTORY_DIR)
+	if err != nil {
+		wbgong.Error.Printf("invalid history path %s: %s", HISTORY_DIR, err)
+		historyRoot = HISTORY_DIR
+	}
+	editor := &Editor{
 		root:                confRoot,
+		historyRoot:         historyRoot,
 		schemasByConfigPath: make(map[string][]*JSONSchema),
 		schemasBySchemaPath: make(map[string]*JSONSchema),
+		jobs:                newJobTracker(),
+		confirmations:       make(map[string]*pendingConfirmation),
+		events:              newConfigEvents(),
+		configStates:        make(map[string]*configState),
 		RequestCh:           make(chan Request, RESTART_QUEUE_LEN),
 	}
+	editor.events.onExternalChange = func(schema *JSONSchema, version int, converted LoadConfigResult, err error) {
+		go editor.configChangedExternally(schema, version, converted, err)
+	}
+	return editor
+}
+
+// setMQTTClient sets the client used to publish the state
+// of service restart jobs and config change events
+func (editor *Editor) setMQTTClient(client mqttPublisher) {
+	editor.jobs.setMQTTClient(client)
+	editor.events.setMQTTClient(client)
+}
+
+// SetEditorMQTTClient sets the client used by the editor to publish
+// job states and config events. It's not an Editor method
+// in order to avoid RPC server warnings about improper methods.
+func SetEditorMQTTClient(editor *Editor, client wbgong.MQTTClient) {
+	editor.setMQTTClient(client)
 }
 
 func (editor *Editor) loadSchema(path string) (err error) {
@@ -130,6 +216,8 @@ func (editor *Editor) loadSchema(path string) (err error) {
 	} else {
 		editor.schemasByConfigPath[schema.ConfigPath()] = []*JSONSchema{schema}
 	}
+	editor.configStates[schema.Path()] = editor.initialConfigState(schema)
+	editor.events.watchConfig(schema)
 	return
 }
 
@@ -140,6 +228,8 @@ func (editor *Editor) doRemoveSchema(path string) {
 	}
 
 	schema.StopWatchingDependentFiles()
+	editor.events.unwatchConfig(schema)
+	delete(editor.configStates, schema.Path())
 	delete(editor.schemasBySchemaPath, schema.Path())
 	l := editor.schemasByConfigPath[schema.ConfigPath()]
 	if l == nil {
@@ -186,7 +276,9 @@ func (editor *Editor) List(args *struct{}, reply *[]*JSONSchemaProps) (err error
 	*reply = make([]*JSONSchemaProps, 0, len(editor.schemasBySchemaPath))
 	for _, schema := range editor.schemasBySchemaPath {
 		if !schema.HideFromList() {
-			*reply = append(*reply, schema.Properties())
+			props := *schema.Properties()
+			props.State = editor.configFileState(schema)
+			*reply = append(*reply, &props)
 		}
 	}
 	sort.Sort(ByConfigThenSchemaPath(*reply))
@@ -195,10 +287,21 @@ func (editor *Editor) List(args *struct{}, reply *[]*JSONSchemaProps) (err error
 
 type EditorPathArgs struct {
 	Path string `json:"path"`
+	// If set, Load returns the invalid config with its validation errors
+	// instead of EDITOR_ERROR_INVALID_CONFIG error
+	ErrorsInReply bool `json:"errorsInReply,omitempty"`
 }
 
 type EditorPathResponse struct {
-	Path string `json:"path"`
+	Path     string `json:"path"`
+	Revision string `json:"revision,omitempty"`
+	JobId    string `json:"jobId,omitempty"`
+	// set if the config is saved in confirm-or-revert mode
+	ConfirmId       string     `json:"confirmId,omitempty"`
+	ConfirmDeadline *time.Time `json:"confirmDeadline,omitempty"`
+	// set instead of returning EDITOR_ERROR_INVALID_CONFIG error
+	// if errorsInReply is passed, the config isn't saved then
+	Errors []ValidationError `json:"errors,omitempty"`
 }
 
 type EditorContentResponse struct {
@@ -206,6 +309,10 @@ type EditorContentResponse struct {
 	Content    *json.RawMessage `json:"content"`
 	Schema     map[string]any   `json:"schema"`
 	Editor     string           `json:"editor"`
+	Revision   string           `json:"revision"`
+	// set instead of returning EDITOR_ERROR_INVALID_CONFIG error
+	// if errorsInReply is passed
+	Errors []ValidationError `json:"errors,omitempty"`
 }
 
 func (editor *Editor) locateSchema(path string) (*JSONSchema, error) {
@@ -226,10 +333,10 @@ func (editor *Editor) Load(args *EditorPathArgs, reply *EditorContentResponse) e
 		return err
 	}
 
-	bs, err := loadConfigBytes(schema.PhysicalConfigPath(), schema.ToJSONCommand())
+	bs, err := loadSchemaConfig(schema)
 	if err != nil {
 		wbgong.Error.Printf("Failed to read config file %s: %s", schema.PhysicalConfigPath(), err)
-		return invalidConfigError
+		return conversionError(err, invalidConfigError)
 	}
 	printPreprocessorErrors(schema.PhysicalConfigPath(), bs.preprocessorErrors)
 
@@ -244,7 +351,10 @@ func (editor *Editor) Load(args *EditorPathArgs, reply *EditorContentResponse) e
 			for _, desc := range r.Errors() {
 				wbgong.Error.Printf("- %s\n", desc)
 			}
-			return invalidConfigError
+			if !args.ErrorsInReply {
+				return newInvalidConfigError(r.Errors())
+			}
+			reply.Errors = r.Errors()
 		}
 	} else if !json.Valid(bs.content) {
 		return invalidConfigError
@@ -255,13 +365,24 @@ func (editor *Editor) Load(args *EditorPathArgs, reply *EditorContentResponse) e
 	reply.Content = &content
 	reply.Schema = fixFormatProps(schema.GetPreprocessed()).(map[string]any)
 	reply.Editor = schema.Editor()
+	reply.Revision = bs.revision
 
 	return nil
 }
 
 type EditorSaveArgs struct {
-	Path    string           `json:"path"`
-	Content *json.RawMessage `json:"content"`
+	Path     string           `json:"path"`
+	Content  *json.RawMessage `json:"content"`
+	ClientId string           `json:"clientId,omitempty"`
+	// Revision returned by Load. If set, the config is saved
+	// only if it was not changed since it was loaded
+	ExpectedRevision string `json:"expectedRevision,omitempty"`
+	// If set, the previous config is restored unless
+	// Editor/Confirm is called within this time
+	ConfirmTimeoutMS int `json:"confirmTimeoutMS,omitempty"`
+	// If set, the validation errors are returned in the reply
+	// instead of EDITOR_ERROR_INVALID_CONFIG error
+	ErrorsInReply bool `json:"errorsInReply,omitempty"`
 }
 
 func (editor *Editor) Save(args *EditorSaveArgs, reply *EditorPathResponse) error {
@@ -272,6 +393,17 @@ func (editor *Editor) Save(args *EditorSaveArgs, reply *EditorPathResponse) erro
 	if err != nil {
 		return err
 	}
+	return editor.save(schema, args, nil, reply)
+}
+
+// save validates the content, converts it to the config file format,
+// writes the config and schedules restarting of the services.
+// current is the current config converted to JSON if the caller has loaded it.
+// Must be called with editor.mtx locked.
+func (editor *Editor) save(schema *JSONSchema, args *EditorSaveArgs, current []byte, reply *EditorPathResponse) (err error) {
+	if err = checkRevision(schema, args.ExpectedRevision); err != nil {
+		return err
+	}
 	if schema.ShouldValidate() {
 		r, err := schema.ValidateContent(*args.Content)
 		if err != nil {
@@ -283,48 +415,308 @@ func (editor *Editor) Save(args *EditorSaveArgs, reply *EditorPathResponse) erro
 			for _, desc := range r.Errors() {
 				wbgong.Error.Printf("- %s\n", desc)
 			}
-			return invalidConfigError
+			if !args.ErrorsInReply {
+				return newInvalidConfigError(r.Errors())
+			}
+			reply.Path = args.Path
+			reply.Errors = r.Errors()
+			return nil
 		}
 	}
 
-	var bs []byte
-	var output RunCommandResult
-	if schema.FromJSONCommand() != nil {
-		output, err = extPreprocess(schema.FromJSONCommand(), *args.Content)
+	res, err := convertConfigFromJSON(schema, *args.Content)
+	if err != nil {
+		wbgong.Error.Printf("failed to convert config %s: %s", schema.PhysicalConfigPath(), err)
+		return conversionError(err, writeError)
+	}
+	printPreprocessorErrors(schema.PhysicalConfigPath(), res.preprocessorErrors)
+	bs := res.content
+	if err = verifyRoundTrip(schema, *args.Content, bs); err != nil {
+		return err
+	}
+
+	old, err := editor.writeConfig(schema, bs, args.ClientId, &writtenJSON{old: current, new: *args.Content})
+	if err != nil {
+		return err
+	}
+	if schema.ShouldValidate() {
+		editor.configWritten(schema, boolPtr(true))
+	}
+	if args.ConfirmTimeoutMS > 0 {
+		p := editor.armConfirmation(schema, old, bs, time.Duration(args.ConfirmTimeoutMS)*time.Millisecond)
+		reply.ConfirmId = p.id
+		reply.ConfirmDeadline = &p.deadline
+	} else {
+		// saving without confirmation implicitly confirms the previous save
+		editor.cancelConfirmation(schema.ConfigPath())
+	}
+	reply.JobId = editor.scheduleRestart(schema, editor.rollbackFunc(schema, old, bs))
+	reply.Path = args.Path
+	reply.Revision = contentHash(bs)
+	return nil
+}
+
+// checkRevision makes sure that the physical config file
+// was not changed since the revision was loaded
+func checkRevision(schema *JSONSchema, expectedRevision string) error {
+	if expectedRevision == "" {
+		return nil
+	}
+	bs, err := os.ReadFile(schema.PhysicalConfigPath())
+	if err != nil && !os.IsNotExist(err) {
+		wbgong.Error.Printf("error reading %s: %s", schema.PhysicalConfigPath(), err)
+		return writeError
+	}
+	if err != nil || contentHash(bs) != expectedRevision {
+		wbgong.Warn.Printf("%s was changed since revision %s", schema.PhysicalConfigPath(), expectedRevision)
+		return conflictError
+	}
+	return nil
+}
+
+type EditorValidateResponse struct {
+	Valid              bool              `json:"valid"`
+	Errors             []ValidationError `json:"errors"`
+	Content            string            `json:"content"`
+	PreprocessorErrors string            `json:"preprocessorErrors,omitempty"`
+}
+
+// Validate checks the content the same way as Save does and returns
+// the config file that would be written, without touching the disk
+func (editor *Editor) Validate(args *EditorSaveArgs, reply *EditorValidateResponse) error {
+	editor.mtx.Lock()
+	defer editor.mtx.Unlock()
+
+	schema, err := editor.locateSchema(args.Path)
+	if err != nil {
+		return err
+	}
+	if args.Content == nil {
+		return invalidConfigError
+	}
+
+	reply.Valid = true
+	reply.Errors = []ValidationError{}
+	if schema.ShouldValidate() {
+		r, err := schema.ValidateContent(*args.Content)
 		if err != nil {
-			wbgong.Error.Printf("external command error, %s: %s", schema.PhysicalConfigPath(), err)
-			return writeError
+			wbgong.Error.Printf("Failed to validate config file: %v", err)
+			return invalidConfigError
 		}
-		bs = output.stdout.Bytes()
-		if output.stderr.Len() != 0 {
-			printPreprocessorErrors(schema.PhysicalConfigPath(), output.stderr.String())
+		reply.Errors = r.Errors()
+		reply.Valid = r.Valid()
+	}
+	if !reply.Valid {
+		return nil
+	}
+
+	res, err := convertConfigFromJSON(schema, *args.Content)
+	if err != nil {
+		wbgong.Error.Printf("failed to convert config %s: %s", schema.PhysicalConfigPath(), err)
+		return conversionError(err, writeError)
+	}
+	if err = verifyRoundTrip(schema, *args.Content, res.content); err != nil {
+		return err
+	}
+	reply.Content = string(res.content)
+	reply.PreprocessorErrors = res.preprocessorErrors
+	return nil
+}
+
+func (editor *Editor) history(schema *JSONSchema) *configHistory {
+	return newConfigHistory(editor.historyRoot, schema.ConfigPath(), schema.HistoryMaxCount(), schema.HistoryMaxSize())
+}
+
+// writtenJSON is JSON of the written config and of the replaced one,
+// old is nil if the caller doesn't have it
+type writtenJSON struct {
+	old, new []byte
+}
+
+// savedConfigPointers finds out the values changed by writing bs.
+// External toJSON command isn't run for it under the editor lock,
+// the whole config is reported as changed if any of the JSONs is unknown.
+func (editor *Editor) savedConfigPointers(schema *JSONSchema, old, bs []byte, js writtenJSON) []string {
+	if js.old == nil {
+		js.old = editor.events.knownJSON(schema, old)
+	}
+	for _, v := range []struct {
+		json    *[]byte
+		content []byte
+	}{{&js.old, old}, {&js.new, bs}} {
+		if *v.json == nil && v.content != nil && !hasExternalToJSON(schema) {
+			if res, err := convertConfigToJSON(schema, v.content); err == nil {
+				*v.json = res.content
+			}
 		}
+	}
+	return changedJSONContentPointers(js.old, js.new)
+}
+
+// writeConfig replaces the physical config file with bs
+// and records both the replaced and the new content in the history.
+// js is the JSON of the configs if it's known, otherwise the configs
+// are converted to JSON to find out the changed values unless
+// it needs external toJSON command.
+// The replaced content is returned, it's nil if there was no config file.
+func (editor *Editor) writeConfig(schema *JSONSchema, bs []byte, clientId string, js *writtenJSON) (old []byte, err error) {
+	old, err = os.ReadFile(schema.PhysicalConfigPath())
+	if err != nil {
+		old = nil
+	}
+	var newJSON []byte
+	if js != nil {
+		newJSON = js.new
 	} else {
-		var indented bytes.Buffer
-		if err = json.Indent(&indented, *args.Content, "", "    "); err != nil {
-			wbgong.Error.Printf("json.Indent() error, %s: %s", schema.PhysicalConfigPath(), err)
-			return writeError
+		js = &writtenJSON{}
+	}
+	changed := editor.savedConfigPointers(schema, old, bs, *js)
+
+	history := editor.history(schema)
+	// the current content may be not recorded yet
+	// if the file was created or changed without confed
+	if history.enabled() && old != nil {
+		if _, err = history.Record(old, configFileMode(schema.PhysicalConfigPath()), ""); err != nil {
+			wbgong.Warn.Printf("failed to record history of %s: %s", schema.PhysicalConfigPath(), err)
 		}
-		bs = indented.Bytes()
 	}
 
-	if err = os.WriteFile(schema.PhysicalConfigPath(), bs, 0777); err != nil {
+	// the config watcher must not take our own write for an external change
+	_, err = editor.events.write(schema, bs, newJSON, func() error {
+		return writeFileAtomic(schema.PhysicalConfigPath(), bs, DEFAULT_CONFIG_FILE_MODE)
+	})
+	if err != nil {
 		wbgong.Error.Printf("error writing %s: %s", schema.PhysicalConfigPath(), err)
-		return writeError
+		return nil, writeError
 	}
+	editor.events.publish(schema, old, bs, changed, clientId, false)
+	editor.configWritten(schema, nil)
 
-	if schema.RestartDelayMS() > 0 {
-		editor.RequestCh <- Request{Sleep, map[string]string{"delay": strconv.Itoa(schema.RestartDelayMS())}}
-	} else {
-		editor.RequestCh <- Request{Sync, map[string]string{"path": schema.PhysicalConfigPath()}}
+	if history.enabled() {
+		if _, err = history.Record(bs, configFileMode(schema.PhysicalConfigPath()), clientId); err != nil {
+			wbgong.Warn.Printf("failed to record history of %s: %s", schema.PhysicalConfigPath(), err)
+		}
 	}
+	return old, nil
+}
 
-	reply.Path = args.Path
-	if schema.Services() != nil {
-		for _, service := range schema.Services() {
-			editor.RequestCh <- Request{Restart, map[string]string{"service": service}}
+// rollbackFunc returns the function restoring the old content of the config
+// if the schema requires rollback on the service failure
+func (editor *Editor) rollbackFunc(schema *JSONSchema, old, written []byte) func() error {
+	if !schema.RollbackOnFailure() || old == nil {
+		return nil
+	}
+	revision := contentHash(written)
+	return func() error {
+		editor.mtx.Lock()
+		defer editor.mtx.Unlock()
+
+		// don't overwrite the config saved after the failed one
+		if err := checkRevision(schema, revision); err != nil {
+			return err
+		}
+		wbgong.Warn.Printf("rolling back %s", schema.PhysicalConfigPath())
+		_, err := editor.writeConfig(schema, old, ROLLBACK_CLIENT_ID, nil)
+		return err
+	}
+}
+
+// scheduleRestart queues restarting of the schema services
+// and returns the id of the restart job, if there are services to restart
+func (editor *Editor) scheduleRestart(schema *JSONSchema, rollback func() error) string {
+	var job *RestartJob
+	if len(schema.Services()) > 0 {
+		job = editor.jobs.start(schema.ConfigPath(), schema.Services())
+		job.serviceAction = schema.ServiceAction()
+		job.serviceCommand = schema.ServiceCommand()
+		if rollback != nil {
+			job.rollback = rollback
+			job.checkTimeout = time.Duration(schema.RollbackTimeoutMS()) * time.Millisecond
 		}
 	}
+
+	if schema.RestartDelayMS() > 0 {
+		editor.RequestCh <- Request{Sleep, map[string]string{"delay": strconv.Itoa(schema.RestartDelayMS())}, job}
+	}
+
+	if job == nil {
+		return ""
+	}
+	for _, service := range schema.Services() {
+		editor.RequestCh <- Request{Restart, map[string]string{"service": service}, job}
+	}
+	return job.Id
+}
+
+type EditorJobArgs struct {
+	Id string `json:"id"`
+}
+
+func (editor *Editor) JobStatus(args *EditorJobArgs, reply *RestartJob) error {
+	job, found := editor.jobs.Get(args.Id)
+	if !found {
+		return jobNotFoundError
+	}
+	*reply = job
+	return nil
+}
+
+// CacheStats returns the hit rate of the cache of configs converted to JSON
+func (editor *Editor) CacheStats(args *struct{}, reply *CacheStats) error {
+	*reply = toJSONCacheStats()
+	return nil
+}
+
+func (editor *Editor) History(args *EditorPathArgs, reply *[]*HistoryEntry) error {
+	editor.mtx.Lock()
+	defer editor.mtx.Unlock()
+
+	schema, err := editor.locateSchema(args.Path)
+	if err != nil {
+		return err
+	}
+
+	entries, err := editor.history(schema).List()
+	if err != nil {
+		wbgong.Error.Printf("failed to read history of %s: %s", schema.PhysicalConfigPath(), err)
+		return historyError
+	}
+	*reply = entries
+	return nil
+}
+
+type EditorRestoreArgs struct {
+	Path     string `json:"path"`
+	Id       string `json:"id"`
+	ClientId string `json:"clientId,omitempty"`
+}
+
+func (editor *Editor) Restore(args *EditorRestoreArgs, reply *EditorPathResponse) error {
+	editor.mtx.Lock()
+	defer editor.mtx.Unlock()
+
+	schema, err := editor.locateSchema(args.Path)
+	if err != nil {
+		return err
+	}
+
+	bs, err := editor.history(schema).Content(args.Id)
+	if err == errHistoryEntryNotFound {
+		return fileNotFoundError
+	}
+	if err != nil {
+		wbgong.Error.Printf("failed to read history entry %s of %s: %s", args.Id, schema.PhysicalConfigPath(), err)
+		return historyError
+	}
+
+	old, err := editor.writeConfig(schema, bs, args.ClientId, nil)
+	if err != nil {
+		return err
+	}
+	editor.cancelConfirmation(schema.ConfigPath())
+	reply.JobId = editor.scheduleRestart(schema, editor.rollbackFunc(schema, old, bs))
+	reply.Path = args.Path
+	reply.Revision = contentHash(bs)
 	return nil
 }
 
@@ -332,6 +724,16 @@ func (editor *Editor) stopWatchingDependentFiles() {
 	for _, schema := range editor.schemasBySchemaPath {
 		schema.StopWatchingDependentFiles()
 	}
+	editor.events.stopWatching()
+}
+
+// StopEditorWatchers stops watching the dependent files of the schemas
+// and the config files. It's not an Editor method for the same reason
+// as SetEditorMQTTClient.
+func StopEditorWatchers(editor *Editor) {
+	editor.mtx.Lock()
+	defer editor.mtx.Unlock()
+	editor.stopWatchingDependentFiles()
 }
 
 // We don't provide LoadFile / LiveLoadFile / LiveRemoveFile
@@ -1,9 +1,12 @@
 package confed
 
 import (
+	"encoding/json"
+	"fmt"
 	"os"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/objx"
 	"github.com/wirenboard/wbgong/testutils"
@@ -155,7 +158,8 @@ func (s *EditorSuite) SetupTest() {
 	s.RpcFixture = testutils.NewRpcFixture(
 		s.T(), "confed", "Editor", "confed",
 		s.editor,
-		"List", "Load", "Save")
+		"List", "Load", "Save", "Validate", "History", "Restore", "JobStatus", "Confirm", "Check", "Patch", "Get", "Set", "Diff",
+		"CacheStats")
 }
 
 func (s *EditorSuite) TearDownTest() {
@@ -399,9 +403,11 @@ func (s *EditorSuite) SkipTestRestart() {
 		"path": "/etc/network/interfaces",
 	})
 	restart := <-s.editor.RequestCh
-	s.Equal(Request{Sleep, map[string]string{"delay": "4000"}}, restart)
+	s.Equal(Sleep, restart.requestType)
+	s.Equal(map[string]string{"delay": "4000"}, restart.properties)
 	restart = <-s.editor.RequestCh
-	s.Equal(Request{Restart, map[string]string{"service": "networking"}}, restart)
+	s.Equal(Restart, restart.requestType)
+	s.Equal(map[string]string{"service": "networking"}, restart.properties)
 }
 
 func (s *EditorSuite) SkipTestMultipleSchemasPerConfig() {
@@ -458,6 +464,952 @@ func (s *EditorSuite) SkipTestMultipleSchemasPerConfig() {
 	s.verifyJSONFile("sample.json", content)
 }
 
+func (s *EditorSuite) saveSampleContent(content objx.Map, clientId string) {
+	bs := json.RawMessage(content.MustJSON())
+	var reply EditorPathResponse
+	s.Ck("Save()", s.editor.Save(&EditorSaveArgs{Path: "/sample.json", Content: &bs, ClientId: clientId}, &reply))
+}
+
+func (s *EditorSuite) TestHistoryAndRestore() {
+	original := s.ReadSourceDataFile("sample.json")
+	newContent := objx.Map{
+		"device_type": "MSU21",
+		"name":        "MSU21 (updated)",
+		"id":          "msu21",
+		"slave_id":    float64(42),
+	}
+	s.saveSampleContent(newContent, "client1")
+
+	var entries []*HistoryEntry
+	s.Ck("History()", s.editor.History(&EditorPathArgs{Path: "/sample.json"}, &entries))
+	s.Require().Len(entries, 2)
+	s.Equal("client1", entries[0].ClientId)
+	s.Equal("", entries[1].ClientId)
+	s.Equal(contentHash([]byte(original)), entries[1].Hash)
+
+	var reply EditorPathResponse
+	s.Ck("Restore()", s.editor.Restore(&EditorRestoreArgs{Path: "/sample.json", Id: entries[1].Id, ClientId: "client2"}, &reply))
+	s.Equal("/sample.json", reply.Path)
+	s.verifyTextFile("sample.json", original)
+
+	s.Ck("History()", s.editor.History(&EditorPathArgs{Path: "/sample.json"}, &entries))
+	s.Require().Len(entries, 3)
+	s.Equal("client2", entries[0].ClientId)
+
+	s.Equal(fileNotFoundError, s.editor.Restore(&EditorRestoreArgs{Path: "/sample.json", Id: "nosuchid"}, &reply))
+}
+
+func (s *EditorSuite) TestHistoryKeepsConfigFileMode() {
+	s.Ck("Chmod()", os.Chmod(s.DataFilePath("sample.json"), 0600))
+	s.saveSampleContent(objx.Map{"device_type": "MSU21", "slave_id": float64(42)}, "client1")
+
+	var entries []*HistoryEntry
+	s.Ck("History()", s.editor.History(&EditorPathArgs{Path: "/sample.json"}, &entries))
+	s.Require().Len(entries, 2)
+	history := s.editor.history(s.editor.schemasBySchemaPath["/sample.schema.json"])
+	for _, entry := range entries {
+		fi, err := os.Stat(history.contentPath(entry.Id))
+		s.Ck("Stat()", err)
+		s.Equal(os.FileMode(0600), fi.Mode().Perm())
+	}
+	fi, err := os.Stat(history.dir)
+	s.Ck("Stat()", err)
+	s.Equal(os.FileMode(HISTORY_DIR_MODE), fi.Mode().Perm())
+}
+
+func (s *EditorSuite) TestValidate() {
+	original := s.ReadSourceDataFile("sample.json")
+	content := json.RawMessage(`{"device_type":"MSU21","slave_id":42}`)
+	var reply EditorValidateResponse
+	s.Ck("Validate()", s.editor.Validate(&EditorSaveArgs{Path: "/sample.json", Content: &content}, &reply))
+	s.True(reply.Valid)
+	s.Empty(reply.Errors)
+	// the formatting of the existing file is preserved
+	s.Equal("{\n  \"device_type\" : \"MSU21\",\n  \"slave_id\": 42\n}\n", reply.Content)
+
+	content = json.RawMessage(`{"wtf": 100}`)
+	reply = EditorValidateResponse{}
+	s.Ck("Validate()", s.editor.Validate(&EditorSaveArgs{Path: "/sample.json", Content: &content}, &reply))
+	s.False(reply.Valid)
+	s.NotEmpty(reply.Errors)
+	s.Empty(reply.Content)
+
+	s.verifyTextFile("sample.json", original)
+	s.Empty(s.editor.RequestCh)
+}
+
+func (s *EditorSuite) TestSaveInvalidConfigErrors() {
+	original := s.ReadSourceDataFile("sample.json")
+	content := objx.Map{"device_type": "MSU21", "slave_id": "42"}
+	s.VerifyRpcError("Save", objx.Map{
+		"path":    "/sample.json",
+		"content": content,
+	}, EDITOR_ERROR_INVALID_CONFIG, "EditorError", `Invalid config file: [{"pointer":"/slave_id",`+
+		`"keyword":"type","message":"Invalid type. Expected: integer, given: string","value":"42"}]`)
+	s.VerifyRpc("Save", objx.Map{
+		"path":          "/sample.json",
+		"content":       content,
+		"errorsInReply": true,
+	}, objx.Map{
+		"path": "/sample.json",
+		"errors": []objx.Map{{
+			"pointer": "/slave_id",
+			"keyword": "type",
+			"message": "Invalid type. Expected: integer, given: string",
+			"value":   "42",
+		}},
+	})
+	s.verifyTextFile("sample.json", original)
+	s.Empty(s.editor.RequestCh)
+
+	s.VerifyRpc("Patch", objx.Map{
+		"path":          "/sample.json",
+		"patch":         objx.Map{"slave_id": -1},
+		"errorsInReply": true,
+	}, objx.Map{
+		"path": "/sample.json",
+		"errors": []objx.Map{{
+			"pointer": "/slave_id",
+			"keyword": "minimum",
+			"message": "Must be greater than or equal to 0",
+			"value":   -1,
+		}},
+	})
+	s.verifyTextFile("sample.json", original)
+}
+
+func (s *EditorSuite) TestLoadInvalidConfigErrors() {
+	s.WriteDataFile("sample.json", `{"device_type": "MSU21", "slave_id": "42"}`)
+	s.VerifyRpcError("Load", objx.Map{"path": "/sample.json"},
+		EDITOR_ERROR_INVALID_CONFIG, "EditorError", `Invalid config file: [{"pointer":"/slave_id",`+
+			`"keyword":"type","message":"Invalid type. Expected: integer, given: string","value":"42"}]`)
+
+	var reply EditorContentResponse
+	s.Ck("Load()", s.editor.Load(&EditorPathArgs{Path: "/sample.json", ErrorsInReply: true}, &reply))
+	s.JSONEq(`{"device_type": "MSU21", "slave_id": "42"}`, string(*reply.Content))
+	s.Equal([]ValidationError{{
+		Pointer: "/slave_id",
+		Keyword: "type",
+		Message: "Invalid type. Expected: integer, given: string",
+		Value:   "42",
+	}}, reply.Errors)
+}
+
+func (s *EditorSuite) TestSaveExpectedRevision() {
+	var loaded EditorContentResponse
+	s.Ck("Load()", s.editor.Load(&EditorPathArgs{Path: "/sample.json"}, &loaded))
+	s.Equal(contentHash([]byte(s.ReadSourceDataFile("sample.json"))), loaded.Revision)
+
+	content := json.RawMessage(`{"device_type": "MSU21", "slave_id": 42}`)
+	var reply EditorPathResponse
+	s.Ck("Save()", s.editor.Save(&EditorSaveArgs{
+		Path:             "/sample.json",
+		Content:          &content,
+		ExpectedRevision: loaded.Revision,
+	}, &reply))
+	s.NotEqual(loaded.Revision, reply.Revision)
+
+	// another client saves the config loaded before the change
+	s.Equal(conflictError, s.editor.Save(&EditorSaveArgs{
+		Path:             "/sample.json",
+		Content:          &content,
+		ExpectedRevision: loaded.Revision,
+	}, &EditorPathResponse{}))
+
+	// the file is changed outside of confed
+	s.WriteDataFile("sample.json", `{"device_type": "MSU21", "slave_id": 43}`)
+	s.Equal(conflictError, s.editor.Save(&EditorSaveArgs{
+		Path:             "/sample.json",
+		Content:          &content,
+		ExpectedRevision: reply.Revision,
+	}, &EditorPathResponse{}))
+	s.verifyJSONFile("sample.json", objx.Map{"device_type": "MSU21", "slave_id": float64(43)})
+}
+
+func (s *EditorSuite) TestJobStatus() {
+	s.CopyDataFilesToTempDir("another.json")
+	s.WriteDataFile("another.schema.json", strings.Replace(
+		s.ReadSourceDataFile("another.schema.json"),
+		`"path": "/another.json"`,
+		`"path": "/another.json", "service": ["svc1", "svc2"]`, 1))
+	s.Ck("loadSchema()", s.editor.loadSchema(s.DataFilePath("another.schema.json")))
+
+	content := json.RawMessage(`{"name": "foo"}`)
+	var reply EditorPathResponse
+	s.Ck("Save()", s.editor.Save(&EditorSaveArgs{Path: "/another.json", Content: &content}, &reply))
+	s.NotEmpty(reply.JobId)
+
+	for _, service := range []string{"svc1", "svc2"} {
+		req := <-s.editor.RequestCh
+		s.Equal(Restart, req.requestType)
+		s.Equal(service, req.properties["service"])
+		s.Equal(reply.JobId, req.job.Id)
+	}
+
+	var job RestartJob
+	s.Ck("JobStatus()", s.editor.JobStatus(&EditorJobArgs{Id: reply.JobId}, &job))
+	s.Equal("/another.json", job.ConfigPath)
+	s.Equal(JOB_STATE_PENDING, job.State)
+	s.Len(job.Services, 2)
+
+	s.Equal(jobNotFoundError, s.editor.JobStatus(&EditorJobArgs{Id: "nosuchjob"}, &job))
+}
+
+func (s *EditorSuite) TestRollbackOnFailure() {
+	s.CopyDataFilesToTempDir("another.json")
+	s.WriteDataFile("another.schema.json", strings.Replace(
+		s.ReadSourceDataFile("another.schema.json"),
+		`"path": "/another.json"`,
+		`"path": "/another.json", "service": "svc1", "rollbackOnFailure": true, "rollbackTimeoutMS": 100`, 1))
+	s.Ck("loadSchema()", s.editor.loadSchema(s.DataFilePath("another.schema.json")))
+	orig := s.ReadSourceDataFile("another.json")
+
+	save := func(name string) *RestartJob {
+		content := json.RawMessage(`{"name": "` + name + `"}`)
+		var reply EditorPathResponse
+		s.Ck("Save()", s.editor.Save(&EditorSaveArgs{Path: "/another.json", Content: &content}, &reply))
+		req := <-s.editor.RequestCh
+		s.Equal(reply.JobId, req.job.Id)
+		s.NotNil(req.job.rollback)
+		s.Equal(100*time.Millisecond, req.job.checkTimeout)
+		return req.job
+	}
+
+	job := save("foo")
+	s.True(job.serviceRestarted("svc1", RunCommandResult{}, nil, "failed"))
+	s.Ck("rollback()", job.rollback())
+	bs, err := os.ReadFile(s.DataFilePath("another.json"))
+	s.Ck("ReadFile()", err)
+	s.Equal(orig, string(bs))
+
+	// the config saved after the failed one must not be overwritten
+	job = save("bar")
+	save("baz")
+	s.Equal(conflictError, job.rollback())
+	bs, err = os.ReadFile(s.DataFilePath("another.json"))
+	s.Ck("ReadFile()", err)
+	s.Contains(string(bs), "baz")
+}
+
+func (s *EditorSuite) saveWithConfirm(name string, timeoutMS int) EditorPathResponse {
+	content := json.RawMessage(`{"name": "` + name + `"}`)
+	var reply EditorPathResponse
+	s.Ck("Save()", s.editor.Save(&EditorSaveArgs{
+		Path:             "/another.json",
+		Content:          &content,
+		ConfirmTimeoutMS: timeoutMS,
+	}, &reply))
+	<-s.editor.RequestCh
+	return reply
+}
+
+func (s *EditorSuite) setUpConfirmTest() string {
+	s.CopyDataFilesToTempDir("another.json")
+	s.WriteDataFile("another.schema.json", strings.Replace(
+		s.ReadSourceDataFile("another.schema.json"),
+		`"path": "/another.json"`,
+		`"path": "/another.json", "service": "svc1"`, 1))
+	s.Ck("loadSchema()", s.editor.loadSchema(s.DataFilePath("another.schema.json")))
+	return s.ReadSourceDataFile("another.json")
+}
+
+func (s *EditorSuite) readAnother() string {
+	bs, err := os.ReadFile(s.DataFilePath("another.json"))
+	s.Ck("ReadFile()", err)
+	return string(bs)
+}
+
+func (s *EditorSuite) TestConfirm() {
+	s.setUpConfirmTest()
+
+	reply := s.saveWithConfirm("foo", 60000)
+	s.NotEmpty(reply.ConfirmId)
+	s.NotNil(reply.ConfirmDeadline)
+
+	var confirmReply EditorPathResponse
+	s.Equal(noPendingConfirmationError, s.editor.Confirm(
+		&EditorConfirmArgs{Path: "/another.json", ConfirmId: "nosuchid"}, &confirmReply))
+	s.Ck("Confirm()", s.editor.Confirm(
+		&EditorConfirmArgs{Path: "/another.json", ConfirmId: reply.ConfirmId}, &confirmReply))
+	s.Equal(reply.Revision, confirmReply.Revision)
+	s.Equal(noPendingConfirmationError, s.editor.Confirm(
+		&EditorConfirmArgs{Path: "/another.json"}, &confirmReply))
+	s.Contains(s.readAnother(), "foo")
+
+	// saving without confirmation confirms the pending save
+	s.saveWithConfirm("bar", 60000)
+	s.saveWithConfirm("baz", 0)
+	s.Equal(noPendingConfirmationError, s.editor.Confirm(
+		&EditorConfirmArgs{Path: "/another.json"}, &confirmReply))
+}
+
+func (s *EditorSuite) TestConfirmTimeout() {
+	orig := s.setUpConfirmTest()
+
+	// all unconfirmed saves are reverted
+	s.saveWithConfirm("foo", 60000)
+	s.saveWithConfirm("bar", 50)
+
+	select {
+	case req := <-s.editor.RequestCh:
+		s.Equal(Restart, req.requestType)
+		s.Equal("svc1", req.properties["service"])
+		s.NotNil(req.job)
+	case <-time.After(5 * time.Second):
+		s.Fail("services are not restarted after revert")
+	}
+	s.Equal(orig, s.readAnother())
+
+	var confirmReply EditorPathResponse
+	s.Equal(noPendingConfirmationError, s.editor.Confirm(
+		&EditorConfirmArgs{Path: "/another.json"}, &confirmReply))
+}
+
+func (s *EditorSuite) waitForEvent(publisher *fakePublisher) ConfigEvent {
+	return s.waitForConfigEvent(publisher, "/another.json")
+}
+
+func (s *EditorSuite) waitForConfigEvent(publisher *fakePublisher, configPath string) (event ConfigEvent) {
+	s.WaitFor(func() bool {
+		publisher.Lock()
+		defer publisher.Unlock()
+		for _, message := range publisher.messages {
+			if message.Topic == EVENTS_TOPIC_PREFIX+configPath {
+				s.Ck("Unmarshal()", json.Unmarshal([]byte(message.Payload), &event))
+				publisher.messages = nil
+				return true
+			}
+		}
+		return false
+	})
+	return
+}
+
+func (s *EditorSuite) TestConfigEvents() {
+	s.CopyDataFilesToTempDir("another.json", "another.schema.json")
+	s.Ck("loadSchema()", s.editor.loadSchema(s.DataFilePath("another.schema.json")))
+	publisher := &fakePublisher{}
+	s.editor.events.setMQTTClient(publisher)
+
+	content := json.RawMessage(`{"name": "foo"}`)
+	var reply EditorPathResponse
+	s.Ck("Save()", s.editor.Save(&EditorSaveArgs{Path: "/another.json", Content: &content, ClientId: "client1"}, &reply))
+	event := s.waitForEvent(publisher)
+	s.Equal("/another.json", event.ConfigPath)
+	s.Equal("/another.schema.json", event.SchemaPath)
+	s.Equal(reply.Revision, event.Revision)
+	s.Equal([]string{"/name"}, event.Changed)
+	s.Equal("client1", event.ClientId)
+	s.False(event.External)
+
+	// our own write must not be reported by the watcher
+	time.Sleep(100 * time.Millisecond)
+	publisher.Lock()
+	s.Empty(publisher.messages)
+	publisher.Unlock()
+
+	// write the file atomically, so the watcher doesn't see it half-written
+	s.WriteDataFile("another.json.tmp", `{"name": "foo", "active": true}`)
+	s.Ck("Rename()", os.Rename(s.DataFilePath("another.json.tmp"), s.DataFilePath("another.json")))
+	event = s.waitForEvent(publisher)
+	s.True(event.External)
+	s.Empty(event.ClientId)
+	s.Equal([]string{"/active"}, event.Changed)
+}
+
+func (s *EditorSuite) TestConfigEventsWithoutToJSON() {
+	// saving must not run external toJSON to find out the changes
+	counter := s.DataFilePath("runs")
+	s.WriteDataFile("converted.schema.json", fmt.Sprintf(`{
+		"type": "object",
+		"configFile": {
+			"path": "/converted.json",
+			"toJSON": ["sh", "-c", "echo >>%s; cat"],
+			"fromJSON": ["cat"]
+		}
+	}`, counter))
+	s.WriteDataFile("converted.json", `{"a": 1}`)
+	s.WriteDataFile("runs", "")
+	s.Ck("loadSchema()", s.editor.loadSchema(s.DataFilePath("converted.schema.json")))
+	publisher := &fakePublisher{}
+	s.editor.events.setMQTTClient(publisher)
+	runs := func() int {
+		bs, err := os.ReadFile(counter)
+		s.Ck("ReadFile()", err)
+		return strings.Count(string(bs), "\n")
+	}
+
+	save := func(content string) ConfigEvent {
+		raw := json.RawMessage(content)
+		var reply EditorPathResponse
+		s.Ck("Save()", s.editor.Save(&EditorSaveArgs{Path: "/converted.json", Content: &raw}, &reply))
+		return s.waitForConfigEvent(publisher, "/converted.json")
+	}
+	// the JSON of the file existing before confed start is unknown
+	s.Equal([]string{""}, save(`{"a": 2}`).Changed)
+	s.Equal([]string{"/b"}, save(`{"a": 2, "b": 3}`).Changed)
+	s.Equal(0, runs())
+
+	// Patch has the current config loaded already
+	patch := json.RawMessage(`{"a": 4}`)
+	var reply EditorPathResponse
+	s.Ck("Patch()", s.editor.Patch(&EditorPatchArgs{
+		Path:  "/converted.json",
+		Patch: &patch,
+		Type:  PATCH_TYPE_MERGE_PATCH,
+	}, &reply))
+	s.Equal([]string{"/a"}, s.waitForConfigEvent(publisher, "/converted.json").Changed)
+	s.Equal(1, runs())
+
+	// neither Restore knows the JSON of the restored config
+	var entries []*HistoryEntry
+	s.Ck("History()", s.editor.History(&EditorPathArgs{Path: "/converted.json"}, &entries))
+	s.Require().NotEmpty(entries)
+	s.Ck("Restore()", s.editor.Restore(&EditorRestoreArgs{Path: "/converted.json", Id: entries[len(entries)-1].Id}, &reply))
+	s.Equal([]string{""}, s.waitForConfigEvent(publisher, "/converted.json").Changed)
+	s.Equal(1, runs())
+}
+
+func (s *EditorSuite) anotherConfigState() *ConfigFileState {
+	var list []*JSONSchemaProps
+	s.Ck("List()", s.editor.List(&struct{}{}, &list))
+	for _, props := range list {
+		if props.ConfigPath == "/another.json" {
+			return props.State
+		}
+	}
+	s.Fail("/another.json is not listed")
+	return nil
+}
+
+func (s *EditorSuite) TestConfigState() {
+	s.CopyDataFilesToTempDir("another.json", "another.schema.json")
+	s.Ck("loadSchema()", s.editor.loadSchema(s.DataFilePath("another.schema.json")))
+
+	state := s.anotherConfigState()
+	s.True(state.Exists)
+	s.NotNil(state.Modified)
+	s.False(state.ModifiedByConfed)
+	s.Nil(state.Valid)
+
+	content := json.RawMessage(`{"name": "foo"}`)
+	var reply EditorPathResponse
+	s.Ck("Save()", s.editor.Save(&EditorSaveArgs{Path: "/another.json", Content: &content}, &reply))
+	state = s.anotherConfigState()
+	s.True(state.ModifiedByConfed)
+	s.Equal(boolPtr(true), state.Valid)
+
+	// the schema requires "name" property
+	s.WriteDataFile("another.json", `{"active": true}`)
+	s.WaitFor(func() bool {
+		state := s.anotherConfigState()
+		return !state.ModifiedByConfed && state.Valid != nil
+	})
+	s.Equal(boolPtr(false), s.anotherConfigState().Valid)
+
+	// the state is restored from the history after restart
+	s.Ck("Save()", s.editor.Save(&EditorSaveArgs{Path: "/another.json", Content: &content}, &reply))
+	s.Ck("loadSchema()", s.editor.loadSchema(s.DataFilePath("another.schema.json")))
+	s.True(s.anotherConfigState().ModifiedByConfed)
+}
+
+func (s *EditorSuite) TestExternalChangeDoesntBlockEditor() {
+	started := s.DataFilePath("started")
+	s.WriteDataFile("slow.schema.json", `{
+		"type": "object",
+		"configFile": {"path": "/slow.json", "toJSON": ["sh", "-c", "touch `+started+`; sleep 1; cat"]}
+	}`)
+	s.Ck("loadSchema()", s.editor.loadSchema(s.DataFilePath("slow.schema.json")))
+
+	s.WriteDataFile("slow.json", `{}`)
+	s.WaitFor(func() bool {
+		_, err := os.Stat(started)
+		return err == nil
+	})
+	start := time.Now()
+	var list []*JSONSchemaProps
+	s.Ck("List()", s.editor.List(&struct{}{}, &list))
+	s.Less(time.Since(start), 500*time.Millisecond)
+
+	s.WaitFor(func() bool {
+		var list []*JSONSchemaProps
+		s.Ck("List()", s.editor.List(&struct{}{}, &list))
+		for _, props := range list {
+			if props.ConfigPath == "/slow.json" {
+				return props.State.Valid != nil
+			}
+		}
+		return false
+	})
+}
+
+func (s *EditorSuite) TestCheck() {
+	s.CopyDataFilesToTempDir("another.schema.json")
+	s.Ck("loadSchema()", s.editor.loadSchema(s.DataFilePath("another.schema.json")))
+	s.WriteDataFile("broken.schema.json", `{
+		"type": "object",
+		"configFile": {"path": "/broken.json", "toJSON": ["sh", "-c", "echo oops >&2; exit 1"]}
+	}`)
+	s.Ck("loadSchema()", s.editor.loadSchema(s.DataFilePath("broken.schema.json")))
+	s.WriteDataFile("broken.json", `{}`)
+
+	var report []ConfigCheckResult
+	s.Ck("Check()", s.editor.Check(&EditorCheckArgs{}, &report))
+	s.Len(report, 3)
+	s.Equal("/another.json", report[0].ConfigPath)
+	s.Equal(CONFIG_CHECK_MISSING, report[0].Status)
+	s.Equal("/broken.json", report[1].ConfigPath)
+	s.Equal(CONFIG_CHECK_PREPROCESSOR_ERROR, report[1].Status)
+	s.Equal("oops\n", report[1].PreprocessorErrors)
+	s.Equal("/sample.json", report[2].ConfigPath)
+	s.Equal(CONFIG_CHECK_OK, report[2].Status)
+
+	s.WriteDataFile("another.json", `{"name": `)
+	s.Ck("Check()", s.editor.Check(&EditorCheckArgs{Path: "/another.json"}, &report))
+	s.Len(report, 1)
+	s.Equal(CONFIG_CHECK_SYNTAX_ERROR, report[0].Status)
+
+	s.WriteDataFile("another.json", `{"active": true}`)
+	s.Ck("Check()", s.editor.Check(&EditorCheckArgs{Path: "/another.json"}, &report))
+	s.Equal(CONFIG_CHECK_INVALID, report[0].Status)
+	s.Len(report[0].Errors, 1)
+	s.Equal(boolPtr(false), s.anotherConfigState().Valid)
+}
+
+func (s *EditorSuite) TestCheckDoesntBlockEditor() {
+	started := s.DataFilePath("started")
+	s.WriteDataFile("slow.schema.json", `{
+		"type": "object",
+		"configFile": {"path": "/slow.json", "toJSON": ["sh", "-c", "touch `+started+`; sleep 1; cat"]}
+	}`)
+	s.Ck("loadSchema()", s.editor.loadSchema(s.DataFilePath("slow.schema.json")))
+	s.WriteDataFile("slow.json", `{}`)
+
+	done := make(chan error, 1)
+	var report []ConfigCheckResult
+	go func() {
+		done <- s.editor.Check(&EditorCheckArgs{Path: "/slow.json"}, &report)
+	}()
+	s.WaitFor(func() bool {
+		_, err := os.Stat(started)
+		return err == nil
+	})
+	start := time.Now()
+	var list []*JSONSchemaProps
+	s.Ck("List()", s.editor.List(&struct{}{}, &list))
+	s.Less(time.Since(start), 500*time.Millisecond)
+
+	s.Ck("Check()", <-done)
+	s.Len(report, 1)
+	s.Equal(CONFIG_CHECK_OK, report[0].Status)
+}
+
+func (s *EditorSuite) TestCheckDoesntOverwriteNewerState() {
+	started := s.DataFilePath("started")
+	s.WriteDataFile("slow.schema.json", `{
+		"type": "object",
+		"configFile": {"path": "/slow.json", "toJSON": ["sh", "-c", "touch `+started+`; sleep 1; cat"]}
+	}`)
+	s.Ck("loadSchema()", s.editor.loadSchema(s.DataFilePath("slow.schema.json")))
+	s.WriteDataFile("slow.json", `[]`)
+
+	done := make(chan error, 1)
+	var report []ConfigCheckResult
+	go func() {
+		done <- s.editor.Check(&EditorCheckArgs{Path: "/slow.json"}, &report)
+	}()
+	s.WaitFor(func() bool {
+		_, err := os.Stat(started)
+		return err == nil
+	})
+	// the config is saved while the old content is being checked
+	content := json.RawMessage(`{}`)
+	var reply EditorPathResponse
+	s.Ck("Save()", s.editor.Save(&EditorSaveArgs{Path: "/slow.json", Content: &content}, &reply))
+
+	s.Ck("Check()", <-done)
+	s.Require().Len(report, 1)
+	s.Equal(CONFIG_CHECK_INVALID, report[0].Status)
+	var list []*JSONSchemaProps
+	s.Ck("List()", s.editor.List(&struct{}{}, &list))
+	for _, props := range list {
+		if props.ConfigPath == "/slow.json" {
+			s.Equal(boolPtr(true), props.State.Valid)
+		}
+	}
+}
+
+func (s *EditorSuite) TestConverterTimeout() {
+	s.WriteDataFile("slow.schema.json", `{
+		"type": "object",
+		"configFile": {
+			"path": "/slow.json",
+			"toJSON": ["sleep", "30"],
+			"fromJSON": ["sleep", "30"],
+			"converter": {"timeoutMS": 100}
+		}
+	}`)
+	s.Ck("loadSchema()", s.editor.loadSchema(s.DataFilePath("slow.schema.json")))
+	s.WriteDataFile("slow.json", `{}`)
+
+	var reply EditorContentResponse
+	s.Equal(converterTimeoutError, s.editor.Load(&EditorPathArgs{Path: "/slow.json"}, &reply))
+
+	content := json.RawMessage(`{"a": 1}`)
+	var saveReply EditorPathResponse
+	s.Equal(converterTimeoutError, s.editor.Save(&EditorSaveArgs{Path: "/slow.json", Content: &content}, &saveReply))
+	s.verifyTextFile("slow.json", "{}")
+}
+
+func (s *EditorSuite) TestRoundTrip() {
+	s.WriteDataFile("lossy.schema.json", `{
+		"type": "object",
+		"configFile": {
+			"path": "/lossy.json",
+			"fromJSON": ["sh", "-c", "cat >/dev/null; echo '{\"a\": 1}'"],
+			"roundTripCheck": true
+		}
+	}`)
+	s.Ck("loadSchema()", s.editor.loadSchema(s.DataFilePath("lossy.schema.json")))
+	s.WriteDataFile("lossy.json", `{"a": 1, "b": 2}`)
+
+	content := json.RawMessage(`{"a": 1.0, "b": 3}`)
+	var reply EditorPathResponse
+	s.Equal(newRoundTripError([]string{"/b"}),
+		s.editor.Save(&EditorSaveArgs{Path: "/lossy.json", Content: &content}, &reply))
+	s.verifyTextFile("lossy.json", `{"a": 1, "b": 2}`)
+	var validateReply EditorValidateResponse
+	s.Equal(newRoundTripError([]string{"/b"}),
+		s.editor.Validate(&EditorSaveArgs{Path: "/lossy.json", Content: &content}, &validateReply))
+
+	schema, err := s.editor.locateSchema("/lossy.json")
+	s.Ck("locateSchema()", err)
+	res, err := CheckRoundTrip(schema)
+	s.Ck("CheckRoundTrip()", err)
+	s.False(res.Ok())
+	s.Equal([]JSONChange{{Op: JSON_CHANGE_REMOVE, Path: "/b", OldValue: 2.0}}, res.Changes)
+	s.Contains(res.TextDiff, "-{\"a\": 1, \"b\": 2}\n+{\"a\": 1}\n")
+
+	// the numbers are compared by value
+	content = json.RawMessage(`{"a": 1.0}`)
+	s.Ck("Save()", s.editor.Save(&EditorSaveArgs{Path: "/lossy.json", Content: &content}, &reply))
+	s.verifyTextFile("lossy.json", "{\"a\": 1}\n")
+	res, err = CheckRoundTrip(schema)
+	s.Ck("CheckRoundTrip()", err)
+	s.True(res.Ok())
+	s.Empty(res.TextDiff)
+}
+
+func (s *EditorSuite) TestBuiltinConverter() {
+	s.WriteDataFile("ntp.schema.json", `{
+		"type": "object",
+		"configFile": {"path": "/etc/ntp.conf", "toJSON": "builtin:ntp", "fromJSON": "builtin:ntp"}
+	}`)
+	s.Ck("loadSchema()", s.editor.loadSchema(s.DataFilePath("ntp.schema.json")))
+	s.WriteDataFile("etc/ntp.conf", "# servers\nserver 10.0.0.1 iburst\n")
+
+	var reply EditorContentResponse
+	s.Ck("Load()", s.editor.Load(&EditorPathArgs{Path: "/etc/ntp.conf"}, &reply))
+	s.JSONEq(`{
+		"data": [{"type": "server", "address": "10.0.0.1", "iburst": true}],
+		"etc": ["# servers", "`+NTP_SERVERS_MARKER+`"]
+	}`, string(*reply.Content))
+
+	content := json.RawMessage(`{
+		"data": [{"type": "pool", "address": "pool.ntp.org"}],
+		"etc": ["# servers", "` + NTP_SERVERS_MARKER + `"]
+	}`)
+	var saveReply EditorPathResponse
+	s.Ck("Save()", s.editor.Save(&EditorSaveArgs{Path: "/etc/ntp.conf", Content: &content}, &saveReply))
+	s.verifyTextFile("etc/ntp.conf", "# servers\npool pool.ntp.org\n")
+
+	s.WriteDataFile("bad.schema.json", `{
+		"type": "object",
+		"configFile": {"path": "/bad.conf", "toJSON": "builtin:no-such-converter"}
+	}`)
+	s.Error(s.editor.loadSchema(s.DataFilePath("bad.schema.json")))
+}
+
+func (s *EditorSuite) TestToJSONCache() {
+	counter := s.DataFilePath("runs")
+	loadSchema := func(cache bool) {
+		s.WriteDataFile("cached.schema.json", fmt.Sprintf(`{
+			"type": "object",
+			"configFile": {
+				"path": "/cached.json",
+				"toJSON": ["sh", "-c", "echo >>%s; cat"],
+				"toJSONCache": %v
+			}
+		}`, counter, cache))
+		s.Ck("loadSchema()", s.editor.loadSchema(s.DataFilePath("cached.schema.json")))
+	}
+	runs := 0
+	load := func(expectedContent string, converted bool) {
+		stats := toJSONCacheStats()
+		var reply EditorContentResponse
+		s.Ck("Load()", s.editor.Load(&EditorPathArgs{Path: "/cached.json"}, &reply))
+		s.JSONEq(expectedContent, string(*reply.Content))
+		bs, err := os.ReadFile(counter)
+		s.Ck("ReadFile()", err)
+		if converted {
+			runs++
+			s.Equal(stats.Misses+1, toJSONCacheStats().Misses)
+		} else {
+			s.Equal(stats.Hits+1, toJSONCacheStats().Hits)
+		}
+		s.Equal(runs, strings.Count(string(bs), "\n"))
+	}
+
+	s.WriteDataFile("runs", "")
+	s.WriteDataFile("cached.json", `{"a": 1}`)
+	loadSchema(true)
+	load(`{"a": 1}`, true)
+	load(`{"a": 1}`, false)
+
+	// the touched file with the same content isn't converted again
+	later := time.Now().Add(time.Minute)
+	s.Ck("Chtimes()", os.Chtimes(s.DataFilePath("cached.json"), later, later))
+	load(`{"a": 1}`, false)
+
+	// the config changed bypassing confed is converted by the watcher
+	// into the cache, so Load doesn't convert it again
+	stats := toJSONCacheStats()
+	s.WriteDataFile("cached.json", `{"a": 2}`)
+	s.Eventually(func() bool {
+		return toJSONCacheStats().Misses > stats.Misses
+	}, time.Second, 10*time.Millisecond)
+	runs++
+	load(`{"a": 2}`, false)
+	load(`{"a": 2}`, false)
+
+	// the cache is dropped on schema reload
+	loadSchema(true)
+	load(`{"a": 2}`, true)
+
+	loadSchema(false)
+	stats = toJSONCacheStats()
+	var reply EditorContentResponse
+	for i := 0; i < 2; i++ {
+		s.Ck("Load()", s.editor.Load(&EditorPathArgs{Path: "/cached.json"}, &reply))
+	}
+	s.Equal(stats, toJSONCacheStats())
+	bs, err := os.ReadFile(counter)
+	s.Ck("ReadFile()", err)
+	s.Equal(runs+2, strings.Count(string(bs), "\n"))
+
+	s.Greater(stats.HitRate, 0.0)
+	s.VerifyRpc("CacheStats", objx.Map{}, objx.Map{
+		"hits":    stats.Hits,
+		"misses":  stats.Misses,
+		"hitRate": stats.HitRate,
+	})
+}
+
+func (s *EditorSuite) TestToJSONCacheDependentInput() {
+	// toJSON depends on another file, so the schema doesn't enable the cache
+	s.WriteDataFile("dependent.schema.json", fmt.Sprintf(`{
+		"type": "object",
+		"configFile": {
+			"path": "/dependent.json",
+			"toJSON": ["sh", "-c", "cat >/dev/null; cat %s"]
+		}
+	}`, s.DataFilePath("input.json")))
+	s.Ck("loadSchema()", s.editor.loadSchema(s.DataFilePath("dependent.schema.json")))
+	s.WriteDataFile("dependent.json", `{}`)
+
+	load := func(expectedContent string) {
+		stats := toJSONCacheStats()
+		var reply EditorContentResponse
+		s.Ck("Load()", s.editor.Load(&EditorPathArgs{Path: "/dependent.json"}, &reply))
+		s.JSONEq(expectedContent, string(*reply.Content))
+		s.Equal(stats.Hits, toJSONCacheStats().Hits)
+	}
+	s.WriteDataFile("input.json", `{"a": 1}`)
+	load(`{"a": 1}`)
+	s.WriteDataFile("input.json", `{"a": 2}`)
+	load(`{"a": 2}`)
+}
+
+func (s *EditorSuite) TestConverterWorker() {
+	s.WriteDataFile("worker.sh", TEST_WORKER_SCRIPT)
+	for _, tc := range []struct {
+		worker, expected string
+	}{
+		{`["sh", "` + s.DataFilePath("worker.sh") + `"]`, `"pid"`},
+		// the one-shot command is used if the worker doesn't speak the protocol
+		{`"cat"`, `"oneshot"`},
+	} {
+		s.WriteDataFile("worker.schema.json", `{
+			"type": "object",
+			"configFile": {
+				"path": "/worker.conf",
+				"toJSON": ["sh", "-c", "echo '{\"oneshot\": true}'"],
+				"fromJSON": ["cat"],
+				"worker": {"command": `+tc.worker+`, "poolSize": 2}
+			}
+		}`)
+		s.Ck("loadSchema()", s.editor.loadSchema(s.DataFilePath("worker.schema.json")))
+		s.WriteDataFile("worker.conf", "config")
+
+		var reply EditorContentResponse
+		s.Ck("Load()", s.editor.Load(&EditorPathArgs{Path: "/worker.conf"}, &reply))
+		s.Contains(string(*reply.Content), tc.expected)
+	}
+
+	for _, configFile := range []string{
+		`{"path": "/bad.conf", "format": "yaml", "worker": {"command": "cat"}}`,
+		// no fallback commands
+		`{"path": "/bad.conf", "worker": {"command": "cat"}}`,
+		`{"path": "/bad.conf", "toJSON": "cat", "worker": {"command": "cat"}}`,
+	} {
+		s.WriteDataFile("bad.schema.json", `{"type": "object", "configFile": `+configFile+`}`)
+		s.Error(s.editor.loadSchema(s.DataFilePath("bad.schema.json")), configFile)
+	}
+}
+
+func (s *EditorSuite) TestPatch() {
+	s.CopyDataFilesToTempDir("sample.json")
+	patch := func(patch, patchType string) error {
+		raw := json.RawMessage(patch)
+		var reply EditorPathResponse
+		return s.editor.Patch(&EditorPatchArgs{Path: "/sample.json", Patch: &raw, Type: patchType}, &reply)
+	}
+
+	s.Ck("Patch()", patch(`[{"op": "replace", "path": "/slave_id", "value": 42}]`, ""))
+	s.Ck("Patch()", patch(`{"name": "MSU21 (patched)", "enabled": null}`, ""))
+	s.verifyJSONFile("sample.json", objx.Map{
+		"device_type": "MSU21",
+		"name":        "MSU21 (patched)",
+		"id":          "msu21",
+		"slave_id":    float64(42),
+	})
+
+	err := patch(`[{"op": "test", "path": "/slave_id", "value": 1}]`, "")
+	s.Require().IsType(&EditorError{}, err)
+	s.Equal(int32(EDITOR_ERROR_INVALID_PATCH), err.(*EditorError).ErrorCode())
+	s.VerifyRpcError("Patch", objx.Map{
+		"path":  "/sample.json",
+		"patch": []objx.Map{{"op": "test", "path": "/slave_id", "value": 1}},
+	}, EDITOR_ERROR_INVALID_PATCH, "EditorError", "Invalid patch: testing value /slave_id failed: test failed")
+
+	err = patch(`{"slave_id": 42}`, PATCH_TYPE_JSON_PATCH)
+	s.Require().IsType(&EditorError{}, err)
+	s.Equal(int32(EDITOR_ERROR_INVALID_PATCH), err.(*EditorError).ErrorCode())
+
+	// the patched config must be valid
+	err = patch(`{"slave_id": -1}`, "")
+	s.Require().IsType(&EditorError{}, err)
+	s.Equal(int32(EDITOR_ERROR_INVALID_CONFIG), err.(*EditorError).ErrorCode())
+}
+
+func (s *EditorSuite) TestGetSet() {
+	s.CopyDataFilesToTempDir("sample.json")
+	get := func(pointer string) (*EditorGetResponse, error) {
+		var reply EditorGetResponse
+		err := s.editor.Get(&EditorGetArgs{Path: "/sample.json", Pointer: pointer}, &reply)
+		return &reply, err
+	}
+	set := func(pointer, value string) error {
+		raw := json.RawMessage(value)
+		var reply EditorPathResponse
+		return s.editor.Set(&EditorSetArgs{Path: "/sample.json", Pointer: pointer, Value: &raw}, &reply)
+	}
+
+	reply, err := get("/name")
+	s.Ck("Get()", err)
+	s.JSONEq(`"MSU21"`, string(*reply.Value))
+	s.Equal("/sample.json", reply.ConfigPath)
+	s.NotEmpty(reply.Revision)
+
+	s.Ck("Set()", set("/slave_id", "42"))
+	s.Ck("Set()", set("/enabled", "false"))
+	reply, err = get("/slave_id")
+	s.Ck("Get()", err)
+	s.Equal("42", string(*reply.Value))
+	s.verifyJSONFile("sample.json", objx.Map{
+		"device_type": "MSU21",
+		"name":        "MSU21",
+		"id":          "msu21",
+		"slave_id":    float64(42),
+		"enabled":     false,
+	})
+
+	for _, pointer := range []string{"/nosuchkey", "/name/foo", "name"} {
+		_, err = get(pointer)
+		s.Require().IsType(&EditorError{}, err, pointer)
+		s.Equal(int32(EDITOR_ERROR_INVALID_POINTER), err.(*EditorError).ErrorCode())
+	}
+
+	// the whole resulting config is validated
+	err = set("/slave_id", "-1")
+	s.Require().IsType(&EditorError{}, err)
+	s.Equal(int32(EDITOR_ERROR_INVALID_CONFIG), err.(*EditorError).ErrorCode())
+}
+
+func (s *EditorSuite) TestDiff() {
+	s.CopyDataFilesToTempDir("sample.json")
+	content := json.RawMessage(`{
+		"device_type": "MSU21",
+		"name": "MSU21 (renamed)",
+		"slave_id": 24,
+		"id": "msu21",
+		"enabled": false
+	}`)
+	var reply EditorDiffResponse
+	s.Ck("Diff()", s.editor.Diff(&EditorDiffArgs{Path: "/sample.json", Content: &content, Text: true}, &reply))
+	s.Equal("/sample.json", reply.ConfigPath)
+	s.NotEmpty(reply.Revision)
+	s.Equal([]JSONChange{
+		{Op: JSON_CHANGE_REPLACE, Path: "/enabled", Value: false, OldValue: true},
+		{Op: JSON_CHANGE_REPLACE, Path: "/name", Value: "MSU21 (renamed)", OldValue: "MSU21"},
+	}, reply.Changes)
+	s.Contains(reply.TextDiff, "--- /sample.json")
+	s.Contains(reply.TextDiff, `+  "name": "MSU21 (renamed)",`)
+
+	// the config is not changed
+	s.verifyJSONFile("sample.json", objx.Map{
+		"device_type": "MSU21",
+		"name":        "MSU21",
+		"id":          "msu21",
+		"slave_id":    float64(24),
+		"enabled":     true,
+	})
+
+	s.RmFile("sample.json")
+	reply = EditorDiffResponse{}
+	s.Ck("Diff()", s.editor.Diff(&EditorDiffArgs{Path: "/sample.json", Content: &content}, &reply))
+	s.Empty(reply.Revision)
+	s.Empty(reply.TextDiff)
+	s.Require().Len(reply.Changes, 1)
+	s.Equal(JSON_CHANGE_ADD, reply.Changes[0].Op)
+	s.Equal("", reply.Changes[0].Path)
+}
+
+func (s *EditorSuite) TestSavePreservesFormatting() {
+	s.WriteDataFile("sample.json", `// MSU21 on /dev/ttyS1
+{
+  "device_type" : "MSU21",
+  "name": "MSU21", // shown in the UI
+  /* modbus address */
+  "slave_id": 24,
+  "id": "msu21",
+}
+`)
+	content := json.RawMessage(`{"device_type": "MSU21", "name": "MSU21", "slave_id": 42, "id": "msu21", "enabled": true}`)
+	var reply EditorPathResponse
+	s.Ck("Save()", s.editor.Save(&EditorSaveArgs{Path: "/sample.json", Content: &content}, &reply))
+	s.verifyTextFile("sample.json", `// MSU21 on /dev/ttyS1
+{
+  "device_type" : "MSU21",
+  "name": "MSU21", // shown in the UI
+  /* modbus address */
+  "slave_id": 42,
+  "id": "msu21",
+  "enabled": true,
+}
+`)
+}
+
 func TestEditorSuite(t *testing.T) {
 	testutils.RunSuites(t, new(EditorSuite))
 }
@@ -0,0 +1,309 @@
+package confed
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/wirenboard/wbgong"
+)
+
+const (
+	EVENTS_TOPIC_PREFIX = "/wb-mqtt-confed/events"
+)
+
+// ConfigEvent is published when a config file is changed
+// by confed or bypassing it
+type ConfigEvent struct {
+	ConfigPath string `json:"configPath"`
+	SchemaPath string `json:"schemaPath"`
+	// empty if the config file is removed
+	Revision string `json:"revision"`
+	// JSON Pointers of the changed values,
+	// [""] if the whole config is changed or the change is unknown
+	Changed  []string `json:"changed"`
+	ClientId string   `json:"clientId,omitempty"`
+	// true if the config is changed bypassing confed
+	External  bool      `json:"external"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// knownConfig is the last known content of the config file
+type knownConfig struct {
+	// nil if there's no config file
+	content []byte
+	// incremented on every change
+	version int
+	// the JSON of the content saved by confed or converted
+	// after the external change, nil if it's unknown
+	json []byte
+}
+
+// configEvents publishes config change events. It keeps the last known
+// content of the config files to find out which changes are made
+// bypassing confed and what is changed.
+type configEvents struct {
+	mtx        sync.Mutex
+	mqttClient mqttPublisher
+	known      map[string]*knownConfig
+	watcher    *configWatcher
+	// the schemas by the watched physical config path
+	watched map[string][]*JSONSchema
+	// called after the config is changed bypassing confed
+	// with the new content converted to JSON
+	onExternalChange func(schema *JSONSchema, version int, converted LoadConfigResult, err error)
+}
+
+func newConfigEvents() *configEvents {
+	e := &configEvents{
+		known:   make(map[string]*knownConfig),
+		watched: make(map[string][]*JSONSchema),
+	}
+	e.watcher = newConfigWatcher(e.configFileChanged)
+	return e
+}
+
+func (e *configEvents) setMQTTClient(client mqttPublisher) {
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+	e.mqttClient = client
+}
+
+func readConfigFile(path string) []byte {
+	bs, err := os.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	return bs
+}
+
+// remember stores the current content of the config
+// unless it's already known
+func (e *configEvents) remember(schema *JSONSchema) {
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+	if _, found := e.known[schema.PhysicalConfigPath()]; !found {
+		e.setKnown(schema.PhysicalConfigPath(), readConfigFile(schema.PhysicalConfigPath()), nil)
+	}
+}
+
+// must be called with e.mtx locked
+func (e *configEvents) setKnown(path string, content, json []byte) (prev []byte) {
+	known, found := e.known[path]
+	if !found {
+		known = &knownConfig{}
+		e.known[path] = known
+	}
+	prev = known.content
+	known.content = content
+	known.json = json
+	known.version++
+	return
+}
+
+// version returns the number of changes of the config
+// known since confed start
+func (e *configEvents) version(schema *JSONSchema) int {
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+	if known, found := e.known[schema.PhysicalConfigPath()]; found {
+		return known.version
+	}
+	return 0
+}
+
+// write writes the config by confed with writeFile, so the write
+// is not reported as an external change. json is the JSON saved
+// as the content if it's known. The watcher doesn't read the config
+// while it's being written. Returns the previously known content.
+func (e *configEvents) write(schema *JSONSchema, content, json []byte, writeFile func() error) (prev []byte, err error) {
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+	if err = writeFile(); err != nil {
+		return
+	}
+	return e.setKnown(schema.PhysicalConfigPath(), content, json), nil
+}
+
+// knownJSON returns the JSON of the content, nil if it's unknown
+func (e *configEvents) knownJSON(schema *JSONSchema, content []byte) []byte {
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+	known, found := e.known[schema.PhysicalConfigPath()]
+	if !found || content == nil || !bytes.Equal(known.content, content) {
+		return nil
+	}
+	return known.json
+}
+
+// fileChanged is called when the config file is changed on disk
+// and publishes the event if it's not changed by confed.
+// The new content is converted to JSON once, the JSON is used
+// to find out the changed values and to validate the config.
+func (e *configEvents) fileChanged(schema *JSONSchema) {
+	path := schema.PhysicalConfigPath()
+	e.mtx.Lock()
+	content := readConfigFile(path)
+	known, found := e.known[path]
+	if found && bytes.Equal(known.content, content) && (known.content == nil) == (content == nil) {
+		e.mtx.Unlock()
+		return
+	}
+	var prevJSON []byte
+	if found {
+		prevJSON = known.json
+	}
+	prev := e.setKnown(path, content, nil)
+	version := e.known[path].version
+	client, onExternalChange := e.mqttClient, e.onExternalChange
+	e.mtx.Unlock()
+
+	wbgong.Info.Printf("%s is changed bypassing confed", path)
+	converted, err := convertChangedConfig(schema, content)
+	var newJSON []byte
+	// the cached conversion may be of the file changed again since it was read
+	if err == nil && converted.revision == contentHash(content) {
+		newJSON = converted.content
+		e.setKnownJSON(path, version, newJSON)
+	}
+	if client != nil {
+		if prevJSON == nil && prev != nil {
+			if res, err := convertConfigToJSON(schema, prev); err == nil {
+				prevJSON = res.content
+			}
+		}
+		e.publish(schema, prev, content, changedJSONContentPointers(prevJSON, newJSON), "", true)
+	}
+	if onExternalChange != nil {
+		onExternalChange(schema, version, converted, err)
+	}
+}
+
+// convertChangedConfig converts the new content of the config to JSON.
+// The schema's toJSON cache is used if there's one, so the next Load
+// doesn't convert the config again.
+func convertChangedConfig(schema *JSONSchema, content []byte) (LoadConfigResult, error) {
+	if content == nil {
+		return LoadConfigResult{}, os.ErrNotExist
+	}
+	if schema.props.toJSONCache != nil {
+		return loadSchemaConfig(schema)
+	}
+	return convertConfigToJSON(schema, content)
+}
+
+// setKnownJSON stores the JSON of the known content
+// unless the content is changed since the version
+func (e *configEvents) setKnownJSON(path string, version int, json []byte) {
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+	if known, found := e.known[path]; found && known.version == version {
+		known.json = json
+	}
+}
+
+// changedJSONContentPointers compares two versions of the config JSON,
+// the whole config is reported as changed if any of them is unknown
+func changedJSONContentPointers(old, new []byte) []string {
+	whole := []string{""}
+	if old == nil || new == nil {
+		return whole
+	}
+	var parsed [2]any
+	for n, content := range [][]byte{old, new} {
+		if err := json.Unmarshal(content, &parsed[n]); err != nil {
+			wbgong.Debug.Printf("can't compare config versions: %s", err)
+			return whole
+		}
+	}
+	return changedJSONPointers(parsed[0], parsed[1])
+}
+
+// publish sends the event about the config change.
+// changed are JSON Pointers of the changed values.
+func (e *configEvents) publish(schema *JSONSchema, old, new []byte, changed []string, clientId string, external bool) {
+	e.mtx.Lock()
+	client := e.mqttClient
+	e.mtx.Unlock()
+	if client == nil {
+		return
+	}
+
+	event := ConfigEvent{
+		ConfigPath: schema.ConfigPath(),
+		SchemaPath: schema.Path(),
+		Changed:    changed,
+		ClientId:   clientId,
+		External:   external,
+		Timestamp:  time.Now().UTC(),
+	}
+	if new != nil {
+		event.Revision = contentHash(new)
+	}
+	bs, err := json.Marshal(event)
+	if err != nil {
+		wbgong.Error.Printf("failed to serialize event for %s: %s", schema.ConfigPath(), err)
+		return
+	}
+	client.Publish(wbgong.MQTTMessage{
+		Topic:   EVENTS_TOPIC_PREFIX + schema.ConfigPath(),
+		Payload: string(bs),
+		QoS:     1,
+	})
+}
+
+// configFileChanged is called by the watcher when the config file is changed
+func (e *configEvents) configFileChanged(path string) {
+	e.mtx.Lock()
+	schemas := append([]*JSONSchema(nil), e.watched[path]...)
+	e.mtx.Unlock()
+	for _, schema := range schemas {
+		e.fileChanged(schema)
+	}
+}
+
+// watchConfig starts watching the physical config file of the schema
+func (e *configEvents) watchConfig(schema *JSONSchema) {
+	e.remember(schema)
+	path := schema.PhysicalConfigPath()
+	if err := e.watcher.watch(path); err != nil {
+		wbgong.Warn.Printf("can't watch %s: %s", path, err)
+		return
+	}
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+	e.watched[path] = append(e.watched[path], schema)
+}
+
+// unwatchConfig stops watching the physical config file of the schema
+func (e *configEvents) unwatchConfig(schema *JSONSchema) {
+	path := schema.PhysicalConfigPath()
+	e.mtx.Lock()
+	found := false
+	schemas := e.watched[path]
+	for n, s := range schemas {
+		if s == schema {
+			// the list may be being iterated, so it's copied
+			e.watched[path] = append(schemas[:n:n], schemas[n+1:]...)
+			found = true
+			break
+		}
+	}
+	if len(e.watched[path]) == 0 {
+		delete(e.watched, path)
+	}
+	e.mtx.Unlock()
+	if found {
+		e.watcher.unwatch(path)
+	}
+}
+
+// stopWatching stops watching all the config files
+func (e *configEvents) stopWatching() {
+	e.watcher.stop()
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+	e.watched = make(map[string][]*JSONSchema)
+}
@@ -1,8 +1,17 @@
 package confed
 
 import (
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"reflect"
+	"strconv"
 	"strings"
+	"syscall"
 	"testing"
+	"time"
 )
 
 func TestExtPreprocess(t *testing.T) {
@@ -37,3 +46,127 @@ func TestExtCaptureStderr(t *testing.T) {
 		t.Errorf("proper exit status not mentioned in the error message")
 	}
 }
+
+func TestConverterTimeout(t *testing.T) {
+	pidFile := filepath.Join(t.TempDir(), "pid")
+	opts := defaultConverterOptions()
+	opts.timeout = 200 * time.Millisecond
+	start := time.Now()
+	// the background process holding stdout must be killed too
+	_, err := runConverter(opts, []string{
+		"sh", "-c", "sleep 30 & echo $! >" + pidFile + "; wait",
+	}, nil)
+	if !errors.Is(err, errConverterTimeout) {
+		t.Fatalf("timeout error expected, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("the converter is stopped after %s", elapsed)
+	}
+	pid, err := os.ReadFile(pidFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, _ := strconv.Atoi(strings.TrimSpace(string(pid)))
+	deadline := time.Now().Add(5 * time.Second)
+	for isRunning(n) {
+		if time.Now().After(deadline) {
+			t.Fatalf("background process %d is still running", n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// isRunning checks if the process exists and isn't a zombie
+func isRunning(pid int) bool {
+	if syscall.Kill(pid, 0) != nil {
+		return false
+	}
+	stat, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	return err != nil || !strings.Contains(string(stat), ") Z ")
+}
+
+func TestConverterOutputLimit(t *testing.T) {
+	opts := defaultConverterOptions()
+	opts.maxOutputSize = 1000
+	_, err := runConverter(opts, []string{"sh", "-c", "while :; do echo 0123456789; done"}, nil)
+	if !errors.Is(err, errConverterOutputTooLarge) {
+		t.Fatalf("output size error expected, got %v", err)
+	}
+
+	out, err := runConverter(opts, []string{"sh", "-c", "echo 0123456789"}, nil)
+	if err != nil || out.stdout.String() != "0123456789\n" {
+		t.Errorf("unexpected result: %q, %v", out.stdout.String(), err)
+	}
+}
+
+func TestConverterEnvironment(t *testing.T) {
+	t.Setenv("CONFED_SECRET", "secret")
+	opts, err := extractConverterOptions(map[string]any{
+		"converter": map[string]any{"env": map[string]any{"LANG": "C.UTF-8"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := runConverter(opts, []string{"env"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "PATH=" + CONVERTER_PATH + "\nLANG=C.UTF-8\n"
+	if out.stdout.String() != expected {
+		t.Errorf("expected environment:\n%s\ngot:\n%s", expected, out.stdout.String())
+	}
+}
+
+func TestConverterUser(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("running as another user requires root")
+	}
+	u, err := user.Lookup("nobody")
+	if err != nil {
+		t.Skip("no nobody user")
+	}
+	opts := defaultConverterOptions()
+	opts.user = u.Username
+	out, err := runConverter(opts, []string{"id", "-u"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.TrimSpace(out.stdout.String()) != u.Uid {
+		t.Errorf("expected uid %s, got %s", u.Uid, out.stdout.String())
+	}
+
+	opts.user = "--no-such-user--"
+	if _, err = runConverter(opts, []string{"id", "-u"}, nil); err == nil {
+		t.Error("unknown user must not be accepted")
+	}
+}
+
+func TestConverterOptions(t *testing.T) {
+	opts, err := extractConverterOptions(map[string]any{})
+	if err != nil || !reflect.DeepEqual(opts, defaultConverterOptions()) {
+		t.Errorf("default options expected, got %+v, %v", opts, err)
+	}
+
+	opts, err = extractConverterOptions(map[string]any{
+		"converter": map[string]any{"timeoutMS": 1500.0, "maxOutputSize": 4096.0, "user": "nobody"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.timeout != 1500*time.Millisecond || opts.maxOutputSize != 4096 || opts.user != "nobody" {
+		t.Errorf("unexpected options %+v", opts)
+	}
+
+	for _, converter := range []any{
+		"fast",
+		map[string]any{"timeoutMS": 0.0},
+		map[string]any{"maxOutputSize": "1M"},
+		map[string]any{"env": map[string]any{"A=B": "C"}},
+		map[string]any{"env": map[string]any{"A": 1.0}},
+		map[string]any{"user": ""},
+	} {
+		if _, err = extractConverterOptions(map[string]any{"converter": converter}); err == nil {
+			t.Errorf("%v must not be accepted", converter)
+		}
+	}
+}
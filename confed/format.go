@@ -0,0 +1,340 @@
+package confed
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/DisposaBoy/JsonConfigReader"
+	"github.com/wirenboard/wbgong"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	CONFIG_FORMAT_JSON  = "json"
+	CONFIG_FORMAT_JSONC = "jsonc"
+	CONFIG_FORMAT_YAML  = "yaml"
+	CONFIG_FORMAT_TOML  = "toml"
+	CONFIG_FORMAT_INI   = "ini"
+	CONFIG_FORMAT_SHELL = "shell"
+
+	YAML_INDENT = 2
+)
+
+// configFormat converts the config files of the format
+// to JSON and back without external commands
+type configFormat struct {
+	toJSON func(raw []byte) ([]byte, error)
+	// orig is the current content of the config file or nil if there's no file,
+	// it's used to preserve the formatting where possible
+	fromJSON func(content, orig []byte) ([]byte, error)
+}
+
+var configFormats = map[string]configFormat{
+	CONFIG_FORMAT_JSON:  {jsonToJSON, formatJSON},
+	CONFIG_FORMAT_JSONC: {jsoncToJSON, formatJSON},
+	CONFIG_FORMAT_YAML:  {yamlToJSON, yamlFromJSON},
+	CONFIG_FORMAT_TOML:  {tomlToJSON, tomlFromJSON},
+	CONFIG_FORMAT_INI:   {iniToJSON, iniFromJSON},
+	CONFIG_FORMAT_SHELL: {shellToJSON, shellFromJSON},
+}
+
+func (format configFormat) ToJSON(raw []byte) ([]byte, error) {
+	return format.toJSON(raw)
+}
+
+func (format configFormat) FromJSON(content, orig []byte) ([]byte, error) {
+	return format.fromJSON(content, orig)
+}
+
+func isKnownConfigFormat(format string) bool {
+	_, found := configFormats[format]
+	return found
+}
+
+// loadSchemaConfig reads the config file of the schema and converts it to JSON.
+// The result is cached if the schema asks for it.
+func loadSchemaConfig(schema *JSONSchema) (res LoadConfigResult, err error) {
+	if schema.props.toJSONCache != nil {
+		return loadCachedConfig(schema, schema.props.toJSONCache)
+	}
+	raw, err := os.ReadFile(schema.PhysicalConfigPath())
+	if err != nil {
+		return
+	}
+	return convertConfigToJSON(schema, raw)
+}
+
+// hasExternalToJSON tells whether converting the config to JSON
+// runs a process
+func hasExternalToJSON(schema *JSONSchema) bool {
+	return schema.ToJSONConverter() == nil && schema.ToJSONCommand() != nil
+}
+
+// convertConfigToJSON makes JSON from the config file content
+// according to the schema's config format, built-in converter or toJSON command.
+// toJSON command is run on the schema's worker if there's one.
+func convertConfigToJSON(schema *JSONSchema, raw []byte) (res LoadConfigResult, err error) {
+	converter := schema.ToJSONConverter()
+	if converter == nil && schema.ToJSONCommand() != nil && schema.props.workers != nil {
+		res, err = schema.props.workers.toJSON(raw)
+		if !isWorkerFallback(err) {
+			return
+		}
+	}
+	if converter == nil {
+		return convertToJSON(raw, schema.ToJSONCommand(), schema.ConverterOptions())
+	}
+	res.revision = contentHash(raw)
+	res.content, err = converter.ToJSON(raw)
+	return
+}
+
+// convertConfigFromJSON makes the physical config file content
+// according to the schema's config format, built-in converter or fromJSON command
+// run on the schema's worker if there's one.
+// If there's no fromJSON command, JSON config file is patched,
+// so its comments, key order and formatting are preserved.
+func convertConfigFromJSON(schema *JSONSchema, content []byte) (LoadConfigResult, error) {
+	converter := schema.FromJSONConverter()
+	if converter == nil && schema.FromJSONCommand() != nil && schema.props.workers != nil {
+		res, err := schema.props.workers.fromJSON(content)
+		if !isWorkerFallback(err) {
+			return res, err
+		}
+	}
+	if converter == nil && schema.FromJSONCommand() != nil {
+		return convertFromJSON(content, schema.FromJSONCommand(), schema.ConverterOptions())
+	}
+	if converter == nil {
+		converter = configFormats[CONFIG_FORMAT_JSONC]
+	}
+	orig, err := os.ReadFile(schema.PhysicalConfigPath())
+	if err != nil {
+		orig = nil
+	}
+	res, err := converter.FromJSON(content, orig)
+	return LoadConfigResult{content: res}, err
+}
+
+func jsonToJSON(raw []byte) ([]byte, error) {
+	var v any
+	if err := json.Unmarshal(raw, &v); err != nil {
+		return nil, err
+	}
+	return raw, nil
+}
+
+func jsoncToJSON(raw []byte) ([]byte, error) {
+	return io.ReadAll(JsonConfigReader.New(bytes.NewReader(raw)))
+}
+
+// formatJSON patches the existing config file
+// or makes the indented JSON if there's no file
+func formatJSON(content, orig []byte) ([]byte, error) {
+	if orig != nil {
+		res, err := patchJSONC(orig, content)
+		if err == nil {
+			return res, nil
+		}
+		wbgong.Debug.Printf("can't preserve formatting of the config: %s", err)
+	}
+	res, err := convertFromJSON(content, nil, nil)
+	return res.content, err
+}
+
+// jsonCompatible converts the values decoded from YAML or TOML
+// to the ones which can be encoded to JSON
+func jsonCompatible(v any) any {
+	switch t := v.(type) {
+	case map[string]any:
+		for k, item := range t {
+			t[k] = jsonCompatible(item)
+		}
+		return t
+	case map[any]any:
+		m := make(map[string]any, len(t))
+		for k, item := range t {
+			m[fmt.Sprint(k)] = jsonCompatible(item)
+		}
+		return m
+	case []any:
+		for n, item := range t {
+			t[n] = jsonCompatible(item)
+		}
+		return t
+	case []map[string]any:
+		l := make([]any, len(t))
+		for n, item := range t {
+			l[n] = jsonCompatible(item)
+		}
+		return l
+	case time.Time:
+		return t.Format(timeLayout(t))
+	default:
+		return v
+	}
+}
+
+// nativeNumbers converts json.Number values decoded by decodeJSONValue
+// to int64 or float64, so integers are encoded as integers
+func nativeNumbers(v any) any {
+	switch t := v.(type) {
+	case map[string]any:
+		for k, item := range t {
+			t[k] = nativeNumbers(item)
+		}
+	case []any:
+		for n, item := range t {
+			t[n] = nativeNumbers(item)
+		}
+	case json.Number:
+		if i, err := t.Int64(); err == nil {
+			return i
+		}
+		if f, err := t.Float64(); err == nil {
+			return f
+		}
+	}
+	return v
+}
+
+func yamlToJSON(raw []byte) ([]byte, error) {
+	var v any
+	if err := yaml.Unmarshal(raw, &v); err != nil {
+		return nil, err
+	}
+	if v == nil {
+		// empty file
+		v = map[string]any{}
+	}
+	return json.Marshal(jsonCompatible(v))
+}
+
+// strings which are booleans in YAML 1.1,
+// they are quoted for the services using old YAML parsers
+var yaml11Booleans = map[string]bool{
+	"y": true, "yes": true, "on": true,
+	"n": true, "no": true, "off": true,
+}
+
+// resetYAMLStyle makes the nodes decoded from JSON use block style
+func resetYAMLStyle(node *yaml.Node) {
+	node.Style = 0
+	if node.Kind == yaml.ScalarNode && node.Tag == "!!str" && yaml11Booleans[strings.ToLower(node.Value)] {
+		node.Style = yaml.DoubleQuotedStyle
+	}
+	for _, child := range node.Content {
+		resetYAMLStyle(child)
+	}
+}
+
+func yamlFromJSON(content, orig []byte) ([]byte, error) {
+	// JSON is YAML, so the key order of the content is kept
+	var node yaml.Node
+	if err := yaml.Unmarshal(content, &node); err != nil {
+		return nil, err
+	}
+	resetYAMLStyle(&node)
+	var buf bytes.Buffer
+	encoder := yaml.NewEncoder(&buf)
+	encoder.SetIndent(YAML_INDENT)
+	if err := encoder.Encode(&node); err != nil {
+		return nil, err
+	}
+	if err := encoder.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// layouts of TOML local dates and times by the names
+// of the locations they are decoded with
+var tomlLocalTimeLayouts = map[string]string{
+	"datetime-local": "2006-01-02T15:04:05.999999999",
+	"date-local":     "2006-01-02",
+	"time-local":     "15:04:05.999999999",
+}
+
+// timeLayout returns the layout the time is written in JSON with
+func timeLayout(t time.Time) string {
+	if layout, found := tomlLocalTimeLayouts[t.Location().String()]; found {
+		return layout
+	}
+	return time.RFC3339Nano
+}
+
+// restoreTOMLTimes makes the strings of the JSON content which were
+// TOML dates and times in the original config dates and times again,
+// so Load/Save round trip doesn't change their type. The strings
+// which don't match the layout of the original value are kept.
+func restoreTOMLTimes(v, orig any) any {
+	switch t := v.(type) {
+	case map[string]any:
+		if o, ok := orig.(map[string]any); ok {
+			for k, item := range t {
+				t[k] = restoreTOMLTimes(item, o[k])
+			}
+		}
+	case []any:
+		var o []any
+		switch origList := orig.(type) {
+		case []any:
+			o = origList
+		case []map[string]any:
+			// arrays of tables
+			for _, item := range origList {
+				o = append(o, item)
+			}
+		}
+		for n := 0; n < len(t) && n < len(o); n++ {
+			t[n] = restoreTOMLTimes(t[n], o[n])
+		}
+	case string:
+		if o, ok := orig.(time.Time); ok {
+			if parsed, err := time.ParseInLocation(timeLayout(o), t, o.Location()); err == nil {
+				return parsed
+			}
+		}
+	}
+	return v
+}
+
+func tomlToJSON(raw []byte) ([]byte, error) {
+	var v map[string]any
+	if err := toml.Unmarshal(raw, &v); err != nil {
+		return nil, err
+	}
+	if v == nil {
+		v = map[string]any{}
+	}
+	return json.Marshal(jsonCompatible(v))
+}
+
+var errTOMLNotObject = errors.New("TOML config must be an object")
+
+func tomlFromJSON(content, orig []byte) ([]byte, error) {
+	v, err := decodeJSONValue(content)
+	if err != nil {
+		return nil, err
+	}
+	m, ok := nativeNumbers(v).(map[string]any)
+	if !ok {
+		return nil, errTOMLNotObject
+	}
+	var origValue map[string]any
+	if orig != nil && toml.Unmarshal(orig, &origValue) == nil {
+		restoreTOMLTimes(m, origValue)
+	}
+	var buf bytes.Buffer
+	if err = toml.NewEncoder(&buf).Encode(m); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,199 @@
+package confed
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/BurntSushi/toml"
+)
+
+func TestConfigFormats(t *testing.T) {
+	for _, tc := range []struct {
+		format, raw, json string
+	}{
+		{CONFIG_FORMAT_JSON, `{"a": 1}`, `{"a": 1}`},
+		{CONFIG_FORMAT_JSONC, "// comment\n{\"a\": 1, /* b */ \"b\": [1, 2]}", `{"a": 1, "b": [1, 2]}`},
+		{
+			CONFIG_FORMAT_YAML,
+			"# servers\nservers:\n  - host: ntp1\n    port: 123\nenabled: true\nname: \"yes\"\n",
+			`{"servers": [{"host": "ntp1", "port": 123}], "enabled": true, "name": "yes"}`,
+		},
+		{CONFIG_FORMAT_YAML, "", `{}`},
+		{
+			CONFIG_FORMAT_TOML,
+			"title = \"test\"\nratio = 0.5\n\n[server]\nport = 8080\nhosts = [\"a\", \"b\"]\n",
+			`{"title": "test", "ratio": 0.5, "server": {"port": 8080, "hosts": ["a", "b"]}}`,
+		},
+		{
+			CONFIG_FORMAT_INI,
+			"; global\nmode = auto\n\n[eth0]\naddress = 192.168.1.2\n# disabled\nenabled = true\n",
+			`{"mode": "auto", "eth0": {"address": "192.168.1.2", "enabled": "true"}}`,
+		},
+		{
+			CONFIG_FORMAT_SHELL,
+			"# defaults\nexport DAEMON_OPTS=\"-v --port 8080\"\nENABLED=yes # comment\nNAME='it''s'\n",
+			`{"DAEMON_OPTS": "-v --port 8080", "ENABLED": "yes"}`,
+		},
+	} {
+		format := configFormats[tc.format]
+		res, err := format.toJSON([]byte(tc.raw))
+		if err != nil {
+			t.Errorf("%s toJSON: %s", tc.format, err)
+			continue
+		}
+		var expected, actual any
+		if err = json.Unmarshal([]byte(tc.json), &expected); err != nil {
+			t.Fatal(err)
+		}
+		if err = json.Unmarshal(res, &actual); err != nil {
+			t.Errorf("%s toJSON: invalid JSON %s", tc.format, res)
+			continue
+		}
+		if !reflect.DeepEqual(expected, actual) {
+			t.Errorf("%s toJSON: expected %s, got %s", tc.format, tc.json, res)
+		}
+
+		// the config written by fromJSON must be read back the same
+		for _, orig := range [][]byte{nil, []byte(tc.raw)} {
+			written, err := format.fromJSON([]byte(tc.json), orig)
+			if err != nil {
+				t.Errorf("%s fromJSON: %s", tc.format, err)
+				continue
+			}
+			res, err = format.toJSON(written)
+			if err != nil {
+				t.Errorf("%s: can't read back %q: %s", tc.format, written, err)
+				continue
+			}
+			actual = nil
+			if err = json.Unmarshal(res, &actual); err != nil || !reflect.DeepEqual(expected, actual) {
+				t.Errorf("%s: %q is read back as %s", tc.format, written, res)
+			}
+		}
+	}
+}
+
+func TestConfigFormatErrors(t *testing.T) {
+	for _, tc := range []struct {
+		format, raw string
+	}{
+		{CONFIG_FORMAT_JSON, "// comment\n{}"},
+		{CONFIG_FORMAT_YAML, "a: [1"},
+		{CONFIG_FORMAT_TOML, "a = "},
+	} {
+		if _, err := configFormats[tc.format].toJSON([]byte(tc.raw)); err == nil {
+			t.Errorf("%s: %q must not be parsed", tc.format, tc.raw)
+		}
+	}
+
+	for _, tc := range []struct {
+		format, content string
+	}{
+		{CONFIG_FORMAT_TOML, `[1, 2]`},
+		{CONFIG_FORMAT_INI, `{"section": {"nested": {}}}`},
+		{CONFIG_FORMAT_INI, `{"a": [1]}`},
+		{CONFIG_FORMAT_SHELL, `{"a": {"b": "c"}}`},
+		{CONFIG_FORMAT_SHELL, `{"a": "multi\nline"}`},
+	} {
+		if _, err := configFormats[tc.format].fromJSON([]byte(tc.content), nil); err == nil {
+			t.Errorf("%s: %s must not be converted", tc.format, tc.content)
+		}
+	}
+}
+
+func TestYAMLFromJSONKeepsKeyOrder(t *testing.T) {
+	res, err := yamlFromJSON([]byte(`{"b": 1, "a": {"y": "on", "x": [1, "2"]}}`), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "b: 1\na:\n  \"y\": \"on\"\n  x:\n    - 1\n    - \"2\"\n"
+	if string(res) != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, res)
+	}
+}
+
+func TestTOMLDatesAndTimes(t *testing.T) {
+	orig := []byte(`created = 1979-05-27T07:32:00-08:00
+local = 1979-05-27T07:32:00.5
+day = 1979-05-27
+alarm = 07:32:00
+note = "1979-05-27"
+dates = [1979-05-27, 1980-01-01]
+
+[[events]]
+at = 1979-05-27T07:32:00Z
+`)
+	res, err := tomlToJSON(orig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var actual any
+	if err = json.Unmarshal(res, &actual); err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]any{
+		"created": "1979-05-27T07:32:00-08:00",
+		"local":   "1979-05-27T07:32:00.5",
+		"day":     "1979-05-27",
+		"alarm":   "07:32:00",
+		"note":    "1979-05-27",
+		"dates":   []any{"1979-05-27", "1980-01-01"},
+		"events":  []any{map[string]any{"at": "1979-05-27T07:32:00Z"}},
+	}
+	if !reflect.DeepEqual(expected, actual) {
+		t.Errorf("expected %v, got %s", expected, res)
+	}
+
+	// the dates and times stay dates and times, the changed ones too
+	content := []byte(`{
+		"created": "1980-01-01T00:00:00+03:00",
+		"local": "1979-05-27T07:32:00.5",
+		"day": "1980-01-01",
+		"alarm": "not a time",
+		"note": "1979-05-27",
+		"dates": ["1979-05-27", "1980-01-02", "1980-01-03"],
+		"events": [{"at": "1979-05-27T07:32:00Z"}]
+	}`)
+	written, err := tomlFromJSON(content, orig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var values map[string]any
+	if _, err = toml.Decode(string(written), &values); err != nil {
+		t.Fatalf("can't read back %q: %s", written, err)
+	}
+	for _, key := range []string{"created", "local", "day"} {
+		if _, ok := values[key].(time.Time); !ok {
+			t.Errorf("%s must be written as date or time in %q", key, written)
+		}
+	}
+	for _, key := range []string{"alarm", "note"} {
+		if _, ok := values[key].(string); !ok {
+			t.Errorf("%s must be written as string in %q", key, written)
+		}
+	}
+	dates := values["dates"].([]any)
+	if _, ok := dates[1].(time.Time); !ok {
+		t.Errorf("changed date must be written as date in %q", written)
+	}
+	if _, ok := dates[2].(string); !ok {
+		t.Errorf("new array item must be written as string in %q", written)
+	}
+	if _, ok := values["events"].([]map[string]any)[0]["at"].(time.Time); !ok {
+		t.Errorf("date in array of tables must be written as date in %q", written)
+	}
+	res, err = tomlToJSON(written)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var expectedContent any
+	if err = json.Unmarshal(content, &expectedContent); err != nil {
+		t.Fatal(err)
+	}
+	actual = nil
+	if err = json.Unmarshal(res, &actual); err != nil || !reflect.DeepEqual(expectedContent, actual) {
+		t.Errorf("%q is read back as %s", written, res)
+	}
+}
@@ -0,0 +1,184 @@
+package confed
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	HISTORY_DIR = "/var/lib/wb-mqtt-confed/history"
+	// the history may contain secrets, so it's readable only by root,
+	// the versions keep the mode of the config file
+	HISTORY_DIR_MODE          = 0700
+	HISTORY_META_MODE         = 0600
+	HISTORY_ID_FORMAT         = "20060102T150405.000000000Z"
+	HISTORY_CONTENT_EXT       = ".conf"
+	HISTORY_META_EXT          = ".json"
+	DEFAULT_HISTORY_MAX_COUNT = 10
+	DEFAULT_HISTORY_MAX_SIZE  = 1024 * 1024
+)
+
+var errHistoryEntryNotFound = errors.New("history entry not found")
+
+type HistoryEntry struct {
+	Id        string    `json:"id"`
+	Timestamp time.Time `json:"timestamp"`
+	ClientId  string    `json:"clientId"`
+	Hash      string    `json:"hash"`
+	Size      int64     `json:"size"`
+}
+
+// configHistory keeps saved versions of a single config file.
+// Every version is stored as a pair of files named by its id:
+// the content of the physical config file and its metadata.
+type configHistory struct {
+	dir      string
+	maxCount int
+	maxSize  int64
+}
+
+func newConfigHistory(historyRoot, configPath string, maxCount int, maxSize int64) *configHistory {
+	return &configHistory{
+		dir:      filepath.Join(historyRoot, configPath),
+		maxCount: maxCount,
+		maxSize:  maxSize,
+	}
+}
+
+func contentHash(content []byte) string {
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
+
+// configFileMode returns the permissions of the config file
+// or the default ones if it doesn't exist
+func configFileMode(path string) os.FileMode {
+	if fi, err := os.Stat(path); err == nil {
+		return fi.Mode().Perm()
+	}
+	return DEFAULT_CONFIG_FILE_MODE
+}
+
+func (h *configHistory) enabled() bool {
+	return h.maxCount > 0
+}
+
+func (h *configHistory) contentPath(id string) string {
+	return filepath.Join(h.dir, id+HISTORY_CONTENT_EXT)
+}
+
+func (h *configHistory) metaPath(id string) string {
+	return filepath.Join(h.dir, id+HISTORY_META_EXT)
+}
+
+// List returns history entries, newest first
+func (h *configHistory) List() ([]*HistoryEntry, error) {
+	entries := make([]*HistoryEntry, 0)
+	files, err := os.ReadDir(h.dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return entries, nil
+		}
+		return nil, err
+	}
+	for _, file := range files {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), HISTORY_META_EXT) {
+			continue
+		}
+		bs, err := os.ReadFile(filepath.Join(h.dir, file.Name()))
+		if err != nil {
+			return nil, err
+		}
+		var entry HistoryEntry
+		if err = json.Unmarshal(bs, &entry); err != nil {
+			return nil, err
+		}
+		entries = append(entries, &entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Id > entries[j].Id
+	})
+	return entries, nil
+}
+
+// Content returns the stored config file content for the entry id
+func (h *configHistory) Content(id string) ([]byte, error) {
+	if id == "" || filepath.Base(id) != id {
+		return nil, errHistoryEntryNotFound
+	}
+	bs, err := os.ReadFile(h.contentPath(id))
+	if os.IsNotExist(err) {
+		return nil, errHistoryEntryNotFound
+	}
+	return bs, err
+}
+
+// Record stores a new version of the config file with the mode
+// of the file unless it's the same as the latest recorded one
+func (h *configHistory) Record(content []byte, mode os.FileMode, clientId string) (*HistoryEntry, error) {
+	entries, err := h.List()
+	if err != nil {
+		return nil, err
+	}
+	hash := contentHash(content)
+	if len(entries) > 0 && entries[0].Hash == hash {
+		return entries[0], nil
+	}
+
+	now := time.Now().UTC()
+	// keep ids ordered even if the clock goes backwards
+	if len(entries) > 0 && !now.After(entries[0].Timestamp) {
+		now = entries[0].Timestamp.Add(time.Nanosecond)
+	}
+	entry := &HistoryEntry{
+		Id:        now.Format(HISTORY_ID_FORMAT),
+		Timestamp: now,
+		ClientId:  clientId,
+		Hash:      hash,
+		Size:      int64(len(content)),
+	}
+	meta, err := json.Marshal(entry)
+	if err != nil {
+		return nil, err
+	}
+	if err = os.MkdirAll(h.dir, HISTORY_DIR_MODE); err != nil {
+		return nil, err
+	}
+	if err = writeFileAtomic(h.contentPath(entry.Id), content, mode.Perm()); err != nil {
+		return nil, err
+	}
+	// the metadata is written last, so the entry doesn't appear in the list
+	// until its content is stored
+	if err = writeFileAtomic(h.metaPath(entry.Id), meta, HISTORY_META_MODE); err != nil {
+		os.Remove(h.contentPath(entry.Id))
+		return nil, err
+	}
+
+	return entry, h.prune(append([]*HistoryEntry{entry}, entries...))
+}
+
+// prune removes the oldest entries exceeding the count or total size limits.
+// The newest entry is always kept.
+func (h *configHistory) prune(entries []*HistoryEntry) error {
+	var totalSize int64
+	for n, entry := range entries {
+		totalSize += entry.Size
+		if n == 0 || (n < h.maxCount && (h.maxSize <= 0 || totalSize <= h.maxSize)) {
+			continue
+		}
+		if err := os.Remove(h.metaPath(entry.Id)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if err := os.Remove(h.contentPath(entry.Id)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
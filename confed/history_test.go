@@ -0,0 +1,134 @@
+package confed
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func recordHistory(t *testing.T, h *configHistory, content, clientId string) *HistoryEntry {
+	t.Helper()
+	entry, err := h.Record([]byte(content), DEFAULT_CONFIG_FILE_MODE, clientId)
+	if err != nil {
+		t.Fatalf("Record() failed: %v", err)
+	}
+	return entry
+}
+
+func listHistory(t *testing.T, h *configHistory) []*HistoryEntry {
+	t.Helper()
+	entries, err := h.List()
+	if err != nil {
+		t.Fatalf("List() failed: %v", err)
+	}
+	return entries
+}
+
+func TestHistoryRecord(t *testing.T) {
+	h := newConfigHistory(t.TempDir(), "/etc/test.conf", 10, 1024)
+	if entries := listHistory(t, h); len(entries) != 0 {
+		t.Fatalf("empty history expected, got %d entries", len(entries))
+	}
+
+	first := recordHistory(t, h, "first", "client1")
+	second := recordHistory(t, h, "second", "client2")
+	if dup := recordHistory(t, h, "second", "client3"); dup.Id != second.Id {
+		t.Errorf("same content must not be recorded twice")
+	}
+
+	entries := listHistory(t, h)
+	if len(entries) != 2 {
+		t.Fatalf("2 entries expected, got %d", len(entries))
+	}
+	if entries[0].Id != second.Id || entries[1].Id != first.Id {
+		t.Errorf("entries must be listed newest first")
+	}
+	if entries[0].ClientId != "client2" || entries[0].Hash != contentHash([]byte("second")) || entries[0].Size != 6 {
+		t.Errorf("unexpected entry: %+v", entries[0])
+	}
+
+	bs, err := h.Content(first.Id)
+	if err != nil {
+		t.Fatalf("Content() failed: %v", err)
+	}
+	if string(bs) != "first" {
+		t.Errorf("unexpected content: %q", string(bs))
+	}
+}
+
+func TestHistoryContentNotFound(t *testing.T) {
+	h := newConfigHistory(t.TempDir(), "/etc/test.conf", 10, 1024)
+	recordHistory(t, h, "first", "")
+	for _, id := range []string{"", "nosuchid", "../../etc/passwd"} {
+		if _, err := h.Content(id); err != errHistoryEntryNotFound {
+			t.Errorf("errHistoryEntryNotFound expected for %q, got %v", id, err)
+		}
+	}
+}
+
+func TestHistoryPruneByCount(t *testing.T) {
+	h := newConfigHistory(t.TempDir(), "/etc/test.conf", 3, 1024)
+	var last *HistoryEntry
+	for _, content := range []string{"1", "2", "3", "4", "5"} {
+		last = recordHistory(t, h, content, "")
+	}
+	entries := listHistory(t, h)
+	if len(entries) != 3 {
+		t.Fatalf("3 entries expected, got %d", len(entries))
+	}
+	if entries[0].Id != last.Id {
+		t.Errorf("the newest entry must be kept")
+	}
+	if _, err := h.Content(entries[2].Id); err != nil {
+		t.Errorf("content of the kept entry is removed: %v", err)
+	}
+}
+
+func TestHistoryPruneBySize(t *testing.T) {
+	h := newConfigHistory(t.TempDir(), "/etc/test.conf", 10, 25)
+	for _, c := range []string{"a", "b", "c"} {
+		recordHistory(t, h, strings.Repeat(c, 10), "")
+	}
+	if entries := listHistory(t, h); len(entries) != 2 {
+		t.Fatalf("2 entries expected, got %d", len(entries))
+	}
+
+	// the newest entry is kept even if it exceeds the limit
+	recordHistory(t, h, strings.Repeat("d", 100), "")
+	if entries := listHistory(t, h); len(entries) != 1 {
+		t.Fatalf("1 entry expected, got %d", len(entries))
+	}
+}
+
+func TestHistoryPermissions(t *testing.T) {
+	root := filepath.Join(t.TempDir(), "history")
+	h := newConfigHistory(root, "/etc/secret.conf", 10, 1024)
+	entry, err := h.Record([]byte("wpa-psk secret"), 0600, "")
+	if err != nil {
+		t.Fatalf("Record() failed: %v", err)
+	}
+
+	for _, dir := range []string{root, filepath.Join(root, "etc"), h.dir} {
+		if fi, err := os.Stat(dir); err != nil || fi.Mode().Perm() != HISTORY_DIR_MODE {
+			t.Errorf("%s must have mode %o: %v, %v", dir, HISTORY_DIR_MODE, fi, err)
+		}
+	}
+	for path, mode := range map[string]os.FileMode{
+		h.contentPath(entry.Id): 0600,
+		h.metaPath(entry.Id):    HISTORY_META_MODE,
+	} {
+		if fi, err := os.Stat(path); err != nil || fi.Mode().Perm() != mode {
+			t.Errorf("%s must have mode %o: %v, %v", path, mode, fi, err)
+		}
+	}
+
+	// the versions keep the mode of the config file
+	entry, err = h.Record([]byte("public"), 0644, "")
+	if err != nil {
+		t.Fatalf("Record() failed: %v", err)
+	}
+	if fi, err := os.Stat(h.contentPath(entry.Id)); err != nil || fi.Mode().Perm() != 0644 {
+		t.Errorf("unexpected mode of the version: %v, %v", fi, err)
+	}
+}
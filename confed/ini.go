@@ -0,0 +1,415 @@
+package confed
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// INI and shell-style KEY=value configs are represented in JSON as objects.
+// In INI configs the keys before the first section are the string
+// properties of the object, every section is an object property
+// containing the section's keys. KEY=value configs are flat.
+// All the values are strings.
+//
+// The configs are written line by line: the changed values are replaced
+// in place, so the comments and the lines which aren't understood
+// (e.g. shell code in /etc/default files) are preserved.
+
+// keyValueSyntax describes the differences between INI and KEY=value files
+type keyValueSyntax struct {
+	name     string
+	sections bool
+	// parseLine returns the key, the value and the parts of the line
+	// around the value. ok is false if the line isn't a key=value line.
+	parseLine func(line string) (l keyValueLine, ok bool)
+	// formatValue makes the value as written in the file,
+	// orig is the previous value as written
+	formatValue func(value, orig string) string
+	// checkValue returns an error if the value can't be written
+	// so that it's read back the same, nil if any value can be written
+	checkValue func(value string) error
+	isComment  func(line string) bool
+}
+
+type keyValueLine struct {
+	text    string
+	section string
+	header  bool
+	key     string
+	value   string
+	// the line is prefix + rawValue + suffix
+	prefix   string
+	rawValue string
+	suffix   string
+}
+
+func (l *keyValueLine) isKey() bool {
+	return l.key != "" && !l.header
+}
+
+func parseKeyValueLines(raw []byte, syntax *keyValueSyntax) []keyValueLine {
+	text := strings.TrimSuffix(string(raw), "\n")
+	if text == "" {
+		return nil
+	}
+	section := ""
+	var res []keyValueLine
+	for _, line := range strings.Split(text, "\n") {
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case trimmed == "" || syntax.isComment(trimmed):
+		case syntax.sections && strings.HasPrefix(trimmed, "[") && strings.HasSuffix(trimmed, "]"):
+			section = strings.TrimSpace(trimmed[1 : len(trimmed)-1])
+			res = append(res, keyValueLine{text: line, section: section, header: true})
+			continue
+		default:
+			if l, ok := syntax.parseLine(line); ok {
+				l.text, l.section = line, section
+				res = append(res, l)
+				continue
+			}
+		}
+		res = append(res, keyValueLine{text: line, section: section})
+	}
+	return res
+}
+
+func keyValueToJSON(raw []byte, syntax *keyValueSyntax) ([]byte, error) {
+	res := make(map[string]any)
+	for _, line := range parseKeyValueLines(raw, syntax) {
+		target := res
+		if line.section != "" {
+			v, found := res[line.section]
+			section, ok := v.(map[string]any)
+			if found && !ok {
+				// the key would be lost on save
+				return nil, fmt.Errorf("%s section [%s] has the same name as a top level key", syntax.name, line.section)
+			}
+			if !ok {
+				section = make(map[string]any)
+				res[line.section] = section
+			}
+			target = section
+		}
+		if line.isKey() {
+			// the last value wins like in shell
+			target[line.key] = line.value
+		}
+	}
+	return json.Marshal(res)
+}
+
+func keyValueString(v any) (string, error) {
+	switch t := v.(type) {
+	case nil:
+		return "", nil
+	case string:
+		if strings.ContainsAny(t, "\r\n") {
+			return "", fmt.Errorf("multiline values are not supported")
+		}
+		return t, nil
+	case bool, json.Number:
+		return fmt.Sprint(t), nil
+	default:
+		return "", fmt.Errorf("unsupported value %v", v)
+	}
+}
+
+func sortedKeys(m map[string]any) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// keyValueSections splits the JSON object to the sections
+// of string values, "" is the section of the top level keys
+func keyValueSections(content []byte, syntax *keyValueSyntax) (map[string]map[string]string, error) {
+	v, err := decodeJSONValue(content)
+	if err != nil {
+		return nil, err
+	}
+	m, ok := v.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("%s config must be an object", syntax.name)
+	}
+	valueString := func(v any) (string, error) {
+		s, err := keyValueString(v)
+		if err == nil && syntax.checkValue != nil {
+			err = syntax.checkValue(s)
+		}
+		return s, err
+	}
+	res := map[string]map[string]string{"": {}}
+	for k, item := range m {
+		if section, isSection := item.(map[string]any); isSection && syntax.sections && k != "" {
+			res[k] = make(map[string]string, len(section))
+			for key, value := range section {
+				if res[k][key], err = valueString(value); err != nil {
+					return nil, fmt.Errorf("%s/%s: %s", k, key, err)
+				}
+			}
+			continue
+		}
+		if res[""][k], err = valueString(item); err != nil {
+			return nil, fmt.Errorf("%s: %s", k, err)
+		}
+	}
+	return res, nil
+}
+
+func keyValueFromJSON(content, orig []byte, syntax *keyValueSyntax) ([]byte, error) {
+	sections, err := keyValueSections(content, syntax)
+	if err != nil {
+		return nil, err
+	}
+	lines := parseKeyValueLines(orig, syntax)
+
+	// the new keys are added after the last key of their INI section,
+	// the top level keys are added before the first section
+	lastLine := make(map[string]int)
+	present := make(map[string]map[string]bool)
+	for n, line := range lines {
+		if _, found := lastLine[""]; line.header && !found {
+			lastLine[""] = n
+		}
+		if line.header || line.isKey() {
+			lastLine[line.section] = n + 1
+		}
+		if line.isKey() {
+			if present[line.section] == nil {
+				present[line.section] = make(map[string]bool)
+			}
+			present[line.section][line.key] = true
+		}
+	}
+	if _, found := lastLine[""]; !found || !syntax.sections {
+		// KEY=value files are read top to bottom like shell does,
+		// so the new keys are appended to the end
+		lastLine[""] = len(lines)
+	}
+
+	var out []string
+	addKeys := func(section string) {
+		values := sections[section]
+		keys := make([]string, 0, len(values))
+		for key := range values {
+			if !present[section][key] {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			out = append(out, syntax.formatLine(key, values[key]))
+		}
+	}
+
+	for n := 0; n <= len(lines); n++ {
+		for section, last := range lastLine {
+			if last == n && (section == "" || sections[section] != nil) {
+				addKeys(section)
+			}
+		}
+		if n == len(lines) {
+			break
+		}
+		line := lines[n]
+		values, sectionKept := sections[line.section]
+		switch {
+		case line.section != "" && !sectionKept:
+			// the removed section is dropped with its comments
+		case line.isKey():
+			value, found := values[line.key]
+			if !found {
+				continue
+			}
+			if value == line.value {
+				out = append(out, line.text)
+			} else {
+				out = append(out, line.prefix+syntax.formatValue(value, line.rawValue)+line.suffix)
+			}
+		default:
+			out = append(out, line.text)
+		}
+	}
+
+	names := make([]string, 0, len(sections))
+	for name := range sections {
+		if _, found := lastLine[name]; !found {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if len(out) > 0 {
+			out = append(out, "")
+		}
+		out = append(out, "["+name+"]")
+		addKeys(name)
+	}
+
+	if len(out) == 0 {
+		return []byte{}, nil
+	}
+	return []byte(strings.Join(out, "\n") + "\n"), nil
+}
+
+func (syntax *keyValueSyntax) formatLine(key, value string) string {
+	if syntax.sections {
+		return key + " = " + syntax.formatValue(value, "")
+	}
+	return key + "=" + syntax.formatValue(value, "")
+}
+
+// iniInlineCommentStart returns the index of the inline comment
+// in the INI value, -1 if there's none. The inline comment starts
+// with ; or # after a space.
+func iniInlineCommentStart(s string) int {
+	for i := 0; i < len(s); i++ {
+		if (s[i] == ';' || s[i] == '#') && (i == 0 || s[i-1] == ' ' || s[i-1] == '\t') {
+			return i
+		}
+	}
+	return -1
+}
+
+var iniSyntax = &keyValueSyntax{
+	name:     "INI",
+	sections: true,
+	parseLine: func(line string) (l keyValueLine, ok bool) {
+		eq := strings.Index(line, "=")
+		if eq < 0 {
+			return l, false
+		}
+		l.key = strings.TrimSpace(line[:eq])
+		valueStart := eq + 1 + len(line[eq+1:]) - len(strings.TrimLeft(line[eq+1:], " \t"))
+		rest := line[valueStart:]
+		// the inline comment is kept in the suffix
+		end := iniInlineCommentStart(rest)
+		if end < 0 {
+			end = len(rest)
+		}
+		l.rawValue = strings.TrimRight(rest[:end], " \t\r")
+		l.value = l.rawValue
+		l.prefix = line[:valueStart]
+		l.suffix = line[valueStart+len(l.rawValue):]
+		if end == 0 && end < len(rest) {
+			// the comment must stay separated from the value written later
+			l.suffix = " " + l.suffix
+		}
+		return l, l.key != ""
+	},
+	formatValue: func(value, orig string) string {
+		return value
+	},
+	// INI values aren't quoted, so the values which would be
+	// read back differently are rejected
+	checkValue: func(value string) error {
+		if strings.Trim(value, " \t\r") != value {
+			return fmt.Errorf("INI values can't start or end with spaces")
+		}
+		if iniInlineCommentStart(value) >= 0 {
+			return fmt.Errorf("INI values can't contain ; or # after a space, they start a comment")
+		}
+		return nil
+	},
+	isComment: func(line string) bool {
+		return line[0] == ';' || line[0] == '#'
+	},
+}
+
+var shellKeyValueRe = regexp.MustCompile(`^(\s*(?:export\s+)?([A-Za-z_][A-Za-z0-9_]*)=)(.*)$`)
+
+// shell characters which require quoting
+const shellSpecialChars = " \t\"'\\$`#;&|<>()*?[]{}~!"
+
+// parseShellValue parses the shell word at the start of the string
+func parseShellValue(s string) (value, raw string, ok bool) {
+	switch {
+	case strings.HasPrefix(s, "'"):
+		end := strings.Index(s[1:], "'")
+		if end < 0 {
+			return "", "", false
+		}
+		return s[1 : end+1], s[:end+2], true
+	case strings.HasPrefix(s, `"`):
+		var b strings.Builder
+		for i := 1; i < len(s); i++ {
+			switch c := s[i]; {
+			case c == '"':
+				return b.String(), s[:i+1], true
+			case c == '\\' && i+1 < len(s) && strings.IndexByte("\"\\$`", s[i+1]) >= 0:
+				i++
+				b.WriteByte(s[i])
+			case c == '$' || c == '`':
+				// the value depends on the shell expansion
+				return "", "", false
+			default:
+				b.WriteByte(c)
+			}
+		}
+		return "", "", false
+	default:
+		end := strings.IndexAny(s, " \t\r")
+		if end < 0 {
+			end = len(s)
+		}
+		raw = s[:end]
+		if strings.ContainsAny(raw, "\"'\\$`;&|<>()") {
+			return "", "", false
+		}
+		return raw, raw, true
+	}
+}
+
+var shellSyntax = &keyValueSyntax{
+	name: "KEY=value",
+	parseLine: func(line string) (l keyValueLine, ok bool) {
+		m := shellKeyValueRe.FindStringSubmatch(line)
+		if m == nil {
+			return l, false
+		}
+		l.prefix, l.key = m[1], m[2]
+		l.value, l.rawValue, ok = parseShellValue(m[3])
+		l.suffix = m[3][len(l.rawValue):]
+		// only a comment may follow the value
+		if rest := strings.TrimSpace(l.suffix); rest != "" && !strings.HasPrefix(rest, "#") {
+			return l, false
+		}
+		return l, ok
+	},
+	formatValue: func(value, orig string) string {
+		if strings.HasPrefix(orig, "'") && !strings.Contains(value, "'") {
+			return "'" + value + "'"
+		}
+		if !strings.HasPrefix(orig, `"`) && !strings.ContainsAny(value, shellSpecialChars) {
+			return value
+		}
+		r := strings.NewReplacer(`\`, `\\`, `"`, `\"`, `$`, `\$`, "`", "\\`")
+		return `"` + r.Replace(value) + `"`
+	},
+	isComment: func(line string) bool {
+		return line[0] == '#'
+	},
+}
+
+func iniToJSON(raw []byte) ([]byte, error) {
+	return keyValueToJSON(raw, iniSyntax)
+}
+
+func iniFromJSON(content, orig []byte) ([]byte, error) {
+	return keyValueFromJSON(content, orig, iniSyntax)
+}
+
+func shellToJSON(raw []byte) ([]byte, error) {
+	return keyValueToJSON(raw, shellSyntax)
+}
+
+func shellFromJSON(content, orig []byte) ([]byte, error) {
+	return keyValueFromJSON(content, orig, shellSyntax)
+}
@@ -0,0 +1,127 @@
+package confed
+
+import (
+	"testing"
+)
+
+func TestKeyValueFromJSONPreservesLines(t *testing.T) {
+	for _, tc := range []struct {
+		name, format, orig, content, expected string
+	}{
+		{
+			"ini",
+			CONFIG_FORMAT_INI,
+			"; global settings\nmode = auto\n\n[eth0]\n# static address\naddress=192.168.1.2\nunknown line\n\n[eth1]\naddress = 10.0.0.1\n",
+			`{"mode": "manual", "debug": "1", "eth0": {"address": "192.168.1.3", "mask": "24"}, "wlan0": {"ssid": "test"}}`,
+			"; global settings\nmode = manual\ndebug = 1\n\n[eth0]\n# static address\naddress=192.168.1.3\nmask = 24\nunknown line\n\n\n[wlan0]\nssid = test\n",
+		},
+		{
+			"ini inline comments",
+			CONFIG_FORMAT_INI,
+			"[main]\na = 1 ; note\nb = 2\t# other note\nc = # empty\nurl = http://host/#anchor\n",
+			`{"main": {"a": "3", "b": "2", "c": "x", "url": "http://host/#anchor"}}`,
+			"[main]\na = 3 ; note\nb = 2\t# other note\nc = x # empty\nurl = http://host/#anchor\n",
+		},
+		{
+			"ini removed section",
+			CONFIG_FORMAT_INI,
+			"[a]\nx = 1\n\n[b]\n; about b\ny = 2\n\n[c]\nz = 3\n",
+			`{"a": {"x": "1"}, "c": {"z": "3"}}`,
+			"[a]\nx = 1\n\n[c]\nz = 3\n",
+		},
+		{
+			"ini without top level keys",
+			CONFIG_FORMAT_INI,
+			"[main]\na = 1\n",
+			`{"b": "2", "main": {"a": "1"}}`,
+			"b = 2\n[main]\na = 1\n",
+		},
+		{
+			"new file",
+			CONFIG_FORMAT_INI,
+			"",
+			`{"b": "2", "main": {"a": "1"}}`,
+			"b = 2\n\n[main]\na = 1\n",
+		},
+		{
+			"shell",
+			CONFIG_FORMAT_SHELL,
+			"# Defaults for the daemon\nexport OPTS=\"-v\" # verbose\nNAME='daemon'\nif [ -f /etc/local ]; then\n  . /etc/local\nfi\nDIR=/var/lib/daemon\nHOME=\"$DIR\"\n",
+			`{"OPTS": "-v --port \"80\"", "NAME": "new daemon", "ENABLED": "yes"}`,
+			"# Defaults for the daemon\nexport OPTS=\"-v --port \\\"80\\\"\" # verbose\nNAME='new daemon'\nif [ -f /etc/local ]; then\n  . /etc/local\nfi\nHOME=\"$DIR\"\nENABLED=yes\n",
+		},
+		{
+			"shell quoting",
+			CONFIG_FORMAT_SHELL,
+			"A=1\n",
+			`{"A": "a b", "B": "$HOME", "C": ""}`,
+			"A=\"a b\"\nB=\"\\$HOME\"\nC=\n",
+		},
+	} {
+		format := configFormats[tc.format]
+		res, err := format.fromJSON([]byte(tc.content), []byte(tc.orig))
+		if err != nil {
+			t.Errorf("%s: %s", tc.name, err)
+			continue
+		}
+		if string(res) != tc.expected {
+			t.Errorf("%s: expected:\n%s\ngot:\n%s", tc.name, tc.expected, res)
+		}
+	}
+}
+
+func TestShellToJSON(t *testing.T) {
+	res, err := shellToJSON([]byte("A=\"x \\\"y\\\" \\$z\"\nB='a b'\nC=$HOME\nexport D=4 # four\nE=1\nE=2\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `{"A":"x \"y\" $z","B":"a b","D":"4","E":"2"}`
+	if string(res) != expected {
+		t.Errorf("expected %s, got %s", expected, res)
+	}
+}
+
+func TestINIKeySectionCollision(t *testing.T) {
+	if _, err := iniToJSON([]byte("eth0 = up\n\n[eth0]\naddress = 10.0.0.1\n")); err == nil {
+		t.Error("error expected for section named as top level key")
+	}
+}
+
+func TestINIInlineComments(t *testing.T) {
+	res, err := iniToJSON([]byte("a = 1 ; note\n[main]\nb = x # note\nc = ; empty\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `{"a":"1","main":{"b":"x","c":""}}`
+	if string(res) != expected {
+		t.Errorf("expected %s, got %s", expected, res)
+	}
+}
+
+func TestINIValuesReadBackDifferently(t *testing.T) {
+	for _, content := range []string{
+		`{"a": "1 ; not a comment"}`,
+		`{"main": {"a": "x\t# y"}}`,
+		`{"a": "#1"}`,
+		`{"a": " 1"}`,
+		`{"main": {"a": "1 "}}`,
+	} {
+		if res, err := iniFromJSON([]byte(content), nil); err == nil {
+			t.Errorf("%s: error expected, got %q", content, res)
+		}
+	}
+
+	// the values which are read back the same are written as is
+	content := `{"a":"1;2","main":{"b":"http://host/#anchor","c":"x y"}}`
+	res, err := iniFromJSON([]byte(content), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	readBack, err := iniToJSON(res)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(readBack) != content {
+		t.Errorf("expected %s, got %s", content, readBack)
+	}
+}
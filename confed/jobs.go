@@ -0,0 +1,302 @@
+package confed
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/wirenboard/wbgong"
+)
+
+const (
+	JOBS_TOPIC_PREFIX = "/wb-mqtt-confed/jobs/"
+	MAX_JOBS          = 100
+	JOB_ID_BYTES      = 8
+
+	JOB_STATE_PENDING      = "pending"
+	JOB_STATE_RUNNING      = "running"
+	JOB_STATE_DONE         = "done"
+	JOB_STATE_FAILED       = "failed"
+	JOB_STATE_ROLLING_BACK = "rollingBack"
+	JOB_STATE_ROLLED_BACK  = "rolledBack"
+
+	ROLLBACK_CLIENT_ID = "rollback"
+)
+
+type ServiceRestartResult struct {
+	Service     string `json:"service"`
+	State       string `json:"state"`
+	ExitCode    int    `json:"exitCode"`
+	Stderr      string `json:"stderr,omitempty"`
+	ActiveState string `json:"activeState,omitempty"`
+}
+
+// RestartJob tracks restarting of the services after a config is saved
+type RestartJob struct {
+	Id            string                  `json:"id"`
+	ConfigPath    string                  `json:"configPath"`
+	State         string                  `json:"state"`
+	Created       time.Time               `json:"created"`
+	Finished      *time.Time              `json:"finished,omitempty"`
+	Services      []*ServiceRestartResult `json:"services"`
+	Rollback      []*ServiceRestartResult `json:"rollback,omitempty"`
+	RollbackError string                  `json:"rollbackError,omitempty"`
+	tracker       *jobTracker
+	// restores the previous config if any of the services fails,
+	// nil if rollback is disabled
+	rollback func() error
+	// set if any of the services is in the failed state after restart
+	// or its action returned an error, only such jobs are rolled back
+	serviceBroken bool
+	// how long the services are watched after restart
+	checkTimeout time.Duration
+	// how the services are restarted, see JSONSchema.ServiceAction()
+	// and JSONSchema.ServiceCommand()
+	serviceAction  string
+	serviceCommand []string
+}
+
+// mqttPublisher is the part of wbgong.MQTTClient used by confed
+type mqttPublisher interface {
+	Publish(message wbgong.MQTTMessage)
+}
+
+// jobTracker keeps the latest restart jobs and publishes
+// their state to retained MQTT topics
+type jobTracker struct {
+	mtx        sync.Mutex
+	jobs       map[string]*RestartJob
+	order      []string
+	mqttClient mqttPublisher
+}
+
+func newJobTracker() *jobTracker {
+	return &jobTracker{
+		jobs:  make(map[string]*RestartJob),
+		order: make([]string, 0, MAX_JOBS),
+	}
+}
+
+func newJobId() string {
+	bs := make([]byte, JOB_ID_BYTES)
+	if _, err := rand.Read(bs); err != nil {
+		return time.Now().UTC().Format(HISTORY_ID_FORMAT)
+	}
+	return hex.EncodeToString(bs)
+}
+
+func (t *jobTracker) setMQTTClient(client mqttPublisher) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	t.mqttClient = client
+}
+
+func (t *jobTracker) publish(id string, payload string) {
+	if t.mqttClient == nil {
+		return
+	}
+	t.mqttClient.Publish(wbgong.MQTTMessage{
+		Topic:    JOBS_TOPIC_PREFIX + id,
+		Payload:  payload,
+		QoS:      1,
+		Retained: true,
+	})
+}
+
+func (t *jobTracker) publishJob(job *RestartJob) {
+	bs, err := json.Marshal(job)
+	if err != nil {
+		wbgong.Error.Printf("failed to serialize job %s: %s", job.Id, err)
+		return
+	}
+	t.publish(job.Id, string(bs))
+}
+
+func (t *jobTracker) start(configPath string, services []string) *RestartJob {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	job := &RestartJob{
+		Id:         newJobId(),
+		ConfigPath: configPath,
+		State:      JOB_STATE_PENDING,
+		Created:    time.Now().UTC(),
+		Services:   make([]*ServiceRestartResult, len(services)),
+		tracker:    t,
+	}
+	for n, service := range services {
+		job.Services[n] = &ServiceRestartResult{Service: service, State: JOB_STATE_PENDING}
+	}
+
+	if len(t.order) == MAX_JOBS {
+		// remove the oldest job and clear its retained topic
+		delete(t.jobs, t.order[0])
+		t.publish(t.order[0], "")
+		t.order = t.order[1:]
+	}
+	t.jobs[job.Id] = job
+	t.order = append(t.order, job.Id)
+	t.publishJob(job)
+	return job
+}
+
+// Get returns a copy of the job
+func (t *jobTracker) Get(id string) (RestartJob, bool) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	job, found := t.jobs[id]
+	if !found {
+		return RestartJob{}, false
+	}
+	res := *job
+	res.Services = copyServiceResults(job.Services)
+	res.Rollback = copyServiceResults(job.Rollback)
+	return res, true
+}
+
+func copyServiceResults(results []*ServiceRestartResult) []*ServiceRestartResult {
+	if results == nil {
+		return nil
+	}
+	res := make([]*ServiceRestartResult, len(results))
+	for n, result := range results {
+		r := *result
+		res[n] = &r
+	}
+	return res
+}
+
+func newServiceRestartResult(name string, res RunCommandResult, err error, activeState string) *ServiceRestartResult {
+	result := &ServiceRestartResult{
+		Service:     name,
+		State:       JOB_STATE_DONE,
+		ExitCode:    res.exitCode,
+		Stderr:      res.stderr.String(),
+		ActiveState: activeState,
+	}
+	if err != nil || res.exitCode != 0 || serviceStateFailed(activeState) {
+		result.State = JOB_STATE_FAILED
+	}
+	return result
+}
+
+func (job *RestartJob) findService(name string) *ServiceRestartResult {
+	for _, service := range job.Services {
+		if service.Service == name && service.State != JOB_STATE_DONE && service.State != JOB_STATE_FAILED {
+			return service
+		}
+	}
+	return nil
+}
+
+func (job *RestartJob) setRunning() {
+	t := job.tracker
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	if job.State == JOB_STATE_PENDING {
+		job.State = JOB_STATE_RUNNING
+		t.publishJob(job)
+	}
+}
+
+// serviceRestarted records the result of the service restart
+// and finishes the job if all its services are restarted.
+// Returns true if the job is failed and must be rolled back.
+func (job *RestartJob) serviceRestarted(name string, res RunCommandResult, err error, activeState string) bool {
+	t := job.tracker
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	service := job.findService(name)
+	if service == nil {
+		return false
+	}
+	job.State = JOB_STATE_RUNNING
+	*service = *newServiceRestartResult(name, res, err, activeState)
+	if service.State == JOB_STATE_FAILED {
+		job.serviceBroken = true
+	}
+
+	finished := true
+	failed := false
+	for _, s := range job.Services {
+		switch s.State {
+		case JOB_STATE_FAILED:
+			failed = true
+		case JOB_STATE_DONE:
+		default:
+			finished = false
+		}
+	}
+	if !finished {
+		t.publishJob(job)
+		return false
+	}
+
+	if job.serviceBroken && job.rollback != nil {
+		job.State = JOB_STATE_ROLLING_BACK
+		t.publishJob(job)
+		return true
+	}
+
+	now := time.Now().UTC()
+	job.Finished = &now
+	job.State = JOB_STATE_DONE
+	if failed {
+		job.State = JOB_STATE_FAILED
+	}
+	t.publishJob(job)
+	return false
+}
+
+// serviceRolledBack records the result of the service restart
+// after the previous config is restored and finishes the job
+// if all its services are restarted
+func (job *RestartJob) serviceRolledBack(name string, res RunCommandResult, err error, activeState string) {
+	t := job.tracker
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	job.Rollback = append(job.Rollback, newServiceRestartResult(name, res, err, activeState))
+	if len(job.Rollback) < len(job.Services) {
+		t.publishJob(job)
+		return
+	}
+	job.finishRollback(nil)
+}
+
+func (job *RestartJob) rollbackFinished(err error) {
+	t := job.tracker
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	job.finishRollback(err)
+}
+
+// must be called with the tracker mutex locked
+func (job *RestartJob) finishRollback(err error) {
+	t := job.tracker
+	now := time.Now().UTC()
+	job.Finished = &now
+	job.State = JOB_STATE_ROLLED_BACK
+	if err != nil {
+		job.State = JOB_STATE_FAILED
+		job.RollbackError = err.Error()
+	}
+	t.publishJob(job)
+}
+
+func (job *RestartJob) serviceNames() []string {
+	t := job.tracker
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	names := make([]string, len(job.Services))
+	for n, service := range job.Services {
+		names[n] = service.Service
+	}
+	return names
+}
@@ -0,0 +1,192 @@
+package confed
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/wirenboard/wbgong"
+)
+
+type fakePublisher struct {
+	sync.Mutex
+	messages []wbgong.MQTTMessage
+}
+
+func (p *fakePublisher) Publish(message wbgong.MQTTMessage) {
+	p.Lock()
+	defer p.Unlock()
+	p.messages = append(p.messages, message)
+}
+
+func (p *fakePublisher) last(t *testing.T) (message wbgong.MQTTMessage, job RestartJob) {
+	t.Helper()
+	p.Lock()
+	defer p.Unlock()
+	if len(p.messages) == 0 {
+		t.Fatalf("no messages published")
+	}
+	message = p.messages[len(p.messages)-1]
+	if message.Payload != "" {
+		if err := json.Unmarshal([]byte(message.Payload), &job); err != nil {
+			t.Fatalf("bad job payload %s: %v", message.Payload, err)
+		}
+	}
+	return
+}
+
+func TestJobTracker(t *testing.T) {
+	publisher := &fakePublisher{}
+	tracker := newJobTracker()
+	tracker.setMQTTClient(publisher)
+
+	job := tracker.start("/etc/test.conf", []string{"svc1", "svc2"})
+	message, published := publisher.last(t)
+	if message.Topic != JOBS_TOPIC_PREFIX+job.Id || !message.Retained {
+		t.Errorf("unexpected message: %+v", message)
+	}
+	if published.State != JOB_STATE_PENDING || len(published.Services) != 2 {
+		t.Errorf("unexpected job: %+v", published)
+	}
+
+	job.setRunning()
+	job.serviceRestarted("svc1", RunCommandResult{}, nil, SERVICE_STATE_ACTIVE)
+	_, published = publisher.last(t)
+	if published.State != JOB_STATE_RUNNING || published.Services[0].State != JOB_STATE_DONE {
+		t.Errorf("unexpected job: %+v", published)
+	}
+
+	res := RunCommandResult{exitCode: 1}
+	res.stderr.WriteString("Job for svc2.service failed")
+	job.serviceRestarted("svc2", res, errors.New("exit status 1"), "failed")
+
+	status, found := tracker.Get(job.Id)
+	if !found {
+		t.Fatalf("job %s not found", job.Id)
+	}
+	if status.State != JOB_STATE_FAILED || status.Finished == nil {
+		t.Errorf("unexpected job state: %+v", status)
+	}
+	expected := ServiceRestartResult{
+		Service:     "svc2",
+		State:       JOB_STATE_FAILED,
+		ExitCode:    1,
+		Stderr:      "Job for svc2.service failed",
+		ActiveState: "failed",
+	}
+	if *status.Services[1] != expected {
+		t.Errorf("unexpected service result: %+v", *status.Services[1])
+	}
+	if _, published = publisher.last(t); published.State != JOB_STATE_FAILED {
+		t.Errorf("final job state is not published: %+v", published)
+	}
+}
+
+func TestServiceRestartResultStates(t *testing.T) {
+	for _, tc := range []struct {
+		activeState string
+		err         error
+		state       string
+	}{
+		{SERVICE_STATE_ACTIVE, nil, JOB_STATE_DONE},
+		// slow starting service
+		{"activating", nil, JOB_STATE_DONE},
+		{"reloading", nil, JOB_STATE_DONE},
+		// oneshot unit without RemainAfterExit
+		{SERVICE_STATE_INACTIVE, nil, JOB_STATE_DONE},
+		{"", nil, JOB_STATE_DONE},
+		{"failed", nil, JOB_STATE_FAILED},
+		{SERVICE_STATE_INACTIVE, errors.New("exit status 1"), JOB_STATE_FAILED},
+	} {
+		res := newServiceRestartResult("svc", RunCommandResult{}, tc.err, tc.activeState)
+		if res.State != tc.state {
+			t.Errorf("state %q, error %v: expected %s, got %s", tc.activeState, tc.err, tc.state, res.State)
+		}
+	}
+}
+
+func TestJobTrackerRemovesOldJobs(t *testing.T) {
+	publisher := &fakePublisher{}
+	tracker := newJobTracker()
+	tracker.setMQTTClient(publisher)
+
+	first := tracker.start("/etc/test.conf", []string{"svc"})
+	for n := 0; n < MAX_JOBS; n++ {
+		tracker.start("/etc/test.conf", []string{"svc"})
+	}
+	if _, found := tracker.Get(first.Id); found {
+		t.Errorf("the oldest job must be removed")
+	}
+	cleared := false
+	for _, message := range publisher.messages {
+		if message.Topic == JOBS_TOPIC_PREFIX+first.Id && message.Payload == "" && message.Retained {
+			cleared = true
+		}
+	}
+	if !cleared {
+		t.Errorf("retained topic of the removed job is not cleared")
+	}
+}
+
+func TestJobTrackerRollback(t *testing.T) {
+	publisher := &fakePublisher{}
+	tracker := newJobTracker()
+	tracker.setMQTTClient(publisher)
+
+	job := tracker.start("/etc/test.conf", []string{"svc1"})
+	job.rollback = func() error { return nil }
+	if !job.serviceRestarted("svc1", RunCommandResult{exitCode: 0}, nil, "failed") {
+		t.Fatalf("failed job with rollback must be rolled back")
+	}
+	_, published := publisher.last(t)
+	if published.State != JOB_STATE_ROLLING_BACK || published.Finished != nil {
+		t.Errorf("unexpected job: %+v", published)
+	}
+
+	job.serviceRolledBack("svc1", RunCommandResult{}, nil, SERVICE_STATE_ACTIVE)
+	_, published = publisher.last(t)
+	if published.State != JOB_STATE_ROLLED_BACK || published.Finished == nil ||
+		len(published.Rollback) != 1 || published.Rollback[0].State != JOB_STATE_DONE {
+		t.Errorf("unexpected job: %+v", published)
+	}
+
+	job = tracker.start("/etc/test.conf", []string{"svc1"})
+	job.rollback = func() error { return nil }
+	job.serviceRestarted("svc1", RunCommandResult{}, nil, "failed")
+	job.rollbackFinished(errors.New("conflict"))
+	if res, _ := tracker.Get(job.Id); res.State != JOB_STATE_FAILED || res.RollbackError != "conflict" {
+		t.Errorf("unexpected job: %+v", res)
+	}
+
+	job = tracker.start("/etc/test.conf", []string{"svc1"})
+	job.rollback = func() error { return nil }
+	if !job.serviceRestarted("svc1", RunCommandResult{exitCode: 1}, errors.New("exit status 1"), SERVICE_STATE_ACTIVE) {
+		t.Errorf("job with failed service action must be rolled back")
+	}
+
+	// oneshot service
+	job = tracker.start("/etc/test.conf", []string{"svc1"})
+	job.rollback = func() error { return nil }
+	if job.serviceRestarted("svc1", RunCommandResult{}, nil, SERVICE_STATE_INACTIVE) {
+		t.Errorf("job with inactive service must not be rolled back")
+	}
+	if res, _ := tracker.Get(job.Id); res.State != JOB_STATE_DONE {
+		t.Errorf("unexpected job: %+v", res)
+	}
+
+	job = tracker.start("/etc/test.conf", []string{"svc1"})
+	job.rollback = func() error { return nil }
+	if job.serviceRestarted("svc1", RunCommandResult{}, nil, "deactivating") {
+		t.Errorf("job must be rolled back only if the service is failed")
+	}
+	if res, _ := tracker.Get(job.Id); res.State != JOB_STATE_DONE {
+		t.Errorf("unexpected job: %+v", res)
+	}
+
+	job = tracker.start("/etc/test.conf", []string{"svc1"})
+	job.rollback = func() error { return nil }
+	if !job.serviceRestarted("svc1", RunCommandResult{exitCode: 3}, nil, SERVICE_STATE_ACTIVE) {
+		t.Errorf("job with non-zero exit status must be rolled back")
+	}
+}
@@ -0,0 +1,244 @@
+package confed
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/tailscale/hujson"
+)
+
+const DEFAULT_JSON_INDENT = "    "
+
+var errJSONCMismatch = errors.New("patched config doesn't match the content")
+
+func parseJSONC(bs []byte) (hujson.Value, any, error) {
+	v, err := hujson.Parse(bs)
+	if err != nil {
+		return v, nil, err
+	}
+	standard := v.Clone()
+	standard.Standardize()
+	doc, err := decodeJSONValue(standard.Pack())
+	return v, doc, err
+}
+
+// patchJSONC applies the changes between the original JSON with comments
+// and the new content to the original text
+func patchJSONC(orig, content []byte) ([]byte, error) {
+	v, oldDoc, err := parseJSONC(orig)
+	if err != nil {
+		return nil, err
+	}
+	newDoc, err := decodeJSONValue(content)
+	if err != nil {
+		return nil, err
+	}
+	changes := diffJSON(oldDoc, newDoc)
+	if len(changes) == 0 {
+		return orig, nil
+	}
+	for _, change := range changes {
+		if change.Path == "" {
+			return nil, errors.New("the whole config is replaced")
+		}
+	}
+	patch, err := json.Marshal(changes)
+	if err != nil {
+		return nil, err
+	}
+	if err = v.Patch(patch); err != nil {
+		return nil, err
+	}
+
+	unit := jsonIndentUnit(&v)
+	for _, change := range changes {
+		if change.Op != JSON_CHANGE_REMOVE {
+			if err = formatPatchedValue(&v, change, unit); err != nil {
+				return nil, err
+			}
+		}
+	}
+	v.UpdateOffsets()
+	res := v.Pack()
+
+	// make sure that nothing is lost
+	if _, patchedDoc, err := parseJSONC(res); err != nil || !reflect.DeepEqual(patchedDoc, newDoc) {
+		return nil, errJSONCMismatch
+	}
+	return res, nil
+}
+
+// jsonIndentUnit finds out the indentation used for the top level values
+func jsonIndentUnit(v *hujson.Value) string {
+	if indent, multiline := childIndent(v.Value, -1, "", ""); multiline && indent != "" {
+		return indent
+	}
+	return DEFAULT_JSON_INDENT
+}
+
+// childBeforeExtra returns the whitespace and comments before the n-th child
+func childBeforeExtra(comp hujson.ValueTrimmed, n int) *hujson.Extra {
+	switch c := comp.(type) {
+	case *hujson.Object:
+		return &c.Members[n].Name.BeforeExtra
+	case *hujson.Array:
+		return &c.Elements[n].BeforeExtra
+	}
+	return nil
+}
+
+func childCount(comp hujson.ValueTrimmed) int {
+	switch c := comp.(type) {
+	case *hujson.Object:
+		return len(c.Members)
+	case *hujson.Array:
+		return len(c.Elements)
+	}
+	return 0
+}
+
+// childIndent returns the indentation of the children of the composite value
+// (skipping the child being formatted) and whether they are placed
+// on separate lines. If there are no other children, the indentation
+// is one unit deeper than the value itself.
+func childIndent(comp hujson.ValueTrimmed, skip int, indent, unit string) (string, bool) {
+	n := childCount(comp)
+	for i := 0; i < n; i++ {
+		if i == skip {
+			continue
+		}
+		extra := *childBeforeExtra(comp, i)
+		if pos := bytes.LastIndexByte(extra, '\n'); pos >= 0 {
+			line := string(extra[pos+1:])
+			return line[:len(line)-len(strings.TrimLeft(line, " \t"))], true
+		}
+	}
+	if n > 1 || (n == 1 && skip < 0) {
+		return "", false
+	}
+	return indent + unit, true
+}
+
+// siblingSpace returns the space used before the siblings
+// of the child placed on the same line
+func siblingSpace(comp hujson.ValueTrimmed, skip int) hujson.Extra {
+	for i := childCount(comp) - 1; i > 0; i-- {
+		if extra := *childBeforeExtra(comp, i); i != skip && extra.IsStandard() {
+			return append(hujson.Extra(nil), extra...)
+		}
+	}
+	return nil
+}
+
+// childIndex finds the child by JSON Pointer token
+func childIndex(comp hujson.ValueTrimmed, token string) (int, bool) {
+	switch c := comp.(type) {
+	case *hujson.Object:
+		name := strings.ReplaceAll(strings.ReplaceAll(token, "~1", "/"), "~0", "~")
+		// the added member is the last one
+		for i := len(c.Members) - 1; i >= 0; i-- {
+			if lit, ok := c.Members[i].Name.Value.(hujson.Literal); ok && lit.String() == name {
+				return i, true
+			}
+		}
+	case *hujson.Array:
+		i, err := strconv.Atoi(token)
+		return i, err == nil && i >= 0 && i < len(c.Elements)
+	}
+	return 0, false
+}
+
+// formatPatchedValue indents the value added or replaced by the patch
+// the same way as its siblings
+func formatPatchedValue(root *hujson.Value, change JSONChange, unit string) error {
+	tokens := strings.Split(change.Path, "/")[1:]
+	v, indent := root, ""
+	// the values inside a single line value are kept on one line
+	compact := false
+	for n, token := range tokens {
+		comp := v.Value
+		i, found := childIndex(comp, token)
+		if !found {
+			return errors.New("can't find patched value " + change.Path)
+		}
+		added := n == len(tokens)-1 && change.Op == JSON_CHANGE_ADD
+		skip := -1
+		if added {
+			skip = i
+		}
+		ci, multiline := childIndent(comp, skip, indent, unit)
+		compact = compact || !multiline
+		if added {
+			formatAddedChild(comp, i, indent, ci, compact)
+		}
+		v = childValue(comp, i)
+		indent = ci
+	}
+
+	if compact {
+		return nil
+	}
+	if _, isLiteral := v.Value.(hujson.Literal); isLiteral {
+		return nil
+	}
+	var bs bytes.Buffer
+	if err := json.Indent(&bs, hujson.Value{Value: v.Value}.Pack(), indent, unit); err != nil {
+		return err
+	}
+	formatted, err := hujson.Parse(bs.Bytes())
+	if err != nil {
+		return err
+	}
+	v.Value = formatted.Value
+	return nil
+}
+
+// formatAddedChild places the added child on its own line
+// or on the same line as its siblings
+func formatAddedChild(comp hujson.ValueTrimmed, i int, indent, childIndent string, compact bool) {
+	before := childBeforeExtra(comp, i)
+	if compact {
+		*before = siblingSpace(comp, i)
+	} else {
+		*before = append(bytes.TrimRight(*before, " \t\n"), "\n"+childIndent...)
+		closing := closingExtra(comp)
+		if len(bytes.TrimSpace(*closing)) == 0 && bytes.IndexByte(*closing, '\n') < 0 {
+			*closing = hujson.Extra("\n" + indent)
+		}
+	}
+	if obj, ok := comp.(*hujson.Object); ok {
+		obj.Members[i].Value.BeforeExtra = hujson.Extra(" ")
+	}
+	// keep the trailing comma after the last child
+	if n := childCount(comp); i == n-1 && i > 0 {
+		if prev := childValue(comp, i-1); prev.AfterExtra != nil && len(prev.AfterExtra) == 0 {
+			childValue(comp, i).AfterExtra = hujson.Extra{}
+		}
+	}
+}
+
+func childValue(comp hujson.ValueTrimmed, n int) *hujson.Value {
+	switch c := comp.(type) {
+	case *hujson.Object:
+		return &c.Members[n].Value
+	case *hujson.Array:
+		return &c.Elements[n]
+	}
+	return nil
+}
+
+// closingExtra returns the whitespace and comments
+// before the closing brace or bracket
+func closingExtra(comp hujson.ValueTrimmed) *hujson.Extra {
+	switch c := comp.(type) {
+	case *hujson.Object:
+		return &c.AfterExtra
+	case *hujson.Array:
+		return &c.AfterExtra
+	}
+	return nil
+}
@@ -0,0 +1,60 @@
+package confed
+
+import (
+	"testing"
+)
+
+func TestPatchJSONC(t *testing.T) {
+	for _, tc := range []struct {
+		name, orig, content, expected string
+	}{
+		{
+			"unchanged",
+			"// comment\n{ \"a\" : 1 }\n",
+			`{"a": 1}`,
+			"// comment\n{ \"a\" : 1 }\n",
+		},
+		{
+			"replace",
+			"// serial config\n{\n  \"debug\": false, // verbose\n  /* ports */\n  \"ports\": []\n}\n",
+			`{"debug": true, "ports": []}`,
+			"// serial config\n{\n  \"debug\": true, // verbose\n  /* ports */\n  \"ports\": []\n}\n",
+		},
+		{
+			"add",
+			"{\n\t\"a\": 1, // one\n\t\"b\": []\n}\n",
+			`{"a": 1, "b": [{"x": [1, 2]}], "c": {"d": true}}`,
+			"{\n\t\"a\": 1, // one\n\t\"b\": [\n\t\t{\n\t\t\t\"x\": [\n\t\t\t\t1,\n\t\t\t\t2\n\t\t\t]\n\t\t}\n\t],\n\t\"c\": {\n\t\t\"d\": true\n\t}\n}\n",
+		},
+		{
+			"remove",
+			"{\n  // first\n  \"a\": 1,\n  // second\n  \"b\": 2\n}\n",
+			`{"b": 2}`,
+			"{\n  // second\n  \"b\": 2\n}\n",
+		},
+		{
+			"compact",
+			"{\"a\": [1, 2], \"b\": 1}\n",
+			`{"a": [1, 2, 3], "b": 2}`,
+			"{\"a\": [1, 2, 3], \"b\": 2}\n",
+		},
+		{
+			"big numbers",
+			"{\n    \"a\": 1\n}\n",
+			`{"a": 12345678901234567890}`,
+			"{\n    \"a\": 12345678901234567890\n}\n",
+		},
+	} {
+		res, err := patchJSONC([]byte(tc.orig), []byte(tc.content))
+		if err != nil {
+			t.Errorf("%s: %s", tc.name, err)
+		} else if string(res) != tc.expected {
+			t.Errorf("%s: expected:\n%s\ngot:\n%s", tc.name, tc.expected, res)
+		}
+	}
+
+	// the whole config can't be patched
+	if _, err := patchJSONC([]byte("[1]"), []byte(`{"a": 1}`)); err == nil {
+		t.Errorf("replacing the whole config must fail")
+	}
+}
@@ -0,0 +1,116 @@
+package confed
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	JSON_CHANGE_ADD     = "add"
+	JSON_CHANGE_REMOVE  = "remove"
+	JSON_CHANGE_REPLACE = "replace"
+)
+
+// JSONChange is a single difference between two JSON documents.
+// It's similar to JSON Patch operation, so the list of changes
+// may be applied as JSON Patch.
+type JSONChange struct {
+	Op       string `json:"op"`
+	Path     string `json:"path"`
+	Value    any    `json:"value"`
+	OldValue any    `json:"oldValue"`
+}
+
+// MarshalJSON keeps null values of added and replaced values,
+// so the change may be applied as JSON Patch operation
+func (c JSONChange) MarshalJSON() ([]byte, error) {
+	m := map[string]any{"op": c.Op, "path": c.Path}
+	if c.Op != JSON_CHANGE_REMOVE {
+		m["value"] = c.Value
+	}
+	if c.Op != JSON_CHANGE_ADD {
+		m["oldValue"] = c.OldValue
+	}
+	return json.Marshal(m)
+}
+
+func escapeJSONPointerToken(token string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(token, "~", "~0"), "/", "~1")
+}
+
+// changedJSONPointers returns JSON Pointers of the values
+// which differ between two parsed JSON documents.
+// Only the topmost changed values are listed, e.g. if an object
+// is replaced by a string, its properties are not listed.
+func changedJSONPointers(old, new any) []string {
+	changes := diffJSON(old, new)
+	res := make([]string, len(changes))
+	for n, change := range changes {
+		res[n] = change.Path
+	}
+	return res
+}
+
+// diffJSON returns the topmost changed values of two parsed JSON documents
+func diffJSON(old, new any) []JSONChange {
+	res := make([]JSONChange, 0)
+	collectJSONChanges("", old, new, &res)
+	return res
+}
+
+func collectJSONChanges(ptr string, old, new any, res *[]JSONChange) {
+	switch o := old.(type) {
+	case map[string]any:
+		n, ok := new.(map[string]any)
+		if !ok {
+			break
+		}
+		keys := make([]string, 0, len(o)+len(n))
+		for k := range o {
+			keys = append(keys, k)
+		}
+		for k := range n {
+			if _, found := o[k]; !found {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			ov, oldFound := o[k]
+			nv, newFound := n[k]
+			child := ptr + "/" + escapeJSONPointerToken(k)
+			switch {
+			case !oldFound:
+				*res = append(*res, JSONChange{Op: JSON_CHANGE_ADD, Path: child, Value: nv})
+			case !newFound:
+				*res = append(*res, JSONChange{Op: JSON_CHANGE_REMOVE, Path: child, OldValue: ov})
+			default:
+				collectJSONChanges(child, ov, nv, res)
+			}
+		}
+		return
+	case []any:
+		n, ok := new.([]any)
+		if !ok {
+			break
+		}
+		for i := 0; i < len(o) && i < len(n); i++ {
+			collectJSONChanges(ptr+"/"+strconv.Itoa(i), o[i], n[i], res)
+		}
+		for i := len(o); i < len(n); i++ {
+			*res = append(*res, JSONChange{Op: JSON_CHANGE_ADD, Path: ptr + "/" + strconv.Itoa(i), Value: n[i]})
+		}
+		// the items are removed from the end,
+		// so the indices are valid when the changes are applied in order
+		for i := len(o) - 1; i >= len(n); i-- {
+			*res = append(*res, JSONChange{Op: JSON_CHANGE_REMOVE, Path: ptr + "/" + strconv.Itoa(i), OldValue: o[i]})
+		}
+		return
+	}
+	if !reflect.DeepEqual(old, new) {
+		*res = append(*res, JSONChange{Op: JSON_CHANGE_REPLACE, Path: ptr, Value: new, OldValue: old})
+	}
+}
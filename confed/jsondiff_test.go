@@ -0,0 +1,73 @@
+package confed
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestChangedJSONPointers(t *testing.T) {
+	for _, tc := range []struct {
+		old, new string
+		expected []string
+	}{
+		{`{"a": 1}`, `{"a": 1}`, []string{}},
+		{`{"a": 1, "b": {"c": [1, 2]}}`, `{"a": 2, "b": {"c": [1, 3, 4]}}`, []string{"/a", "/b/c/1", "/b/c/2"}},
+		{`{"a": 1}`, `{"b": 1}`, []string{"/a", "/b"}},
+		{`{"a/b": {"x": 1}}`, `{"a/b": "x"}`, []string{"/a~1b"}},
+		{`[1]`, `{"a": 1}`, []string{""}},
+	} {
+		var old, new any
+		if err := json.Unmarshal([]byte(tc.old), &old); err != nil {
+			t.Fatal(err)
+		}
+		if err := json.Unmarshal([]byte(tc.new), &new); err != nil {
+			t.Fatal(err)
+		}
+		if res := changedJSONPointers(old, new); !reflect.DeepEqual(tc.expected, res) {
+			t.Errorf("%s -> %s: expected %v, got %v", tc.old, tc.new, tc.expected, res)
+		}
+	}
+}
+
+func TestDiffJSON(t *testing.T) {
+	old := `{"a": 1, "b": {"c": [1, 2, 3]}, "d": null, "e": true, "h": 1}`
+	new := `{"a": 2, "b": {"c": [1]}, "d": "x", "f": {"g": 1}, "h": null}`
+	var oldDoc, newDoc any
+	if err := json.Unmarshal([]byte(old), &oldDoc); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal([]byte(new), &newDoc); err != nil {
+		t.Fatal(err)
+	}
+	changes := diffJSON(oldDoc, newDoc)
+	expected := []JSONChange{
+		{Op: JSON_CHANGE_REPLACE, Path: "/a", Value: float64(2), OldValue: float64(1)},
+		{Op: JSON_CHANGE_REMOVE, Path: "/b/c/2", OldValue: float64(3)},
+		{Op: JSON_CHANGE_REMOVE, Path: "/b/c/1", OldValue: float64(2)},
+		{Op: JSON_CHANGE_REPLACE, Path: "/d", Value: "x"},
+		{Op: JSON_CHANGE_REMOVE, Path: "/e", OldValue: true},
+		{Op: JSON_CHANGE_ADD, Path: "/f", Value: map[string]any{"g": float64(1)}},
+		{Op: JSON_CHANGE_REPLACE, Path: "/h", OldValue: float64(1)},
+	}
+	if !reflect.DeepEqual(expected, changes) {
+		t.Fatalf("unexpected changes: %#v", changes)
+	}
+
+	// the changes may be applied as JSON Patch
+	patch, err := json.Marshal(changes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	patched, err := applyPatch([]byte(old), patch, PATCH_TYPE_JSON_PATCH)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var patchedDoc any
+	if err := json.Unmarshal(patched, &patchedDoc); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(newDoc, patchedDoc) {
+		t.Errorf("patched document %s doesn't match %s", patched, new)
+	}
+}
@@ -0,0 +1,379 @@
+package confed
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/wirenboard/wbgong"
+)
+
+// /etc/network/interfaces is represented as
+//
+//	{
+//	    "interfaces": [
+//	        {
+//	            "name": "eth0",
+//	            "auto": true,
+//	            "mode": "inet",
+//	            "method": "static",
+//	            "options": {"address": "192.168.1.2", "netmask": "255.255.255.0"}
+//	        }
+//	    ]
+//	}
+//
+// It's the same format as the one of networkparser script. The file is parsed
+// by the grammar of the script: only the listed stanzas, methods and option keys
+// are supported, auto and allow-hotplug stanzas take a single interface.
+// Like the script, the converter stops at the first unsupported line
+// (e.g. source or wireless-* option), the rest of the file is dropped.
+
+const (
+	WB_SERIAL_FILE = "/var/lib/wirenboard/serial.conf"
+	// the interface which is never written to the config
+	RESERVED_NETWORK_IFACE = "eth0:42"
+	// the interface getting the controller's serial as its hwaddress
+	PRIMARY_NETWORK_IFACE = "eth0"
+)
+
+var (
+	networkStanzaRe    = regexp.MustCompile(`^(?:auto|iface|mapping|allow-hotplug)`)
+	networkIfaceNameRe = regexp.MustCompile(`^[A-Za-z0-9:]+`)
+	networkModeRe      = regexp.MustCompile(`^(?:inet|can)`)
+	networkMethodRe    = regexp.MustCompile(`^(?:loopback|manual|dhcp|static|ppp|bootp|tunnel|wvdial|ipv4ll)`)
+	// the unicode letters and digits match \w of the script's regexps
+	networkOptionKeyRe = regexp.MustCompile(`^(?:bridge_[\p{L}\p{N}_]*|post-[\p{L}\p{N}_]*|up|down|pre-[\p{L}\p{N}_]*|address` +
+		`|network|netmask|gateway|broadcast|dns-[\p{L}\p{N}_]*|scope|` +
+		`pointtopoint|metric|hwaddress|mtu|hostname|` +
+		`leasehours|leasetime|vendor|client|bootfile|server` +
+		`|mode|endpoint|dstaddr|local|ttl|provider|unit` +
+		`|options|frame|bitrate|netnum|media|wpa-[\p{L}\p{N}_-]*)`)
+
+	errNoInterfaces      = errors.New("no interfaces key")
+	errEmptyNetworkConf  = errors.New("empty network config")
+	errBadInterfacesList = errors.New("bad interfaces value")
+)
+
+type networkConverter struct {
+	// the file containing the controller's serial
+	serialFile string
+}
+
+// serial returns the first line of the serial file,
+// found is false if the file can't be read
+func (c *networkConverter) serial() (serial string, found bool) {
+	bs, err := os.ReadFile(c.serialFile)
+	if err != nil {
+		return "", false
+	}
+	line := string(bs)
+	if n := strings.IndexAny(line, "\r\n"); n >= 0 {
+		line = line[:n]
+	}
+	return strings.TrimSpace(line), true
+}
+
+// networkScanner parses the file the same way as pyparsing grammar
+// of the script: each token skips whitespace and comments before it,
+// the whitespace tokens skip only the comments with whitespace before them
+type networkScanner struct {
+	s   string
+	pos int
+}
+
+func isNetworkWhitespace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\r' || c == '\n'
+}
+
+func (sc *networkScanner) skipWhitespace(pos int) int {
+	for pos < len(sc.s) && isNetworkWhitespace(sc.s[pos]) {
+		pos++
+	}
+	return pos
+}
+
+func (sc *networkScanner) skipComments(pos int) int {
+	for {
+		p := sc.skipWhitespace(pos)
+		if p == len(sc.s) || sc.s[p] != '#' {
+			return pos
+		}
+		if n := strings.IndexByte(sc.s[p:], '\n'); n >= 0 {
+			pos = p + n
+		} else {
+			pos = len(sc.s)
+		}
+	}
+}
+
+// white consumes the whitespace, there must be some
+func (sc *networkScanner) white() bool {
+	pos := sc.skipComments(sc.pos)
+	end := pos
+	for end < len(sc.s) && isNetworkWhitespace(sc.s[end]) {
+		end++
+	}
+	if end == pos {
+		return false
+	}
+	sc.pos = end
+	return true
+}
+
+func (sc *networkScanner) token(re *regexp.Regexp) (string, bool) {
+	pos := sc.skipWhitespace(sc.skipComments(sc.pos))
+	loc := re.FindStringIndex(sc.s[pos:])
+	if loc == nil {
+		return "", false
+	}
+	sc.pos = pos + loc[1]
+	return sc.s[pos:sc.pos], true
+}
+
+// restOfLine returns the text up to the end of the line
+// starting from the next token, inline comments are kept
+func (sc *networkScanner) restOfLine() (string, bool) {
+	pos := sc.skipWhitespace(sc.skipComments(sc.pos))
+	n := strings.IndexByte(sc.s[pos:], '\n')
+	if n < 0 {
+		return "", false
+	}
+	sc.pos = pos + n
+	return sc.s[pos:sc.pos], true
+}
+
+func (sc *networkScanner) option() (key, value string, ok bool) {
+	if !sc.white() {
+		return
+	}
+	if key, ok = sc.token(networkOptionKeyRe); !ok {
+		return
+	}
+	if !sc.white() {
+		return "", "", false
+	}
+	value, ok = sc.restOfLine()
+	return
+}
+
+type networkBlock struct {
+	stanza, name  string
+	mode, method  string
+	options       map[string]any
+	hasDefinition bool
+}
+
+// definition parses the optional "<mode> <method>" part of the stanza with the options
+func (sc *networkScanner) definition(block *networkBlock) bool {
+	if !sc.white() {
+		return false
+	}
+	var ok bool
+	if block.mode, ok = sc.token(networkModeRe); !ok {
+		return false
+	}
+	if block.method, ok = sc.token(networkMethodRe); !ok {
+		return false
+	}
+	block.options = make(map[string]any)
+	for {
+		start := sc.pos
+		key, value, ok := sc.option()
+		if !ok {
+			sc.pos = start
+			return true
+		}
+		block.options[key] = value
+	}
+}
+
+func (sc *networkScanner) block() (block networkBlock, ok bool) {
+	if block.stanza, ok = sc.token(networkStanzaRe); !ok {
+		return
+	}
+	if !sc.white() {
+		return block, false
+	}
+	if block.name, ok = sc.token(networkIfaceNameRe); !ok {
+		return
+	}
+	start := sc.pos
+	if block.hasDefinition = sc.definition(&block); !block.hasDefinition {
+		sc.pos = start
+	}
+	return block, true
+}
+
+func (sc *networkScanner) line() int {
+	return strings.Count(sc.s[:sc.pos], "\n") + 1
+}
+
+// expandTabs replaces tabs with spaces like python's str.expandtabs
+func expandTabs(s string) string {
+	if !strings.Contains(s, "\t") {
+		return s
+	}
+	var b strings.Builder
+	column := 0
+	for _, r := range s {
+		switch r {
+		case '\t':
+			n := 8 - column%8
+			b.WriteString(strings.Repeat(" ", n))
+			column += n
+		case '\n', '\r':
+			b.WriteRune(r)
+			column = 0
+		default:
+			b.WriteRune(r)
+			column++
+		}
+	}
+	return b.String()
+}
+
+func (c *networkConverter) ToJSON(raw []byte) ([]byte, error) {
+	if len(raw) == 0 {
+		return nil, errEmptyNetworkConf
+	}
+	text := expandTabs(string(raw))
+	if !strings.HasSuffix(text, "\n") {
+		text += "\n"
+	}
+
+	ifaces := []map[string]any{}
+	byName := make(map[string]map[string]any)
+	sc := &networkScanner{s: text}
+	for {
+		start := sc.pos
+		block, ok := sc.block()
+		if !ok {
+			sc.pos = start
+			break
+		}
+		iface, found := byName[block.name]
+		if !found {
+			iface = map[string]any{"name": block.name, "auto": false}
+			byName[block.name] = iface
+			ifaces = append(ifaces, iface)
+		}
+		switch block.stanza {
+		case "auto":
+			iface["auto"] = true
+		case "allow-hotplug":
+			iface["allow-hotplug"] = true
+		case "iface":
+			if !block.hasDefinition {
+				return nil, fmt.Errorf("no mode and method of interface %s", block.name)
+			}
+			iface["mode"], iface["method"] = block.mode, block.method
+		}
+		if block.hasDefinition {
+			iface["options"] = block.options
+		}
+	}
+	if len(ifaces) == 0 {
+		return nil, errEmptyNetworkConf
+	}
+	if sc.pos = sc.skipWhitespace(sc.skipComments(sc.pos)); sc.pos < len(sc.s) {
+		wbgong.Warn.Printf("network config line %d isn't supported, the rest of the file is ignored", sc.line())
+	}
+
+	if serial, found := c.serial(); found {
+		if iface, found := byName[PRIMARY_NETWORK_IFACE]; found {
+			options, _ := iface["options"].(map[string]any)
+			if options == nil {
+				options = make(map[string]any)
+				iface["options"] = options
+			}
+			options["hwaddress"] = serial
+		}
+	}
+	return json.Marshal(map[string]any{"interfaces": ifaces})
+}
+
+func formatNetworkIface(v any) (string, error) {
+	iface, ok := v.(map[string]any)
+	if !ok {
+		return "", errors.New("bad interface definition")
+	}
+	nameValue, found := iface["name"]
+	if !found {
+		return "", errors.New("interface without name")
+	}
+	if nameValue == RESERVED_NETWORK_IFACE {
+		return "", nil
+	}
+	name, ok := nameValue.(string)
+	if !ok {
+		return "", errors.New("bad interface name")
+	}
+
+	var b strings.Builder
+	if pyTruth(iface["auto"]) {
+		b.WriteString("auto " + name + "\n")
+	}
+	if pyTruth(iface["allow-hotplug"]) {
+		b.WriteString("allow-hotplug " + name + "\n")
+	}
+	mode, method := "inet", "manual"
+	var err error
+	if v, found := iface["mode"]; found {
+		if mode, err = pyStr(v); err != nil {
+			return "", fmt.Errorf("interface %s mode: %s", name, err)
+		}
+	}
+	if v, found := iface["method"]; found {
+		if method, err = pyStr(v); err != nil {
+			return "", fmt.Errorf("interface %s method: %s", name, err)
+		}
+	}
+	b.WriteString(fmt.Sprintf("iface %s %s %s\n", name, mode, method))
+
+	options := map[string]any{}
+	if v, found := iface["options"]; found {
+		if options, ok = v.(map[string]any); !ok {
+			return "", errors.New("bad interface options")
+		}
+	}
+	for _, key := range sortedKeys(options) {
+		if options[key] == nil || options[key] == "" {
+			continue
+		}
+		value, err := pyStr(options[key])
+		if err != nil {
+			return "", fmt.Errorf("interface %s option %s: %s", name, key, err)
+		}
+		b.WriteString("  " + key + " " + value + "\n")
+	}
+	b.WriteString("\n")
+	return b.String(), nil
+}
+
+func (c *networkConverter) FromJSON(content, orig []byte) ([]byte, error) {
+	v, err := decodeJSONValue(content)
+	if err != nil {
+		return nil, err
+	}
+	config, _ := v.(map[string]any)
+	ifacesValue, found := config["interfaces"]
+	if !found {
+		return nil, errNoInterfaces
+	}
+	ifaces, ok := ifacesValue.([]any)
+	if !ok {
+		return nil, errBadInterfacesList
+	}
+	var b strings.Builder
+	for _, iface := range ifaces {
+		s, err := formatNetworkIface(iface)
+		if err != nil {
+			return nil, err
+		}
+		b.WriteString(s)
+	}
+	return []byte(b.String()), nil
+}
@@ -0,0 +1,197 @@
+package confed
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// ntp.conf is represented as
+//
+//	{
+//	    "data": [{"type": "server", "address": "0.pool.ntp.org", "iburst": true}],
+//	    "etc": ["# other lines", "### !!!SERVER LIST GOES HERE ###"]
+//	}
+//
+// "etc" keeps the lines which don't describe the servers,
+// the marker line shows where the servers are written.
+// It's the same format as the one of ntpparser script,
+// but numeric keys are written instead of failing on them.
+
+const NTP_SERVERS_MARKER = "### !!!SERVER LIST GOES HERE ###"
+
+var (
+	ntpServerEntries = []string{"pool", "server", "peer", "broadcast", "manycastclient"}
+	// in the order of writing
+	ntpFlags   = []string{"burst", "iburst", "prefer"}
+	ntpOptions = []string{"version", "minpoll", "maxpoll", "ttl"}
+
+	// python's int() syntax
+	ntpIntRe = regexp.MustCompile(`^[+-]?[0-9]+(?:_[0-9]+)*$`)
+
+	errNTPNoEtc = errors.New("no etc list in NTP config")
+)
+
+type ntpConverter struct{}
+
+func isNTPServerEntry(word string) bool {
+	for _, entry := range ntpServerEntries {
+		if word == entry {
+			return true
+		}
+	}
+	return false
+}
+
+// isPySpace reports whether python's str.split() and str.strip() treat r as whitespace
+func isPySpace(r rune) bool {
+	return unicode.IsSpace(r) || (r >= 0x1c && r <= 0x1f)
+}
+
+// parseNTPInt parses the integer the way python's int() does
+func parseNTPInt(s string) (json.Number, bool) {
+	if !ntpIntRe.MatchString(s) {
+		return "", false
+	}
+	negative := s[0] == '-'
+	s = strings.TrimLeft(strings.ReplaceAll(strings.TrimLeft(s, "+-"), "_", ""), "0")
+	if s == "" {
+		return "0", true
+	}
+	if negative {
+		s = "-" + s
+	}
+	return json.Number(s), true
+}
+
+func parseNTPServer(words []string) (map[string]any, error) {
+	if len(words) < 2 {
+		return nil, fmt.Errorf("no address of %s", words[0])
+	}
+	res := map[string]any{"type": words[0], "address": words[1]}
+	for i := 2; i < len(words); i++ {
+		switch w := words[i]; w {
+		case "autokey", "burst", "iburst", "prefer":
+			res[w] = true
+		case "key", "version", "minpoll", "maxpoll", "ttl":
+			if i+1 == len(words) {
+				return nil, fmt.Errorf("no value of %s for %s", w, words[1])
+			}
+			i++
+			n, ok := parseNTPInt(words[i])
+			if !ok {
+				return nil, fmt.Errorf("bad value of %s for %s: %s", w, words[1], words[i])
+			}
+			res[w] = n
+		}
+	}
+	return res, nil
+}
+
+func (ntpConverter) ToJSON(raw []byte) ([]byte, error) {
+	data := []any{}
+	etc := []string{}
+	marked := false
+	text := string(raw)
+	if text != "" {
+		for _, line := range strings.Split(strings.TrimSuffix(text, "\n"), "\n") {
+			words := strings.FieldsFunc(line, isPySpace)
+			if len(words) == 0 || !isNTPServerEntry(words[0]) {
+				etc = append(etc, strings.TrimFunc(line, isPySpace))
+				continue
+			}
+			if !marked {
+				marked = true
+				etc = append(etc, NTP_SERVERS_MARKER)
+			}
+			server, err := parseNTPServer(words)
+			if err != nil {
+				return nil, err
+			}
+			data = append(data, server)
+		}
+	}
+	return json.Marshal(map[string]any{"data": data, "etc": etc})
+}
+
+func formatNTPServer(v any) (string, error) {
+	server, ok := v.(map[string]any)
+	if !ok {
+		return "", fmt.Errorf("bad NTP server %v", v)
+	}
+	serverType, typeOk := server["type"].(string)
+	address, addressOk := server["address"].(string)
+	if !typeOk || !addressOk {
+		return "", fmt.Errorf("no type or address of NTP server %v", v)
+	}
+	words := []string{serverType, address}
+	if _, found := server["autokey"]; found {
+		words = append(words, "autokey")
+	} else if key, found := server["key"]; found {
+		s, err := pyStr(key)
+		if err != nil {
+			return "", fmt.Errorf("bad key of NTP server %s: %s", address, err)
+		}
+		words = append(words, "key", s)
+	}
+	for _, flag := range ntpFlags {
+		if _, found := server[flag]; found {
+			words = append(words, flag)
+		}
+	}
+	for _, option := range ntpOptions {
+		if value, found := server[option]; found {
+			s, err := pyStr(value)
+			if err != nil {
+				return "", fmt.Errorf("bad %s of NTP server %s: %s", option, address, err)
+			}
+			words = append(words, option, s)
+		}
+	}
+	return strings.Join(words, " "), nil
+}
+
+func (ntpConverter) FromJSON(content, orig []byte) ([]byte, error) {
+	v, err := decodeJSONValue(content)
+	if err != nil {
+		return nil, err
+	}
+	config, _ := v.(map[string]any)
+	etc, ok := config["etc"].([]any)
+	if !ok {
+		return nil, errNTPNoEtc
+	}
+	dataValue, hasData := config["data"]
+
+	var b strings.Builder
+	written := false
+	for _, item := range etc {
+		if item != NTP_SERVERS_MARKER {
+			line, err := pyStr(item)
+			if err != nil {
+				return nil, fmt.Errorf("bad NTP config line: %s", err)
+			}
+			b.WriteString(line + "\n")
+			continue
+		}
+		if written || !hasData {
+			continue
+		}
+		written = true
+		data, ok := dataValue.([]any)
+		if !ok {
+			return nil, fmt.Errorf("bad NTP servers list %v", dataValue)
+		}
+		for _, server := range data {
+			line, err := formatNTPServer(server)
+			if err != nil {
+				return nil, err
+			}
+			b.WriteString(line + "\n")
+		}
+	}
+	return []byte(b.String()), nil
+}
@@ -0,0 +1,105 @@
+package confed
+
+import (
+	"encoding/json"
+	"errors"
+
+	jsonpatch "github.com/evanphx/json-patch/v5"
+	"github.com/wirenboard/wbgong"
+)
+
+const (
+	PATCH_TYPE_JSON_PATCH  = "json-patch"
+	PATCH_TYPE_MERGE_PATCH = "merge-patch"
+)
+
+type EditorPatchArgs struct {
+	Path  string           `json:"path"`
+	Patch *json.RawMessage `json:"patch"`
+	// json-patch (RFC 6902) or merge-patch (RFC 7396).
+	// If not set, an array is treated as JSON Patch
+	// and an object as JSON Merge Patch
+	Type             string `json:"type,omitempty"`
+	ClientId         string `json:"clientId,omitempty"`
+	ExpectedRevision string `json:"expectedRevision,omitempty"`
+	ConfirmTimeoutMS int    `json:"confirmTimeoutMS,omitempty"`
+	ErrorsInReply    bool   `json:"errorsInReply,omitempty"`
+}
+
+func patchType(patch []byte, requested string) (string, error) {
+	switch requested {
+	case PATCH_TYPE_JSON_PATCH, PATCH_TYPE_MERGE_PATCH:
+		return requested, nil
+	case "":
+	default:
+		return "", errors.New("unknown patch type " + requested)
+	}
+	var v any
+	if err := json.Unmarshal(patch, &v); err != nil {
+		return "", err
+	}
+	switch v.(type) {
+	case []any:
+		return PATCH_TYPE_JSON_PATCH, nil
+	case map[string]any:
+		return PATCH_TYPE_MERGE_PATCH, nil
+	default:
+		return "", errors.New("patch must be an array or an object")
+	}
+}
+
+func applyPatch(doc, patch []byte, requestedType string) ([]byte, error) {
+	t, err := patchType(patch, requestedType)
+	if err != nil {
+		return nil, err
+	}
+	if t == PATCH_TYPE_MERGE_PATCH {
+		return jsonpatch.MergePatch(doc, patch)
+	}
+	decoded, err := jsonpatch.DecodePatch(patch)
+	if err != nil {
+		return nil, err
+	}
+	return decoded.Apply(doc)
+}
+
+// Patch applies JSON Patch or JSON Merge Patch to the current config
+// and saves the result the same way as Save does
+func (editor *Editor) Patch(args *EditorPatchArgs, reply *EditorPathResponse) error {
+	editor.mtx.Lock()
+	defer editor.mtx.Unlock()
+
+	schema, err := editor.locateSchema(args.Path)
+	if err != nil {
+		return err
+	}
+	if args.Patch == nil {
+		return newInvalidPatchError(errors.New("no patch"))
+	}
+	if err = checkRevision(schema, args.ExpectedRevision); err != nil {
+		return err
+	}
+
+	current, err := loadCurrentConfig(schema)
+	if err != nil {
+		return err
+	}
+
+	patched, err := applyPatch(current.content, *args.Patch, args.Type)
+	if err != nil {
+		wbgong.Error.Printf("Failed to patch config file %s: %s", schema.PhysicalConfigPath(), err)
+		return newInvalidPatchError(err)
+	}
+
+	content := json.RawMessage(patched)
+	return editor.save(schema, &EditorSaveArgs{
+		Path:    args.Path,
+		Content: &content,
+		// the patch is applied to this revision,
+		// so nobody may change the config in between
+		ExpectedRevision: current.revision,
+		ClientId:         args.ClientId,
+		ConfirmTimeoutMS: args.ConfirmTimeoutMS,
+		ErrorsInReply:    args.ErrorsInReply,
+	}, current.content, reply)
+}
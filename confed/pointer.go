@@ -0,0 +1,167 @@
+package confed
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+
+	"github.com/wirenboard/wbgong"
+	"github.com/xeipuuv/gojsonpointer"
+)
+
+type EditorGetArgs struct {
+	Path string `json:"path"`
+	// JSON Pointer of the value, empty string means the whole config
+	Pointer string `json:"pointer"`
+}
+
+type EditorGetResponse struct {
+	ConfigPath string           `json:"configPath"`
+	Pointer    string           `json:"pointer"`
+	Value      *json.RawMessage `json:"value"`
+	Revision   string           `json:"revision"`
+}
+
+type EditorSetArgs struct {
+	Path    string           `json:"path"`
+	Pointer string           `json:"pointer"`
+	Value   *json.RawMessage `json:"value"`
+	// the same as for Save
+	ClientId         string `json:"clientId,omitempty"`
+	ExpectedRevision string `json:"expectedRevision,omitempty"`
+	ConfirmTimeoutMS int    `json:"confirmTimeoutMS,omitempty"`
+	ErrorsInReply    bool   `json:"errorsInReply,omitempty"`
+}
+
+// loadCurrentConfig reads the config converted to JSON
+// without validating it
+func loadCurrentConfig(schema *JSONSchema) (LoadConfigResult, error) {
+	current, err := loadSchemaConfig(schema)
+	if os.IsNotExist(err) {
+		return current, fileNotFoundError
+	}
+	if err != nil {
+		wbgong.Error.Printf("Failed to read config file %s: %s", schema.PhysicalConfigPath(), err)
+		return current, conversionError(err, invalidConfigError)
+	}
+	printPreprocessorErrors(schema.PhysicalConfigPath(), current.preprocessorErrors)
+	return current, nil
+}
+
+// decodeJSONValue keeps numbers as json.Number,
+// so they are written back exactly as they were
+func decodeJSONValue(bs []byte) (v any, err error) {
+	d := json.NewDecoder(bytes.NewReader(bs))
+	d.UseNumber()
+	err = d.Decode(&v)
+	return
+}
+
+func parseJSONPointer(ptrString string) (gojsonpointer.JsonPointer, error) {
+	ptr, err := gojsonpointer.NewJsonPointer(ptrString)
+	if err != nil {
+		return ptr, newInvalidPointerError(err)
+	}
+	return ptr, nil
+}
+
+// Get returns the value of the config by JSON Pointer.
+// Unlike Load, the config is not validated against the schema.
+func (editor *Editor) Get(args *EditorGetArgs, reply *EditorGetResponse) error {
+	editor.mtx.Lock()
+	defer editor.mtx.Unlock()
+
+	schema, err := editor.locateSchema(args.Path)
+	if err != nil {
+		return err
+	}
+	ptr, err := parseJSONPointer(args.Pointer)
+	if err != nil {
+		return err
+	}
+	current, err := loadCurrentConfig(schema)
+	if err != nil {
+		return err
+	}
+	doc, err := decodeJSONValue(current.content)
+	if err != nil {
+		wbgong.Error.Printf("Failed to parse config file %s: %s", schema.PhysicalConfigPath(), err)
+		return invalidConfigError
+	}
+	value, _, err := ptr.Get(doc)
+	if err != nil {
+		return newInvalidPointerError(err)
+	}
+	bs, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+
+	raw := json.RawMessage(bs)
+	reply.ConfigPath = schema.ConfigPath()
+	reply.Pointer = args.Pointer
+	reply.Value = &raw
+	reply.Revision = current.revision
+	return nil
+}
+
+// Set replaces the value of the config by JSON Pointer
+// and saves the result the same way as Save does.
+// A missing object member is added, array items can only be replaced.
+func (editor *Editor) Set(args *EditorSetArgs, reply *EditorPathResponse) error {
+	editor.mtx.Lock()
+	defer editor.mtx.Unlock()
+
+	schema, err := editor.locateSchema(args.Path)
+	if err != nil {
+		return err
+	}
+	if args.Value == nil {
+		return invalidConfigError
+	}
+	ptr, err := parseJSONPointer(args.Pointer)
+	if err != nil {
+		return err
+	}
+	value, err := decodeJSONValue(*args.Value)
+	if err != nil {
+		return invalidConfigError
+	}
+	if err = checkRevision(schema, args.ExpectedRevision); err != nil {
+		return err
+	}
+
+	var revision string
+	var currentJSON []byte
+	doc := value
+	if args.Pointer != "" {
+		current, err := loadCurrentConfig(schema)
+		if err != nil {
+			return err
+		}
+		revision, currentJSON = current.revision, current.content
+		if doc, err = decodeJSONValue(current.content); err != nil {
+			wbgong.Error.Printf("Failed to parse config file %s: %s", schema.PhysicalConfigPath(), err)
+			return invalidConfigError
+		}
+		if _, err = ptr.Set(doc, value); err != nil {
+			return newInvalidPointerError(err)
+		}
+	}
+
+	bs, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	content := json.RawMessage(bs)
+	return editor.save(schema, &EditorSaveArgs{
+		Path:    args.Path,
+		Content: &content,
+		// the value is set in this revision,
+		// so nobody may change the config in between
+		ExpectedRevision: revision,
+		ClientId:         args.ClientId,
+		ConfirmTimeoutMS: args.ConfirmTimeoutMS,
+		ErrorsInReply:    args.ErrorsInReply,
+	}, currentJSON, reply)
+}
@@ -1,46 +1,253 @@
 package confed
 
 import (
-	"time"
-
 	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/wirenboard/wbgong"
 )
 
 const (
-	SERVICE_CMD = "systemctl"
+	SERVICE_CMD                    = "systemctl"
+	SERVICE_STATE_ACTIVE           = "active"
+	SERVICE_STATE_INACTIVE         = "inactive"
+	SERVICE_STATE_FAILED           = "failed"
+	SERVICE_STATE_POLL_INTERVAL_MS = 500
+	// how long the service in a transient state is watched
+	// after the check period, it's the default start timeout of systemd
+	SERVICE_STATE_SETTLE_TIMEOUT = 90 * time.Second
 )
 
-func restartService(name string) (err error) {
-	_, err = runCommand(false, nil, SERVICE_CMD, "reload-or-restart", name)
-	return
-}
-
-func RunRequestHandler(ch chan Request) {
-	go func() {
-		for {
-			req := <-ch
-			switch req.requestType {
-			case Sleep:
-				delay, _ := strconv.Atoi(req.properties["delay"])
-				wbgong.Debug.Printf("Delay %d ms before restarting services", delay)
-				time.Sleep(time.Duration(delay) * time.Millisecond)
-			case Sync:
-				path := req.properties["path"]
-				wbgong.Debug.Printf("File sync %s", path)
-				if _, err := runCommand(false, nil, "sync", path); err != nil {
-					wbgong.Error.Printf("Error sync file %s: %s", path, err)
-				}
-			case Restart:
-				service := req.properties["service"]
-				wbgong.Debug.Printf("Restarting service %s", service)
-				if err := restartService(service); err != nil {
-					wbgong.Error.Printf("Error restarting %s: %s", service, err)
-				}
-			default:
-				wbgong.Error.Printf("Unknown request type %d", req.requestType)
+// transient states of the service, it's watched until it leaves them
+var serviceTransientStates = map[string]bool{
+	"activating":   true,
+	"deactivating": true,
+	"reloading":    true,
+	"refreshing":   true,
+	"maintenance":  true,
+}
+
+// serviceStateFailed returns true if the service is in the failed state
+// after the action. Inactive services aren't failed:
+// oneshot units without RemainAfterExit become inactive when they finish.
+// Empty state means the state can't be determined.
+func serviceStateFailed(state string) bool {
+	return state == SERVICE_STATE_FAILED
+}
+
+// watchServiceState checks the active service during the specified period
+// and returns the first state it leaves the active state for or the last seen one.
+// The transient states are watched until they settle, but no longer than
+// SERVICE_STATE_SETTLE_TIMEOUT after the period.
+func watchServiceState(manager ServiceManager, name string, period time.Duration) string {
+	start := time.Now()
+	for {
+		state := manager.ActiveState(name)
+		elapsed := time.Since(start)
+		if serviceTransientStates[state] {
+			if elapsed >= period+SERVICE_STATE_SETTLE_TIMEOUT {
+				return state
 			}
+		} else if state != SERVICE_STATE_ACTIVE || elapsed >= period {
+			return state
 		}
-	}()
+		time.Sleep(SERVICE_STATE_POLL_INTERVAL_MS * time.Millisecond)
+	}
+}
+
+// restartWaiter is a job waiting for the service to be restarted
+type restartWaiter struct {
+	job *RestartJob
+	// the restart is done after the job's config is rolled back
+	rollback bool
+}
+
+// serviceRestart is the state of restarting of a single service.
+// All the requests received before the restart is started
+// are merged into one restart.
+type serviceRestart struct {
+	name string
+	// the standard action, it's passed to the custom command if it's set
+	action  string
+	command []string
+	waiters []restartWaiter
+	delay   time.Duration
+	timer   *time.Timer
+	// incremented on every rescheduling, so the stale timers are ignored
+	gen     int
+	running bool
+}
+
+// restarter restarts the services requested via the restart queue.
+// Restarts of a service are debounced: the delay is counted
+// from the last request. Different services are restarted in parallel.
+type restarter struct {
+	manager  ServiceManager
+	mtx      sync.Mutex
+	services map[string]*serviceRestart
+	// the delay requested by the last Sleep request
+	// applies to the following Restart requests of the same job
+	delay    time.Duration
+	delayJob *RestartJob
+}
+
+func newRestarter(manager ServiceManager) *restarter {
+	return &restarter{
+		manager:  manager,
+		services: make(map[string]*serviceRestart),
+	}
+}
+
+func (r *restarter) handleRequest(req Request) {
+	switch req.requestType {
+	case Sleep:
+		delay, _ := strconv.Atoi(req.properties["delay"])
+		r.delay = time.Duration(delay) * time.Millisecond
+		r.delayJob = req.job
+	case Restart:
+		delay := time.Duration(0)
+		if req.job == r.delayJob {
+			delay = r.delay
+		}
+		r.schedule(req.properties["service"], delay, restartWaiter{job: req.job})
+	default:
+		wbgong.Error.Printf("Unknown request type %d", req.requestType)
+	}
+}
+
+// restartKey identifies the restarts which may be merged:
+// the restarts using a custom command are merged only with the same command
+func restartKey(name string, command []string) string {
+	if command == nil {
+		return name
+	}
+	return name + "\x00" + strings.Join(command, "\x00")
+}
+
+func (r *restarter) schedule(name string, delay time.Duration, waiter restartWaiter) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	action, command := DEFAULT_SERVICE_ACTION, []string(nil)
+	if waiter.job != nil && waiter.job.serviceCommand != nil {
+		command = waiter.job.serviceCommand
+	} else if waiter.job != nil && waiter.job.serviceAction != "" {
+		action = waiter.job.serviceAction
+	}
+
+	key := restartKey(name, command)
+	sr, found := r.services[key]
+	if !found {
+		sr = &serviceRestart{name: name, action: action, command: command}
+		r.services[key] = sr
+	}
+	sr.action = strongerServiceAction(sr.action, action)
+	sr.waiters = append(sr.waiters, waiter)
+	sr.delay = delay
+	if sr.running {
+		// the service will be restarted again after the current restart
+		return
+	}
+	if sr.timer != nil {
+		sr.timer.Stop()
+		wbgong.Debug.Printf("Merging restarts of service %s", name)
+	}
+	r.startTimer(key, sr)
+}
+
+// must be called with r.mtx locked
+func (r *restarter) startTimer(key string, sr *serviceRestart) {
+	sr.gen++
+	gen := sr.gen
+	wbgong.Debug.Printf("Delay %s before restarting service %s", sr.delay, sr.name)
+	sr.timer = time.AfterFunc(sr.delay, func() {
+		r.restart(key, gen)
+	})
+}
+
+func (r *restarter) restart(key string, gen int) {
+	r.mtx.Lock()
+	sr := r.services[key]
+	if sr == nil || sr.gen != gen || sr.running {
+		r.mtx.Unlock()
+		return
+	}
+	name, action, command := sr.name, sr.action, sr.command
+	waiters := sr.waiters
+	sr.waiters = nil
+	sr.timer = nil
+	sr.running = true
+	// the next restart uses the action requested after this one
+	sr.action = ""
+	r.mtx.Unlock()
+
+	var checkTimeout time.Duration
+	for _, w := range waiters {
+		if w.job != nil && !w.rollback {
+			w.job.setRunning()
+			if w.job.checkTimeout > checkTimeout {
+				checkTimeout = w.job.checkTimeout
+			}
+		}
+	}
+
+	var res RunCommandResult
+	var err error
+	if command != nil {
+		wbgong.Debug.Printf("Running %s for service %s", strings.Join(command, " "), name)
+		res, err = runServiceCommand(command, name, action)
+	} else {
+		wbgong.Debug.Printf("Running %s of service %s", action, name)
+		res, err = r.manager.Apply(name, action)
+	}
+	if err != nil {
+		wbgong.Error.Printf("Error restarting %s: %s", name, err)
+	}
+	state := watchServiceState(r.manager, name, checkTimeout)
+
+	for _, w := range waiters {
+		switch {
+		case w.job == nil:
+		case w.rollback:
+			w.job.serviceRolledBack(name, res, err, state)
+		case w.job.serviceRestarted(name, res, err, state):
+			wbgong.Warn.Printf("Service %s failed to start with new %s", name, w.job.ConfigPath)
+			go r.rollbackJob(w.job)
+		}
+	}
+
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	sr.running = false
+	if len(sr.waiters) > 0 {
+		r.startTimer(key, sr)
+	} else {
+		delete(r.services, key)
+	}
+}
+
+// rollbackJob restores the previous config of the failed job
+// and restarts its services again
+func (r *restarter) rollbackJob(job *RestartJob) {
+	if err := job.rollback(); err != nil {
+		wbgong.Error.Printf("Error rolling back %s: %s", job.ConfigPath, err)
+		job.rollbackFinished(err)
+		return
+	}
+	for _, service := range job.serviceNames() {
+		wbgong.Info.Printf("Restarting service %s after rollback of %s", service, job.ConfigPath)
+		r.schedule(service, 0, restartWaiter{job: job, rollback: true})
+	}
+}
+
+func (r *restarter) handleRequests(ch chan Request) {
+	for req := range ch {
+		r.handleRequest(req)
+	}
+}
+
+func RunRequestHandler(ch chan Request, manager ServiceManager) {
+	go newRestarter(manager).handleRequests(ch)
 }
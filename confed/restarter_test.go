@@ -0,0 +1,374 @@
+package confed
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+type fakeServiceManager struct {
+	sync.Mutex
+	restarts []string
+	// states returned by ActiveState, consumed one by one,
+	// the last one is repeated
+	states map[string][]string
+	// if set, Restart blocks until it's closed
+	block   chan struct{}
+	running int
+	// maximum number of simultaneous restarts
+	maxRunning int
+}
+
+func newFakeServiceManager() *fakeServiceManager {
+	return &fakeServiceManager{states: make(map[string][]string)}
+}
+
+func (m *fakeServiceManager) Apply(name, action string) (RunCommandResult, error) {
+	m.Lock()
+	m.restarts = append(m.restarts, name)
+	m.running++
+	if m.running > m.maxRunning {
+		m.maxRunning = m.running
+	}
+	block := m.block
+	m.Unlock()
+
+	if block != nil {
+		<-block
+	}
+
+	m.Lock()
+	m.running--
+	m.Unlock()
+	return RunCommandResult{}, nil
+}
+
+func (m *fakeServiceManager) ActiveState(name string) string {
+	m.Lock()
+	defer m.Unlock()
+	states := m.states[name]
+	if len(states) == 0 {
+		return SERVICE_STATE_ACTIVE
+	}
+	if len(states) > 1 {
+		m.states[name] = states[1:]
+	}
+	return states[0]
+}
+
+func (m *fakeServiceManager) restartCount(name string) int {
+	m.Lock()
+	defer m.Unlock()
+	n := 0
+	for _, restart := range m.restarts {
+		if restart == name {
+			n++
+		}
+	}
+	return n
+}
+
+func (m *fakeServiceManager) runningCount() int {
+	m.Lock()
+	defer m.Unlock()
+	return m.running
+}
+
+func sendRestart(r *restarter, job *RestartJob, delayMS int) {
+	if delayMS > 0 {
+		r.handleRequest(Request{Sleep, map[string]string{"delay": strconv.Itoa(delayMS)}, job})
+	}
+	for _, service := range job.serviceNames() {
+		r.handleRequest(Request{Restart, map[string]string{"service": service}, job})
+	}
+}
+
+func waitFor(t *testing.T, what string, pred func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !pred() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func waitForJobState(t *testing.T, tracker *jobTracker, id, state string) {
+	t.Helper()
+	waitFor(t, "job "+state, func() bool {
+		job, _ := tracker.Get(id)
+		return job.State == state
+	})
+}
+
+func TestRestarterMergesRestarts(t *testing.T) {
+	manager := newFakeServiceManager()
+	r := newRestarter(manager)
+	tracker := newJobTracker()
+
+	var jobs []*RestartJob
+	for i := 0; i < 5; i++ {
+		job := tracker.start("/etc/test.conf", []string{"svc1"})
+		sendRestart(r, job, 50)
+		jobs = append(jobs, job)
+	}
+	for _, job := range jobs {
+		waitForJobState(t, tracker, job.Id, JOB_STATE_DONE)
+	}
+	if n := manager.restartCount("svc1"); n != 1 {
+		t.Errorf("service must be restarted once, restarted %d times", n)
+	}
+}
+
+func TestRestarterDebounce(t *testing.T) {
+	manager := newFakeServiceManager()
+	r := newRestarter(manager)
+	tracker := newJobTracker()
+
+	first := tracker.start("/etc/test.conf", []string{"svc1"})
+	sendRestart(r, first, 200)
+	time.Sleep(100 * time.Millisecond)
+	second := tracker.start("/etc/test.conf", []string{"svc1"})
+	sendRestart(r, second, 200)
+
+	// the delay is counted from the last request
+	time.Sleep(150 * time.Millisecond)
+	if n := manager.restartCount("svc1"); n != 0 {
+		t.Errorf("service must not be restarted yet")
+	}
+	waitForJobState(t, tracker, first.Id, JOB_STATE_DONE)
+	waitForJobState(t, tracker, second.Id, JOB_STATE_DONE)
+	if n := manager.restartCount("svc1"); n != 1 {
+		t.Errorf("service must be restarted once, restarted %d times", n)
+	}
+}
+
+func TestRestarterParallel(t *testing.T) {
+	manager := newFakeServiceManager()
+	manager.block = make(chan struct{})
+	r := newRestarter(manager)
+	tracker := newJobTracker()
+
+	first := tracker.start("/etc/first.conf", []string{"svc1"})
+	second := tracker.start("/etc/second.conf", []string{"svc2"})
+	sendRestart(r, first, 0)
+	sendRestart(r, second, 0)
+
+	waitFor(t, "parallel restarts", func() bool { return manager.runningCount() == 2 })
+	close(manager.block)
+	waitForJobState(t, tracker, first.Id, JOB_STATE_DONE)
+	waitForJobState(t, tracker, second.Id, JOB_STATE_DONE)
+}
+
+func TestRestarterRestartsAgainAfterRunningRestart(t *testing.T) {
+	manager := newFakeServiceManager()
+	manager.block = make(chan struct{})
+	r := newRestarter(manager)
+	tracker := newJobTracker()
+
+	first := tracker.start("/etc/test.conf", []string{"svc1"})
+	sendRestart(r, first, 0)
+	waitFor(t, "restart", func() bool { return manager.runningCount() == 1 })
+
+	// the config is changed while the service is restarting,
+	// so it must be restarted once more, but only once
+	second := tracker.start("/etc/test.conf", []string{"svc1"})
+	third := tracker.start("/etc/test.conf", []string{"svc1"})
+	sendRestart(r, second, 0)
+	sendRestart(r, third, 0)
+	if n := manager.restartCount("svc1"); n != 1 {
+		t.Errorf("services must not be restarted simultaneously")
+	}
+	close(manager.block)
+
+	waitForJobState(t, tracker, third.Id, JOB_STATE_DONE)
+	waitForJobState(t, tracker, second.Id, JOB_STATE_DONE)
+	if n := manager.restartCount("svc1"); n != 2 {
+		t.Errorf("service must be restarted twice, restarted %d times", n)
+	}
+	if manager.maxRunning != 1 {
+		t.Errorf("the service is restarted in parallel with itself")
+	}
+}
+
+func TestRestarterRollback(t *testing.T) {
+	manager := newFakeServiceManager()
+	manager.states["svc1"] = []string{"failed", SERVICE_STATE_ACTIVE}
+	r := newRestarter(manager)
+	tracker := newJobTracker()
+
+	job := tracker.start("/etc/test.conf", []string{"svc1", "svc2"})
+	rolledBack := make(chan struct{}, 1)
+	job.rollback = func() error {
+		rolledBack <- struct{}{}
+		return nil
+	}
+	sendRestart(r, job, 0)
+
+	waitForJobState(t, tracker, job.Id, JOB_STATE_ROLLED_BACK)
+	select {
+	case <-rolledBack:
+	default:
+		t.Errorf("config is not rolled back")
+	}
+	res, _ := tracker.Get(job.Id)
+	if len(res.Rollback) != 2 || res.Services[0].State != JOB_STATE_FAILED {
+		t.Errorf("unexpected job: %+v", res)
+	}
+	for _, service := range []string{"svc1", "svc2"} {
+		if n := manager.restartCount(service); n != 2 {
+			t.Errorf("%s must be restarted twice, restarted %d times", service, n)
+		}
+	}
+}
+
+func TestRestarterSlowStartAndOneshotServices(t *testing.T) {
+	manager := newFakeServiceManager()
+	// the slow service is still starting after the check period
+	manager.states["slow"] = []string{"activating", "activating", "activating", SERVICE_STATE_ACTIVE}
+	manager.states["oneshot"] = []string{SERVICE_STATE_INACTIVE}
+	r := newRestarter(manager)
+	tracker := newJobTracker()
+
+	job := tracker.start("/etc/test.conf", []string{"slow", "oneshot"})
+	job.checkTimeout = 100 * time.Millisecond
+	sendRestart(r, job, 0)
+
+	waitForJobState(t, tracker, job.Id, JOB_STATE_DONE)
+	res, _ := tracker.Get(job.Id)
+	if res.Services[0].ActiveState != SERVICE_STATE_ACTIVE || res.Services[1].ActiveState != SERVICE_STATE_INACTIVE {
+		t.Errorf("unexpected job: %+v", res)
+	}
+}
+
+func TestRestarterWaitsForTransientStates(t *testing.T) {
+	manager := newFakeServiceManager()
+	manager.states["stopped"] = []string{"deactivating", SERVICE_STATE_INACTIVE}
+	manager.states["crashed"] = []string{"deactivating", SERVICE_STATE_FAILED}
+	r := newRestarter(manager)
+	tracker := newJobTracker()
+
+	stoppedJob := tracker.start("/etc/stopped.conf", []string{"stopped"})
+	stoppedJob.rollback = func() error {
+		t.Errorf("config of stopped service must not be rolled back")
+		return nil
+	}
+	sendRestart(r, stoppedJob, 0)
+	crashedJob := tracker.start("/etc/crashed.conf", []string{"crashed"})
+	crashedJob.rollback = func() error { return nil }
+	sendRestart(r, crashedJob, 0)
+
+	waitForJobState(t, tracker, stoppedJob.Id, JOB_STATE_DONE)
+	res, _ := tracker.Get(stoppedJob.Id)
+	if res.Services[0].ActiveState != SERVICE_STATE_INACTIVE {
+		t.Errorf("unexpected job: %+v", res)
+	}
+	waitForJobState(t, tracker, crashedJob.Id, JOB_STATE_ROLLED_BACK)
+	res, _ = tracker.Get(crashedJob.Id)
+	if res.Services[0].State != JOB_STATE_FAILED || res.Services[0].ActiveState != SERVICE_STATE_FAILED {
+		t.Errorf("unexpected job: %+v", res)
+	}
+}
+
+func TestServiceStateFailed(t *testing.T) {
+	for state, failed := range map[string]bool{
+		SERVICE_STATE_FAILED:   true,
+		SERVICE_STATE_ACTIVE:   false,
+		SERVICE_STATE_INACTIVE: false,
+		"activating":           false,
+		"deactivating":         false,
+		"reloading":            false,
+		"":                     false,
+	} {
+		if serviceStateFailed(state) != failed {
+			t.Errorf("serviceStateFailed(%q) must be %v", state, failed)
+		}
+	}
+}
+
+func TestRestarterDoesntRollBackOneshotService(t *testing.T) {
+	manager := newFakeServiceManager()
+	manager.states["oneshot"] = []string{SERVICE_STATE_INACTIVE}
+	r := newRestarter(manager)
+	tracker := newJobTracker()
+
+	job := tracker.start("/etc/test.conf", []string{"oneshot"})
+	job.rollback = func() error {
+		t.Errorf("config of oneshot service must not be rolled back")
+		return nil
+	}
+	sendRestart(r, job, 0)
+
+	waitForJobState(t, tracker, job.Id, JOB_STATE_DONE)
+	if n := manager.restartCount("oneshot"); n != 1 {
+		t.Errorf("service must be restarted once, restarted %d times", n)
+	}
+}
+
+func TestRestarterMergesActions(t *testing.T) {
+	manager := NewRecordingServiceManager()
+	r := newRestarter(manager)
+	tracker := newJobTracker()
+
+	reload := tracker.start("/etc/first.conf", []string{"svc1"})
+	reload.serviceAction = SERVICE_ACTION_RELOAD
+	restart := tracker.start("/etc/second.conf", []string{"svc1"})
+	restart.serviceAction = SERVICE_ACTION_RESTART
+	sendRestart(r, reload, 50)
+	sendRestart(r, restart, 50)
+
+	waitForJobState(t, tracker, reload.Id, JOB_STATE_DONE)
+	waitForJobState(t, tracker, restart.Id, JOB_STATE_DONE)
+	calls := manager.Calls()
+	if len(calls) != 1 || calls[0] != (ServiceCall{"svc1", SERVICE_ACTION_RESTART}) {
+		t.Errorf("unexpected calls: %v", calls)
+	}
+}
+
+func TestRestarterCustomCommand(t *testing.T) {
+	manager := NewRecordingServiceManager()
+	r := newRestarter(manager)
+	tracker := newJobTracker()
+
+	ok := tracker.start("/etc/first.conf", []string{"svc1"})
+	ok.serviceCommand = []string{"true"}
+	failed := tracker.start("/etc/second.conf", []string{"svc2"})
+	failed.serviceCommand = []string{"false"}
+	sendRestart(r, ok, 0)
+	sendRestart(r, failed, 0)
+
+	waitForJobState(t, tracker, ok.Id, JOB_STATE_DONE)
+	waitForJobState(t, tracker, failed.Id, JOB_STATE_FAILED)
+	if calls := manager.Calls(); len(calls) != 0 {
+		t.Errorf("service manager must not be used for custom commands: %v", calls)
+	}
+}
+
+func TestRunServiceCommand(t *testing.T) {
+	res, err := runServiceCommand([]string{"sh", "-c", `echo "$SERVICE_NAME $SERVICE_ACTION"`}, "svc1", SERVICE_ACTION_RESTART)
+	if err != nil {
+		t.Fatalf("runServiceCommand: %s", err)
+	}
+	if out := res.stdout.String(); out != "svc1 restart\n" {
+		t.Errorf("unexpected output: %q", out)
+	}
+	if _, err := runServiceCommand(nil, "svc1", SERVICE_ACTION_RESTART); err != errEmptyServiceCommand {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestRecordingServiceManagerKeepsLastCalls(t *testing.T) {
+	manager := NewRecordingServiceManager()
+	for n := 0; n < MAX_RECORDED_SERVICE_CALLS+10; n++ {
+		manager.Apply("svc"+strconv.Itoa(n), SERVICE_ACTION_RESTART)
+	}
+	calls := manager.Calls()
+	if len(calls) != MAX_RECORDED_SERVICE_CALLS {
+		t.Fatalf("unexpected number of calls: %d", len(calls))
+	}
+	if calls[0].Service != "svc10" || calls[len(calls)-1].Service != "svc"+strconv.Itoa(MAX_RECORDED_SERVICE_CALLS+9) {
+		t.Errorf("unexpected calls: %v", calls)
+	}
+}
@@ -0,0 +1,99 @@
+package confed
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/pmezard/go-difflib/difflib"
+	"github.com/wirenboard/wbgong"
+)
+
+// RoundTripResult is the report of converting the config file
+// to JSON and back
+type RoundTripResult struct {
+	ConfigPath string `json:"configPath"`
+	SchemaPath string `json:"schemaPath"`
+	// the values lost or changed by converting JSON
+	// to the config file and back
+	Changes []JSONChange `json:"changes"`
+	// the unified diff between the config file and the file
+	// written from its JSON, empty if the file is reproduced exactly
+	TextDiff string `json:"textDiff,omitempty"`
+}
+
+func (r *RoundTripResult) Ok() bool {
+	return len(r.Changes) == 0
+}
+
+// roundTripChanges converts JSON content to the config file format
+// and back and returns the values which don't match the content
+func roundTripChanges(schema *JSONSchema, content, converted []byte) ([]JSONChange, error) {
+	readBack, err := convertConfigToJSON(schema, converted)
+	if err != nil {
+		return nil, fmt.Errorf("can't convert written config back to JSON: %w", err)
+	}
+	// numbers are compared by value, not by representation
+	var expected, actual any
+	if err = json.Unmarshal(content, &expected); err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(readBack.content, &actual); err != nil {
+		return nil, fmt.Errorf("written config is converted back to invalid JSON: %w", err)
+	}
+	return diffJSON(expected, actual), nil
+}
+
+// verifyRoundTrip makes sure that the converted config is read back
+// as the submitted content if the schema asks for it
+func verifyRoundTrip(schema *JSONSchema, content, converted []byte) error {
+	if !schema.RoundTripCheck() {
+		return nil
+	}
+	changes, err := roundTripChanges(schema, content, converted)
+	if err != nil {
+		wbgong.Error.Printf("round trip check of %s failed: %s", schema.PhysicalConfigPath(), err)
+		return &EditorError{EDITOR_ERROR_ROUND_TRIP, roundTripError.message + ": " + err.Error()}
+	}
+	if len(changes) == 0 {
+		return nil
+	}
+	pointers := make([]string, len(changes))
+	for n, change := range changes {
+		pointers[n] = change.Path
+	}
+	wbgong.Error.Printf("config %s isn't read back as saved, differences at %v", schema.PhysicalConfigPath(), pointers)
+	return newRoundTripError(pointers)
+}
+
+// CheckRoundTrip converts the config file of the schema to JSON, back
+// to the config file and to JSON again, reporting the lost values
+func CheckRoundTrip(schema *JSONSchema) (*RoundTripResult, error) {
+	res := &RoundTripResult{
+		ConfigPath: schema.ConfigPath(),
+		SchemaPath: schema.Path(),
+	}
+	raw, err := os.ReadFile(schema.PhysicalConfigPath())
+	if err != nil {
+		return nil, err
+	}
+	current, err := convertConfigToJSON(schema, raw)
+	if err != nil {
+		return nil, fmt.Errorf("can't convert config to JSON: %w", err)
+	}
+	converted, err := convertConfigFromJSON(schema, current.content)
+	if err != nil {
+		return nil, fmt.Errorf("can't convert JSON to config: %w", err)
+	}
+	if res.Changes, err = roundTripChanges(schema, current.content, converted.content); err != nil {
+		return nil, err
+	}
+	res.TextDiff, err = difflib.GetUnifiedDiffString(difflib.UnifiedDiff{
+		A:        difflib.SplitLines(string(raw)),
+		B:        difflib.SplitLines(string(converted.content)),
+		FromFile: schema.ConfigPath(),
+		ToFile:   schema.ConfigPath(),
+		Context:  DIFF_CONTEXT_LINES,
+	})
+	return res, err
+}
@@ -1,15 +1,24 @@
 package confed
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
-
+	"fmt"
+	"io"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/santhosh-tekuri/jsonschema/v5"
 	"github.com/wirenboard/wbgong"
 	"github.com/xeipuuv/gojsonschema"
 )
 
 const (
-	DEFAULT_SUBCONF_PATTERN = `^.*\.conf$`
+	DEFAULT_SUBCONF_PATTERN     = `^.*\.conf$`
+	DEFAULT_ROLLBACK_TIMEOUT_MS = 10000
 )
 
 type JSONSchemaProps struct {
@@ -20,24 +29,43 @@ type JSONSchemaProps struct {
 	physicalConfigPath      string
 	fromJSONCommand         []string
 	toJSONCommand           []string
+	fromJSONConverter       Converter
+	toJSONConverter         Converter
+	configFormat            string
+	converterOptions        *converterOptions
+	workers                 *converterWorkerPool
+	toJSONCache             *toJSONCache
+	roundTripCheck          bool
 	services                []string
+	serviceAction           string
+	serviceCommand          []string
 	restartDelayMS          int
 	shouldValidate          bool
 	hideFromList            bool
+	historyMaxCount         int
+	historyMaxSize          int64
+	rollbackOnFailure       bool
+	rollbackTimeoutMS       int
 	TitleTranslations       map[string]string `json:"titleTranslations,omitempty"`
 	DescriptionTranslations map[string]string `json:"descriptionTranslations,omitempty"`
 	Editor                  string            `json:"editor"`
+	// filled by Editor/List
+	State *ConfigFileState `json:"state,omitempty"`
 }
 
 type JSONSchema struct {
 	path         string
 	schema       *gojsonschema.Schema
+	latestSchema *jsonschema.Schema // the validator of 2019-09 and 2020-12 drafts
 	content      []byte
 	parsed       map[string]any
 	preprocessed map[string]any
 	props        JSONSchemaProps
 	enumLoader   *enumLoader
 	patchLoader  *patchLoader
+	// guards the parsed schema and its validators, they're updated lazily
+	// and the schema is validated against without the editor lock
+	mtx sync.Mutex
 }
 
 func subconfKey(path, pattern, ptrString string) string {
@@ -70,6 +98,69 @@ func extractStringOrStringList(msi map[string]any, key string) ([]string, error)
 	return r, nil
 }
 
+func extractHistoryLimits(configFile map[string]any) (maxCount int, maxSize int64) {
+	// A configFile section could contain "history" property
+	// limiting the number and total size of stored config versions:
+	// "history": {
+	//     "maxCount": 10,
+	//     "maxSize": 1048576
+	// }
+	// Setting maxCount to 0 disables the history
+	maxCount, maxSize = DEFAULT_HISTORY_MAX_COUNT, DEFAULT_HISTORY_MAX_SIZE
+	history, ok := configFile["history"].(map[string]any)
+	if !ok {
+		return
+	}
+	if v, ok := history["maxCount"].(float64); ok {
+		maxCount = int(v)
+	}
+	if v, ok := history["maxSize"].(float64); ok {
+		maxSize = int64(v)
+	}
+	return
+}
+
+func extractServiceAction(configFile map[string]any) (action string, command []string, err error) {
+	// A configFile section could contain "serviceAction" property
+	// specifying how the services are restarted after the config is saved.
+	// It's either one of the standard actions:
+	// "serviceAction": "reload-or-restart" | "restart" | "reload" | "try-restart"
+	// or a custom command run instead of the service manager:
+	// "serviceAction": ["/usr/bin/some-tool", "--reload"]
+	action = DEFAULT_SERVICE_ACTION
+	v, found := configFile["serviceAction"]
+	if !found {
+		return
+	}
+	if name, ok := v.(string); ok {
+		if !isStandardServiceAction(name) {
+			return "", nil, fmt.Errorf("unknown service action %q", name)
+		}
+		return name, nil, nil
+	}
+	command, err = extractStringOrStringList(configFile, "serviceAction")
+	if err == nil && len(command) == 0 {
+		err = errEmptyServiceCommand
+	}
+	return "", command, err
+}
+
+func extractConfigFormat(configFile map[string]any) (string, error) {
+	// A configFile section could contain "format" property
+	// specifying the format of the config file which is converted
+	// to JSON without toJSON and fromJSON commands:
+	// "format": "json" | "jsonc" | "yaml" | "toml" | "ini" | "shell"
+	v, found := configFile["format"]
+	if !found {
+		return "", nil
+	}
+	format, ok := v.(string)
+	if !ok || !isKnownConfigFormat(format) {
+		return "", fmt.Errorf("unknown config format %v", v)
+	}
+	return format, nil
+}
+
 func addTranslation(strings map[string]any, lang, key string, dst map[string]string) {
 	translated, ok := strings[key]
 	if ok {
@@ -116,6 +207,62 @@ func NewJSONSchemaWithRoot(schemaPath, root string) (s *JSONSchema, err error) {
 		return
 	}
 
+	// "builtin:<name>" commands are run in-process
+	fromJSONConverter, err := lookupConverter(fromJSONCommand)
+	if err != nil {
+		return
+	}
+	if fromJSONConverter != nil {
+		fromJSONCommand = nil
+	}
+	toJSONConverter, err := lookupConverter(toJSONCommand)
+	if err != nil {
+		return
+	}
+	if toJSONConverter != nil {
+		toJSONCommand = nil
+	}
+
+	configFormat, err := extractConfigFormat(configFile)
+	if err != nil {
+		return
+	}
+	if configFormat != "" {
+		if fromJSONCommand != nil || toJSONCommand != nil || fromJSONConverter != nil || toJSONConverter != nil {
+			return nil, errors.New("configFile.format can't be used with toJSON and fromJSON")
+		}
+		fromJSONConverter = configFormats[configFormat]
+		toJSONConverter = fromJSONConverter
+	}
+
+	converterOptions, err := extractConverterOptions(configFile)
+	if err != nil {
+		return
+	}
+
+	workers, err := extractWorkerPool(configFile, converterOptions)
+	if err != nil {
+		return
+	}
+	if workers != nil && (configFormat != "" || fromJSONConverter != nil || toJSONConverter != nil) {
+		return nil, errors.New("configFile.worker can't be used with built-in converters")
+	}
+	// the commands are the fallback if the worker doesn't speak the protocol
+	if workers != nil && (fromJSONCommand == nil || toJSONCommand == nil) {
+		return nil, errors.New("configFile.worker requires toJSON and fromJSON commands")
+	}
+
+	// the converted config is cached only if the schema asks for it,
+	// toJSON command may depend on something besides the config file
+	var cache *toJSONCache
+	if enabled, _ := configFile["toJSONCache"].(bool); enabled {
+		cache = &toJSONCache{}
+	}
+
+	// if set, the config converted from JSON on save is converted back
+	// and the save is refused if some values are lost
+	roundTripCheck, _ := configFile["roundTripCheck"].(bool)
+
 	shouldValidate, ok := configFile["validate"].(bool)
 	if !ok {
 		shouldValidate = true
@@ -126,7 +273,19 @@ func NewJSONSchemaWithRoot(schemaPath, root string) (s *JSONSchema, err error) {
 		hideFromList = false
 	}
 
+	historyMaxCount, historyMaxSize := extractHistoryLimits(configFile)
+
+	rollbackOnFailure, _ := configFile["rollbackOnFailure"].(bool)
+	rollbackTimeoutMS, ok := configFile["rollbackTimeoutMS"].(float64)
+	if !ok {
+		rollbackTimeoutMS = DEFAULT_ROLLBACK_TIMEOUT_MS
+	}
+
 	services, _ := extractStringOrStringList(configFile, "service")
+	serviceAction, serviceCommand, err := extractServiceAction(configFile)
+	if err != nil {
+		return
+	}
 	restartDelayMS, _ := configFile["restartDelayMS"].(float64)
 	editor, _ := configFile["editor"].(string)
 
@@ -172,10 +331,23 @@ func NewJSONSchemaWithRoot(schemaPath, root string) (s *JSONSchema, err error) {
 			Description:             description,
 			fromJSONCommand:         fromJSONCommand,
 			toJSONCommand:           toJSONCommand,
+			fromJSONConverter:       fromJSONConverter,
+			toJSONConverter:         toJSONConverter,
+			configFormat:            configFormat,
+			converterOptions:        converterOptions,
+			workers:                 workers,
+			toJSONCache:             cache,
+			roundTripCheck:          roundTripCheck,
 			services:                services,
+			serviceAction:           serviceAction,
+			serviceCommand:          serviceCommand,
 			restartDelayMS:          int(restartDelayMS),
 			shouldValidate:          shouldValidate,
 			hideFromList:            hideFromList,
+			historyMaxCount:         historyMaxCount,
+			historyMaxSize:          historyMaxSize,
+			rollbackOnFailure:       rollbackOnFailure,
+			rollbackTimeoutMS:       int(rollbackTimeoutMS),
 			TitleTranslations:       titleTranslations,
 			DescriptionTranslations: descriptionTranslations,
 			Editor:                  editor,
@@ -187,11 +359,21 @@ func NewJSONSchemaWithRoot(schemaPath, root string) (s *JSONSchema, err error) {
 }
 
 func (s *JSONSchema) GetPreprocessed() map[string]any {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.preprocess()
+}
+
+// preprocess must be called with s.mtx locked
+func (s *JSONSchema) preprocess() map[string]any {
 	if s.patchLoader.IsDirty() {
-		err := json.Unmarshal(s.patchLoader.Patch(s.content), &s.parsed)
+		// the parsed schema may be in use, so it's replaced, not updated
+		var parsed map[string]any
+		err := json.Unmarshal(s.patchLoader.Patch(s.content), &parsed)
 		if err != nil {
 			wbgong.Warn.Printf("Failed to parse patched schema %s: %s", s.path, err)
 		} else {
+			s.parsed = parsed
 			s.preprocessed = nil
 		}
 	}
@@ -201,30 +383,91 @@ func (s *JSONSchema) GetPreprocessed() map[string]any {
 	return s.preprocessed
 }
 
-func (s *JSONSchema) getSchema() (schema *gojsonschema.Schema, err error) {
-	if s.schema != nil && !s.enumLoader.IsDirty() && !s.patchLoader.IsDirty() {
-		return s.schema, nil
+// latestDraftSchemas are $schema values of the drafts
+// not supported by gojsonschema
+var latestDraftSchemas = map[string]bool{
+	"https://json-schema.org/schema":               true,
+	"https://json-schema.org/draft/2019-09/schema": true,
+	"https://json-schema.org/draft/2020-12/schema": true,
+}
+
+// usesLatestDraft tells whether the schema is written for draft 2019-09 or 2020-12
+func (s *JSONSchema) usesLatestDraft() bool {
+	url, _ := s.parsed["$schema"].(string)
+	url = strings.Replace(url, "http://", "https://", 1)
+	if i := strings.IndexByte(url, '#'); i >= 0 {
+		url = url[:i]
 	}
+	return latestDraftSchemas[url]
+}
 
-	loader := gojsonschema.NewGoLoader(s.GetPreprocessed())
-	s.schema, err = gojsonschema.NewSchema(loader)
-	if err != nil {
+// compile makes the validator of draft-04..07 schemas using gojsonschema
+// and of 2019-09 and 2020-12 schemas using santhosh-tekuri/jsonschema.
+// It must be called with s.mtx locked.
+func (s *JSONSchema) compile() (err error) {
+	if (s.schema != nil || s.latestSchema != nil) && !s.enumLoader.IsDirty() && !s.patchLoader.IsDirty() {
+		return nil
+	}
+
+	if !s.usesLatestDraft() {
+		loader := gojsonschema.NewGoLoader(s.preprocess())
+		s.schema, err = gojsonschema.NewSchema(loader)
 		return
 	}
 
-	return s.schema, nil
+	bs, err := json.Marshal(s.preprocess())
+	if err != nil {
+		return
+	}
+	// the resource is named by the file URL of the absolute schema path,
+	// it's escaped, as the compiler looks the resource up by the escaped URL
+	path, err := filepath.Abs(s.path)
+	if err != nil {
+		return
+	}
+	resourceURL := (&url.URL{Scheme: "file", Path: filepath.ToSlash(path)}).String()
+	compiler := jsonschema.NewCompiler()
+	// the schemas are self-contained like the ones of gojsonschema
+	compiler.LoadURL = func(ref string) (io.ReadCloser, error) {
+		return nil, fmt.Errorf("can't load %s: external schemas aren't supported", ref)
+	}
+	if err = compiler.AddResource(resourceURL, bytes.NewReader(bs)); err != nil {
+		return
+	}
+	s.latestSchema, err = compiler.Compile(resourceURL)
+	return
 }
 
-func (s *JSONSchema) ValidateContent(content []byte) (r *gojsonschema.Result, err error) {
-	documentLoader := gojsonschema.NewStringLoader(string(content))
-	schema, err := s.getSchema()
+func (s *JSONSchema) ValidateContent(content []byte) (*ValidationResult, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if err := s.compile(); err != nil {
+		return nil, err
+	}
+	if s.latestSchema == nil {
+		r, err := s.schema.Validate(gojsonschema.NewStringLoader(string(content)))
+		if err != nil {
+			return nil, err
+		}
+		return &ValidationResult{errors: s.resultValidationErrors(r)}, nil
+	}
+
+	doc, err := decodeJSONValue(content)
 	if err != nil {
-		return
+		return nil, err
+	}
+	err = s.latestSchema.Validate(doc)
+	var ve *jsonschema.ValidationError
+	if errors.As(err, &ve) {
+		return &ValidationResult{errors: s.latestDraftValidationErrors(doc, ve)}, nil
+	}
+	if err != nil {
+		return nil, err
 	}
-	return schema.Validate(documentLoader)
+	return &ValidationResult{}, nil
 }
 
-func (s *JSONSchema) ValidateFile(path string) (result *gojsonschema.Result, err error) {
+func (s *JSONSchema) ValidateFile(path string) (result *ValidationResult, err error) {
 	bs, err := loadConfigBytes(path, nil)
 	if err != nil {
 		return
@@ -256,6 +499,35 @@ func (s *JSONSchema) FromJSONCommand() []string {
 	return s.props.fromJSONCommand
 }
 
+// ToJSONConverter returns the built-in converter or the converter
+// of the config format used instead of toJSON command
+func (s *JSONSchema) ToJSONConverter() Converter {
+	return s.props.toJSONConverter
+}
+
+// FromJSONConverter returns the built-in converter or the converter
+// of the config format used instead of fromJSON command
+func (s *JSONSchema) FromJSONConverter() Converter {
+	return s.props.fromJSONConverter
+}
+
+// ConfigFormat returns the format of the config file converted natively
+// or an empty string if toJSON and fromJSON commands are used
+func (s *JSONSchema) ConfigFormat() string {
+	return s.props.configFormat
+}
+
+// ConverterOptions returns the limits of toJSON and fromJSON commands
+func (s *JSONSchema) ConverterOptions() *converterOptions {
+	return s.props.converterOptions
+}
+
+// RoundTripCheck tells whether the saved config must be read back
+// as the submitted JSON
+func (s *JSONSchema) RoundTripCheck() bool {
+	return s.props.roundTripCheck
+}
+
 func (s *JSONSchema) Title() string {
 	return s.props.Title
 }
@@ -268,10 +540,38 @@ func (s *JSONSchema) Services() []string {
 	return s.props.services
 }
 
+// ServiceAction returns the standard action performed on the services
+// after the config is saved, empty if ServiceCommand is used instead
+func (s *JSONSchema) ServiceAction() string {
+	return s.props.serviceAction
+}
+
+// ServiceCommand returns the custom command run for the services
+// after the config is saved
+func (s *JSONSchema) ServiceCommand() []string {
+	return s.props.serviceCommand
+}
+
 func (s *JSONSchema) RestartDelayMS() int {
 	return s.props.restartDelayMS
 }
 
+func (s *JSONSchema) HistoryMaxCount() int {
+	return s.props.historyMaxCount
+}
+
+func (s *JSONSchema) HistoryMaxSize() int64 {
+	return s.props.historyMaxSize
+}
+
+func (s *JSONSchema) RollbackOnFailure() bool {
+	return s.props.rollbackOnFailure
+}
+
+func (s *JSONSchema) RollbackTimeoutMS() int {
+	return s.props.rollbackTimeoutMS
+}
+
 func (s *JSONSchema) ShouldValidate() bool {
 	return s.props.shouldValidate
 }
@@ -287,6 +587,9 @@ func (s *JSONSchema) Properties() *JSONSchemaProps {
 func (s *JSONSchema) StopWatchingDependentFiles() {
 	s.enumLoader.StopWatchingSubconfigs()
 	s.patchLoader.StopWatchingPatches()
+	if s.props.workers != nil {
+		s.props.workers.stop()
+	}
 }
 
 func (s *JSONSchema) Editor() string {
@@ -1,10 +1,11 @@
 package confed
 
 import (
+	"encoding/json"
+	"sync"
 	"testing"
 
 	"github.com/wirenboard/wbgong/testutils"
-	"github.com/xeipuuv/gojsonschema"
 )
 
 type SchemaSuite struct {
@@ -27,7 +28,7 @@ func (s *SchemaSuite) TearDownTest() {
 	s.Suite.TearDownTest()
 }
 
-func (s *SchemaSuite) validate(path string) (r *gojsonschema.Result) {
+func (s *SchemaSuite) validate(path string) (r *ValidationResult) {
 	r, err := s.schema.ValidateFile(path)
 	s.Ck("validation error", err)
 	return
@@ -76,6 +77,218 @@ func (s *SchemaSuite) TestAddingSubconf() {
 	s.verifyValid("sample-to-use-after-new-subconf.json")
 }
 
+func (s *SchemaSuite) TestValidationErrors() {
+	s.CopyDataFilesToTempDir("sample-translations.schema.json")
+	schema, err := NewJSONSchemaWithRoot("sample-translations.schema.json", s.DataFileTempDir())
+	s.Ck("error loading schema", err)
+	defer schema.StopWatchingDependentFiles()
+
+	r, err := schema.ValidateContent([]byte(`{"device_type": "MSU21", "slave_id": -1}`))
+	s.Ck("validation error", err)
+	errs := r.Errors()
+	s.Require().Len(errs, 1)
+	s.Equal("/slave_id", errs[0].Pointer)
+	s.Equal("minimum", errs[0].Keyword)
+	s.Equal("Must be greater than or equal to 0", errs[0].Message)
+	s.Nil(errs[0].MessageTranslations)
+
+	r, err = schema.ValidateContent([]byte(`{"slave_id": 1}`))
+	s.Ck("validation error", err)
+	errs = r.Errors()
+	s.Require().Len(errs, 1)
+	s.Equal(ValidationError{
+		Pointer:             "",
+		Keyword:             "required",
+		Message:             "device_type is required",
+		Value:               map[string]any{"slave_id": json.Number("1")},
+		MessageTranslations: map[string]string{"ru": "Не задан параметр device_type"},
+	}, errs[0])
+}
+
+func (s *SchemaSuite) TestServiceAction() {
+	s.Equal(DEFAULT_SERVICE_ACTION, s.schema.ServiceAction())
+	s.Nil(s.schema.ServiceCommand())
+
+	for spec, expected := range map[string][]string{
+		`"restart"`:                     {SERVICE_ACTION_RESTART},
+		`["/usr/bin/tool", "--reload"]`: {"", "/usr/bin/tool", "--reload"},
+	} {
+		s.WriteDataFile("action.schema.json",
+			`{"type": "object", "configFile": {"path": "/action.json", "serviceAction": `+spec+`}}`)
+		schema, err := NewJSONSchemaWithRoot("action.schema.json", s.DataFileTempDir())
+		s.Ck("NewJSONSchemaWithRoot()", err)
+		s.Equal(expected[0], schema.ServiceAction())
+		if len(expected) > 1 {
+			s.Equal(expected[1:], schema.ServiceCommand())
+		}
+	}
+
+	for _, spec := range []string{`"kill"`, `[]`, `42`} {
+		s.WriteDataFile("action.schema.json",
+			`{"type": "object", "configFile": {"path": "/action.json", "serviceAction": `+spec+`}}`)
+		_, err := NewJSONSchemaWithRoot("action.schema.json", s.DataFileTempDir())
+		s.Error(err, spec)
+	}
+}
+
+func (s *SchemaSuite) TestConfigFormat() {
+	s.Equal("", s.schema.ConfigFormat())
+
+	s.WriteDataFile("format.schema.json",
+		`{"type": "object", "configFile": {"path": "/format.yaml", "format": "yaml"}}`)
+	schema, err := NewJSONSchemaWithRoot("format.schema.json", s.DataFileTempDir())
+	s.Ck("NewJSONSchemaWithRoot()", err)
+	s.Equal(CONFIG_FORMAT_YAML, schema.ConfigFormat())
+
+	s.WriteDataFile("format.yaml", "name: test\nport: 8080\n")
+	bs, err := loadSchemaConfig(schema)
+	s.Ck("loadSchemaConfig()", err)
+	s.JSONEq(`{"name": "test", "port": 8080}`, string(bs.content))
+	s.Equal(contentHash([]byte("name: test\nport: 8080\n")), bs.revision)
+
+	bs, err = convertConfigFromJSON(schema, []byte(`{"name": "other", "port": 8081}`))
+	s.Ck("convertConfigFromJSON()", err)
+	s.Equal("name: other\nport: 8081\n", string(bs.content))
+
+	for _, configFile := range []string{
+		`{"path": "/format.conf", "format": "xml"}`,
+		`{"path": "/format.conf", "format": "yaml", "toJSON": ["cat"]}`,
+	} {
+		s.WriteDataFile("format.schema.json", `{"type": "object", "configFile": `+configFile+`}`)
+		_, err := NewJSONSchemaWithRoot("format.schema.json", s.DataFileTempDir())
+		s.Error(err, configFile)
+	}
+}
+
+func (s *SchemaSuite) TestConcurrentValidation() {
+	for _, name := range []string{"sample.schema.json", "latest.schema.json"} {
+		if name == "latest.schema.json" {
+			s.WriteDataFile(name, LATEST_DRAFT_SCHEMA)
+		}
+		// the schema is compiled by the first validation
+		schema, err := NewJSONSchemaWithRoot(name, s.DataFileTempDir())
+		s.Ck("error loading schema", err)
+		var wg sync.WaitGroup
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				schema.GetPreprocessed()
+				_, err := schema.ValidateContent([]byte(`{"port": 0}`))
+				s.NoError(err)
+			}()
+		}
+		wg.Wait()
+		schema.StopWatchingDependentFiles()
+	}
+}
+
 func TestSchemaSuite(t *testing.T) {
 	testutils.RunSuites(t, new(SchemaSuite))
 }
+
+const LATEST_DRAFT_SCHEMA = `{
+	"$schema": "https://json-schema.org/draft/2020-12/schema",
+	"type": "object",
+	"configFile": {"path": "/latest.conf"},
+	"$defs": {
+		"port": {"type": "integer", "minimum": 1},
+		"tree": {
+			"$dynamicAnchor": "node",
+			"type": "object",
+			"properties": {
+				"children": {"type": "array", "items": {"$dynamicRef": "#node"}}
+			}
+		}
+	},
+	"properties": {
+		"port": {"$ref": "#/$defs/port"},
+		"tls": {"type": "boolean"},
+		"tree": {"$ref": "#/$defs/tree"}
+	},
+	"dependentSchemas": {
+		"tls": {"properties": {"cert": {"type": "string"}}, "required": ["cert"]}
+	},
+	"unevaluatedProperties": false,
+	"translations": {
+		"ru": {"missing properties: 'cert'": "Не задан сертификат"}
+	}
+}`
+
+func (s *SchemaSuite) TestLatestDraft() {
+	s.WriteDataFile("latest.schema.json", LATEST_DRAFT_SCHEMA)
+	schema, err := NewJSONSchemaWithRoot(s.DataFilePath("latest.schema.json"), s.DataFileTempDir())
+	s.Ck("error loading schema", err)
+	defer schema.StopWatchingDependentFiles()
+
+	// the schema with the relative path which must be escaped in the resource URL
+	s.WriteDataFile("sub dir/latest.schema.json", LATEST_DRAFT_SCHEMA)
+	relSchema, err := NewJSONSchemaWithRoot("sub dir/latest.schema.json", s.DataFileTempDir())
+	s.Ck("error loading schema", err)
+	defer relSchema.StopWatchingDependentFiles()
+	r, err := relSchema.ValidateContent([]byte(`{"port": 0}`))
+	s.Ck("validation error", err)
+	s.False(r.Valid())
+
+	validate := func(content string) []ValidationError {
+		r, err := schema.ValidateContent([]byte(content))
+		s.Ck("validation error", err)
+		s.Equal(len(r.Errors()) == 0, r.Valid())
+		return r.Errors()
+	}
+	s.Empty(validate(`{"port": 1883, "tls": true, "cert": "/a", "tree": {"children": [{"children": []}]}}`))
+	s.Equal([]ValidationError{{
+		Pointer: "/port",
+		Keyword: "minimum",
+		Message: "must be >= 1 but found 0",
+		Value:   json.Number("0"),
+	}}, validate(`{"port": 0}`))
+	s.Equal([]ValidationError{{
+		Pointer: "/extra",
+		Keyword: "unevaluatedProperties",
+		Message: "not allowed",
+		Value:   json.Number("1"),
+	}}, validate(`{"port": 1, "extra": 1}`))
+	s.Equal([]ValidationError{{
+		Pointer:             "",
+		Keyword:             "required",
+		Message:             "missing properties: 'cert'",
+		Value:               map[string]any{"tls": true},
+		MessageTranslations: map[string]string{"ru": "Не задан сертификат"},
+	}}, validate(`{"tls": true}`))
+	errs := validate(`{"tree": {"children": [1]}}`)
+	s.Require().Len(errs, 1)
+	s.Equal("/tree/children/0", errs[0].Pointer)
+	s.Equal("type", errs[0].Keyword)
+
+	// 2019-09 keywords
+	s.WriteDataFile("draft2019.schema.json", `{
+		"$schema": "https://json-schema.org/draft/2019-09/schema",
+		"configFile": {"path": "/draft2019.conf"},
+		"properties": {"a": {"type": "string"}},
+		"dependentRequired": {"a": ["b"]},
+		"unevaluatedProperties": {"type": "number"}
+	}`)
+	schema2019, err := NewJSONSchemaWithRoot(s.DataFilePath("draft2019.schema.json"), s.DataFileTempDir())
+	s.Ck("error loading schema", err)
+	defer schema2019.StopWatchingDependentFiles()
+	r, err = schema2019.ValidateContent([]byte(`{"a": "x", "b": 1}`))
+	s.Ck("validation error", err)
+	s.True(r.Valid())
+	r, err = schema2019.ValidateContent([]byte(`{"a": "x", "b": "y"}`))
+	s.Ck("validation error", err)
+	s.False(r.Valid())
+
+	// draft-07 doesn't know unevaluatedProperties
+	s.WriteDataFile("draft7.schema.json", `{
+		"$schema": "http://json-schema.org/draft-07/schema#",
+		"configFile": {"path": "/draft7.conf"},
+		"unevaluatedProperties": false
+	}`)
+	schema7, err := NewJSONSchemaWithRoot(s.DataFilePath("draft7.schema.json"), s.DataFileTempDir())
+	s.Ck("error loading schema", err)
+	defer schema7.StopWatchingDependentFiles()
+	r, err = schema7.ValidateContent([]byte(`{"a": 1}`))
+	s.Ck("validation error", err)
+	s.True(r.Valid())
+}
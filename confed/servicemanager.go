@@ -0,0 +1,275 @@
+package confed
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	systemd "github.com/coreos/go-systemd/v22/dbus"
+	"github.com/wirenboard/wbgong"
+)
+
+const (
+	SERVICE_ACTION_RELOAD_OR_RESTART = "reload-or-restart"
+	SERVICE_ACTION_RESTART           = "restart"
+	SERVICE_ACTION_RELOAD            = "reload"
+	SERVICE_ACTION_TRY_RESTART       = "try-restart"
+	DEFAULT_SERVICE_ACTION           = SERVICE_ACTION_RELOAD_OR_RESTART
+
+	SERVICE_MANAGER_SYSTEMCTL = "systemctl"
+	SERVICE_MANAGER_SYSTEMD   = "systemd"
+	SERVICE_MANAGER_SYSVINIT  = "sysvinit"
+	SERVICE_MANAGER_NONE      = "none"
+
+	SYSVINIT_SERVICE_CMD = "service"
+	SYSTEMD_JOB_TIMEOUT  = 5 * time.Minute
+	SYSTEMD_JOB_DONE     = "done"
+
+	SERVICE_COMMAND_TIMEOUT = SYSTEMD_JOB_TIMEOUT
+	// the number of the last actions kept by RecordingServiceManager
+	MAX_RECORDED_SERVICE_CALLS = 100
+)
+
+var serviceActionPriorities = map[string]int{
+	SERVICE_ACTION_RELOAD:            1,
+	SERVICE_ACTION_TRY_RESTART:       2,
+	SERVICE_ACTION_RELOAD_OR_RESTART: 3,
+	SERVICE_ACTION_RESTART:           4,
+}
+
+func isStandardServiceAction(action string) bool {
+	_, found := serviceActionPriorities[action]
+	return found
+}
+
+// strongerServiceAction returns the action which covers both ones,
+// e.g. restart of the service covers its reload
+func strongerServiceAction(a, b string) string {
+	if serviceActionPriorities[b] > serviceActionPriorities[a] {
+		return b
+	}
+	return a
+}
+
+// ServiceManager performs actions on system services
+type ServiceManager interface {
+	// Apply performs one of the standard actions (restart, reload etc.) on the service
+	Apply(name, action string) (RunCommandResult, error)
+	// ActiveState returns the state of the service like 'systemctl is-active' does
+	// or an empty string if the state can't be determined
+	ActiveState(name string) string
+}
+
+// NewServiceManager creates the service manager by its name
+func NewServiceManager(name string) (ServiceManager, error) {
+	switch name {
+	case SERVICE_MANAGER_SYSTEMCTL:
+		return SystemctlServiceManager{}, nil
+	case SERVICE_MANAGER_SYSTEMD:
+		return NewSystemdServiceManager(), nil
+	case SERVICE_MANAGER_SYSVINIT:
+		return SysvinitServiceManager{}, nil
+	case SERVICE_MANAGER_NONE:
+		return NewRecordingServiceManager(), nil
+	default:
+		return nil, fmt.Errorf("unknown service manager %q", name)
+	}
+}
+
+// SystemctlServiceManager runs systemctl
+type SystemctlServiceManager struct{}
+
+func (SystemctlServiceManager) Apply(name, action string) (RunCommandResult, error) {
+	return runCommand(false, nil, SERVICE_CMD, action, name)
+}
+
+func (SystemctlServiceManager) ActiveState(name string) string {
+	// is-active exits with non-zero code for inactive services,
+	// so the error is ignored and only the output is checked
+	res, _ := runCommand(true, nil, SERVICE_CMD, "is-active", name)
+	return strings.TrimSpace(res.stdout.String())
+}
+
+// SystemdServiceManager talks to systemd over D-Bus.
+// The connection is established on the first use and
+// re-established after errors.
+type SystemdServiceManager struct {
+	mtx  sync.Mutex
+	conn *systemd.Conn
+}
+
+func NewSystemdServiceManager() *SystemdServiceManager {
+	return &SystemdServiceManager{}
+}
+
+// systemdUnitName adds .service suffix to the name
+// the same way as systemctl does
+func systemdUnitName(name string) string {
+	if path.Ext(name) == "" {
+		return name + ".service"
+	}
+	return name
+}
+
+func (m *SystemdServiceManager) connection(ctx context.Context) (*systemd.Conn, error) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	if m.conn != nil && m.conn.Connected() {
+		return m.conn, nil
+	}
+	conn, err := systemd.NewSystemConnectionContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	m.conn = conn
+	return conn, nil
+}
+
+func (m *SystemdServiceManager) Apply(name, action string) (res RunCommandResult, err error) {
+	res.exitCode = -1
+	ctx, cancel := context.WithTimeout(context.Background(), SYSTEMD_JOB_TIMEOUT)
+	defer cancel()
+
+	conn, err := m.connection(ctx)
+	if err != nil {
+		return res, err
+	}
+	unit := systemdUnitName(name)
+	ch := make(chan string, 1)
+	switch action {
+	case SERVICE_ACTION_RELOAD_OR_RESTART:
+		_, err = conn.ReloadOrRestartUnitContext(ctx, unit, "replace", ch)
+	case SERVICE_ACTION_RESTART:
+		_, err = conn.RestartUnitContext(ctx, unit, "replace", ch)
+	case SERVICE_ACTION_RELOAD:
+		_, err = conn.ReloadUnitContext(ctx, unit, "replace", ch)
+	case SERVICE_ACTION_TRY_RESTART:
+		_, err = conn.TryRestartUnitContext(ctx, unit, "replace", ch)
+	default:
+		return res, fmt.Errorf("unsupported service action %q", action)
+	}
+	if err != nil {
+		return res, err
+	}
+	select {
+	case result := <-ch:
+		if result != SYSTEMD_JOB_DONE {
+			return res, fmt.Errorf("%s of %s finished with result %q", action, unit, result)
+		}
+	case <-ctx.Done():
+		return res, ctx.Err()
+	}
+	res.exitCode = 0
+	return res, nil
+}
+
+func (m *SystemdServiceManager) ActiveState(name string) string {
+	ctx, cancel := context.WithTimeout(context.Background(), SYSTEMD_JOB_TIMEOUT)
+	defer cancel()
+
+	conn, err := m.connection(ctx)
+	if err != nil {
+		return ""
+	}
+	prop, err := conn.GetUnitPropertyContext(ctx, systemdUnitName(name), "ActiveState")
+	if err != nil {
+		return ""
+	}
+	state, _ := prop.Value.Value().(string)
+	return state
+}
+
+// SysvinitServiceManager runs init scripts via 'service' command
+type SysvinitServiceManager struct{}
+
+// LSB init scripts don't have reload-or-restart action,
+// force-reload is its equivalent
+var sysvinitActions = map[string]string{
+	SERVICE_ACTION_RELOAD_OR_RESTART: "force-reload",
+	SERVICE_ACTION_RESTART:           "restart",
+	SERVICE_ACTION_RELOAD:            "reload",
+	SERVICE_ACTION_TRY_RESTART:       "try-restart",
+}
+
+func (SysvinitServiceManager) Apply(name, action string) (RunCommandResult, error) {
+	sysvAction, found := sysvinitActions[action]
+	if !found {
+		return RunCommandResult{exitCode: -1}, fmt.Errorf("unsupported service action %q", action)
+	}
+	return runCommand(false, nil, SYSVINIT_SERVICE_CMD, name, sysvAction)
+}
+
+func (SysvinitServiceManager) ActiveState(name string) string {
+	res, err := runCommand(false, nil, SYSVINIT_SERVICE_CMD, name, "status")
+	if err == nil {
+		return SERVICE_STATE_ACTIVE
+	}
+	// LSB exit codes of the status action
+	switch res.exitCode {
+	case 1, 2:
+		return "failed"
+	case 3:
+		return "inactive"
+	default:
+		return ""
+	}
+}
+
+type ServiceCall struct {
+	Service string
+	Action  string
+}
+
+// RecordingServiceManager doesn't touch the services,
+// it only records the last requested actions. It's intended for tests
+// and for running confed outside of the target system.
+type RecordingServiceManager struct {
+	mtx   sync.Mutex
+	calls []ServiceCall
+}
+
+func NewRecordingServiceManager() *RecordingServiceManager {
+	return &RecordingServiceManager{}
+}
+
+func (m *RecordingServiceManager) Apply(name, action string) (RunCommandResult, error) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	wbgong.Info.Printf("Not running %s of service %s", action, name)
+	if len(m.calls) == MAX_RECORDED_SERVICE_CALLS {
+		m.calls = append(m.calls[:0], m.calls[1:]...)
+	}
+	m.calls = append(m.calls, ServiceCall{name, action})
+	return RunCommandResult{}, nil
+}
+
+func (m *RecordingServiceManager) ActiveState(name string) string {
+	return SERVICE_STATE_ACTIVE
+}
+
+// Calls returns the recorded actions
+func (m *RecordingServiceManager) Calls() []ServiceCall {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	return append([]ServiceCall(nil), m.calls...)
+}
+
+var errEmptyServiceCommand = errors.New("empty service command")
+
+// runServiceCommand runs the custom command used instead of
+// the standard service action. The command is limited the same way
+// as the converters and gets the service and the action
+// in SERVICE_NAME and SERVICE_ACTION environment variables.
+func runServiceCommand(command []string, name, action string) (RunCommandResult, error) {
+	if len(command) == 0 {
+		return RunCommandResult{exitCode: -1}, errEmptyServiceCommand
+	}
+	opts := defaultConverterOptions()
+	opts.timeout = SERVICE_COMMAND_TIMEOUT
+	opts.env = map[string]string{"SERVICE_NAME": name, "SERVICE_ACTION": action}
+	return runConverter(opts, command, nil)
+}
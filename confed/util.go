@@ -2,21 +2,20 @@ package confed
 
 import (
 	"bytes"
-	"errors"
-	"fmt"
+	"encoding/json"
 	"io"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"strings"
-	"syscall"
 
 	"github.com/DisposaBoy/JsonConfigReader"
 )
 
 type RunCommandResult struct {
-	stdout bytes.Buffer
-	stderr bytes.Buffer
+	stdout   bytes.Buffer
+	stderr   bytes.Buffer
+	exitCode int
 }
 
 func runCommand(captureStdout bool, stdin io.Reader, command string, args ...string) (res RunCommandResult, err error) {
@@ -28,58 +27,47 @@ func runCommand(captureStdout bool, stdin io.Reader, command string, args ...str
 	cmd.Stderr = &res.stderr
 	err = cmd.Run()
 	if err != nil {
-		exitErr, ok := err.(*exec.ExitError)
-		if ok {
-			status := -1 // FIXME
-			ws, ok := exitErr.Sys().(syscall.WaitStatus)
-			if ok {
-				status = ws.ExitStatus()
-			}
-			err = fmt.Errorf("exit status %d from %s %s: %s",
-				status, command, strings.Join(args, " "),
-				res.stderr.String())
-		}
+		res.exitCode, err = commandError(err, res.stderr.String(), command, args)
 	}
-
 	return
 }
 
 func extPreprocess(commandAndArgs []string, in []byte) (RunCommandResult, error) {
-	if len(commandAndArgs) < 1 {
-		return RunCommandResult{}, errors.New("commandAndArgs must not be empty")
-	}
-
-	return runCommand(true, bytes.NewBuffer(in), commandAndArgs[0], commandAndArgs[1:]...)
+	return runConverter(nil, commandAndArgs, in)
 }
 
 type LoadConfigResult struct {
 	content            []byte
 	preprocessorErrors string
+	// hash of the file content before preprocessing
+	revision string
 }
 
 func loadConfigBytes(path string, preprocessCmd []string) (res LoadConfigResult, err error) {
-	in, err := os.Open(path)
+	raw, err := os.ReadFile(path)
 	if err != nil {
 		return
 	}
-	defer in.Close() // not writing the file, so we can ignore Close() errors here
+	return convertToJSON(raw, preprocessCmd, nil)
+}
+
+// convertToJSON makes JSON from the config file content
+// using toJSON command, if any, and strips the comments.
+// The command is run with the default options if opts is nil.
+func convertToJSON(raw []byte, preprocessCmd []string, opts *converterOptions) (res LoadConfigResult, err error) {
+	res.revision = contentHash(raw)
 
-	var jsonInput io.Reader = in
+	var jsonInput io.Reader = bytes.NewReader(raw)
 	if preprocessCmd != nil {
-		var tmpBs []byte
-		tmpBs, err = io.ReadAll(in)
-		if err != nil {
-			return
-		}
 		var output RunCommandResult
-		output, err = extPreprocess(preprocessCmd, tmpBs)
+		output, err = runConverter(opts, preprocessCmd, raw)
+		if output.stderr.Len() != 0 {
+			res.preprocessorErrors = output.stderr.String()
+		}
 		if err != nil {
 			return
 		}
 		jsonInput = &output.stdout
-		if output.stderr.Len() != 0 {
-			res.preprocessorErrors = output.stderr.String()
-		}
 	}
 
 	reader := JsonConfigReader.New(jsonInput)
@@ -87,6 +75,27 @@ func loadConfigBytes(path string, preprocessCmd []string) (res LoadConfigResult,
 	return
 }
 
+// convertFromJSON makes the config file content from JSON
+// using fromJSON command or just indents JSON if there is no such command
+func convertFromJSON(content []byte, fromJSONCmd []string, opts *converterOptions) (res LoadConfigResult, err error) {
+	if fromJSONCmd == nil {
+		var indented bytes.Buffer
+		if err = json.Indent(&indented, content, "", "    "); err != nil {
+			return
+		}
+		res.content = indented.Bytes()
+		return
+	}
+
+	output, err := runConverter(opts, fromJSONCmd, content)
+	if err != nil {
+		return
+	}
+	res.content = output.stdout.Bytes()
+	res.preprocessorErrors = output.stderr.String()
+	return
+}
+
 func pathFromRoot(root, path string) (r string, err error) {
 	if root == "" || !strings.HasSuffix(root, "/") {
 		root += "/"
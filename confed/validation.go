@@ -0,0 +1,173 @@
+package confed
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/santhosh-tekuri/jsonschema/v5"
+	"github.com/xeipuuv/gojsonpointer"
+	"github.com/xeipuuv/gojsonschema"
+)
+
+// ValidationError describes a single schema violation
+// in a form suitable for RPC clients
+type ValidationError struct {
+	Pointer             string            `json:"pointer"`
+	Keyword             string            `json:"keyword"`
+	Message             string            `json:"message"`
+	Value               any               `json:"value"`
+	MessageTranslations map[string]string `json:"messageTranslations,omitempty"`
+}
+
+func (e ValidationError) String() string {
+	pointer := e.Pointer
+	if pointer == "" {
+		pointer = "(root)"
+	}
+	return pointer + ": " + e.Message
+}
+
+// ValidationResult is the result of validation of the config
+// by either draft-04..07 or 2019-09 and 2020-12 schema
+type ValidationResult struct {
+	errors []ValidationError
+}
+
+func (r *ValidationResult) Valid() bool {
+	return len(r.errors) == 0
+}
+
+func (r *ValidationResult) Errors() []ValidationError {
+	return r.errors
+}
+
+// gojsonschema error types that differ from the names
+// of the schema keywords producing them
+var validationErrorKeywords = map[string]string{
+	"invalid_type":                    "type",
+	"number_any_of":                   "anyOf",
+	"number_one_of":                   "oneOf",
+	"number_all_of":                   "allOf",
+	"number_not":                      "not",
+	"missing_dependency":              "dependencies",
+	"array_no_additional_items":       "additionalItems",
+	"array_min_items":                 "minItems",
+	"array_max_items":                 "maxItems",
+	"unique":                          "uniqueItems",
+	"array_min_properties":            "minProperties",
+	"array_max_properties":            "maxProperties",
+	"additional_property_not_allowed": "additionalProperties",
+	"invalid_property_pattern":        "patternProperties",
+	"invalid_property_name":           "propertyNames",
+	"string_gte":                      "minLength",
+	"string_lte":                      "maxLength",
+	"multiple_of":                     "multipleOf",
+	"number_gte":                      "minimum",
+	"number_gt":                       "exclusiveMinimum",
+	"number_lte":                      "maximum",
+	"number_lt":                       "exclusiveMaximum",
+	"condition_then":                  "then",
+	"condition_else":                  "else",
+}
+
+func validationErrorKeyword(errorType string) string {
+	if keyword, ok := validationErrorKeywords[errorType]; ok {
+		return keyword
+	}
+	return errorType
+}
+
+// jsonPointerFromContext converts gojsonschema context like "(root).a.0"
+// to JSON Pointer like "/a/0"
+func jsonPointerFromContext(context *gojsonschema.JsonContext) string {
+	if context == nil {
+		return ""
+	}
+	parts := strings.Split(context.String("\x00"), "\x00")
+	var b strings.Builder
+	for _, part := range parts[1:] {
+		b.WriteString("/")
+		b.WriteString(escapeJSONPointerToken(part))
+	}
+	return b.String()
+}
+
+func formatValidationMessage(format string, details gojsonschema.ErrorDetails) string {
+	for k, v := range details {
+		format = strings.ReplaceAll(format, "{{."+k+"}}", fmt.Sprint(v))
+	}
+	return format
+}
+
+// translateValidationMessage translates the message of gojsonschema error,
+// format and details are empty for the errors of the newer drafts
+func (s *JSONSchema) translateValidationMessage(message, format string, details gojsonschema.ErrorDetails) map[string]string {
+	// Messages are translated using "translations" property of the schema.
+	// Either the whole message or its format may be translated:
+	// "translations": {
+	//     "ru": {
+	//         "{{.property}} is required": "Не задан параметр {{.property}}",
+	//         ...
+	//     }
+	// }
+	translations, ok := s.parsed["translations"].(map[string]any)
+	if !ok {
+		return nil
+	}
+	res := make(map[string]string)
+	for lang, val := range translations {
+		strs, ok := val.(map[string]any)
+		if !ok {
+			continue
+		}
+		if translated, ok := strs[message].(string); ok {
+			res[lang] = translated
+		} else if translated, ok := strs[format].(string); ok && format != "" {
+			res[lang] = formatValidationMessage(translated, details)
+		}
+	}
+	if len(res) == 0 {
+		return nil
+	}
+	return res
+}
+
+// resultValidationErrors converts gojsonschema result errors
+// to the list of ValidationError
+func (s *JSONSchema) resultValidationErrors(r *gojsonschema.Result) []ValidationError {
+	errs := make([]ValidationError, 0, len(r.Errors()))
+	for _, desc := range r.Errors() {
+		errs = append(errs, ValidationError{
+			Pointer:             jsonPointerFromContext(desc.Context()),
+			Keyword:             validationErrorKeyword(desc.Type()),
+			Message:             desc.Description(),
+			Value:               desc.Value(),
+			MessageTranslations: s.translateValidationMessage(desc.Description(), desc.DescriptionFormat(), desc.Details()),
+		})
+	}
+	return errs
+}
+
+// latestDraftValidationErrors converts the tree of errors of 2019-09
+// and 2020-12 drafts validator to the list of ValidationError.
+// Only the leaf errors are reported like gojsonschema does.
+func (s *JSONSchema) latestDraftValidationErrors(doc any, ve *jsonschema.ValidationError) []ValidationError {
+	if len(ve.Causes) != 0 {
+		var errs []ValidationError
+		for _, cause := range ve.Causes {
+			errs = append(errs, s.latestDraftValidationErrors(doc, cause)...)
+		}
+		return errs
+	}
+	var value any
+	if ptr, err := gojsonpointer.NewJsonPointer(ve.InstanceLocation); err == nil {
+		value, _, _ = ptr.Get(doc)
+	}
+	return []ValidationError{{
+		Pointer:             ve.InstanceLocation,
+		Keyword:             ve.KeywordLocation[strings.LastIndex(ve.KeywordLocation, "/")+1:],
+		Message:             ve.Message,
+		Value:               value,
+		MessageTranslations: s.translateValidationMessage(ve.Message, "", nil),
+	}}
+}
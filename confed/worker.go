@@ -0,0 +1,402 @@
+package confed
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/DisposaBoy/JsonConfigReader"
+	"github.com/wirenboard/wbgong"
+)
+
+// Converter workers are long-lived toJSON/fromJSON processes.
+// confed writes a request per line to the worker's stdin:
+//
+//	{"id": 1, "method": "toJSON", "content": "<config file>"}
+//	{"id": 2, "method": "fromJSON", "content": "<JSON>"}
+//
+// and the worker answers with a line to its stdout:
+//
+//	{"id": 1, "result": "<JSON or config file>", "stderr": "<warnings>"}
+//	{"id": 2, "error": "<the reason of the failure>"}
+//
+// The first request is {"id": 1, "method": "hello"} which must be answered
+// with "ready" result, otherwise the worker is considered not speaking
+// the protocol and the one-shot toJSON and fromJSON commands are used instead.
+
+const (
+	DEFAULT_WORKER_POOL_SIZE = 1
+	// the time given to the started worker to answer hello request
+	WORKER_HANDSHAKE_TIMEOUT = 5 * time.Second
+
+	WORKER_METHOD_HELLO     = "hello"
+	WORKER_METHOD_TO_JSON   = "toJSON"
+	WORKER_METHOD_FROM_JSON = "fromJSON"
+	WORKER_READY            = "ready"
+)
+
+var (
+	errWorkerUnsupported = errors.New("converter worker doesn't speak the protocol")
+	errWorkerUnavailable = errors.New("converter worker failed to start")
+	errWorkerExited      = errors.New("converter worker exited")
+	errWorkerProtocol    = errors.New("bad converter worker response")
+)
+
+// isWorkerFallback tells whether the request must be run
+// by the one-shot command instead of the worker
+func isWorkerFallback(err error) bool {
+	return errors.Is(err, errWorkerUnsupported) || errors.Is(err, errWorkerUnavailable)
+}
+
+type workerRequest struct {
+	Id      int64  `json:"id"`
+	Method  string `json:"method"`
+	Content string `json:"content,omitempty"`
+}
+
+type workerResponse struct {
+	Id     int64  `json:"id"`
+	Result string `json:"result"`
+	Error  string `json:"error,omitempty"`
+	Stderr string `json:"stderr,omitempty"`
+}
+
+type workerLine struct {
+	line []byte
+	err  error
+}
+
+// workerStderr logs the stderr output of the worker
+type workerStderr struct {
+	command string
+}
+
+func (w *workerStderr) Write(p []byte) (int, error) {
+	for _, line := range strings.Split(strings.TrimSpace(string(p)), "\n") {
+		wbgong.Warn.Printf("converter worker %s printed in stderr: %s", w.command, line)
+	}
+	return len(p), nil
+}
+
+type converterWorker struct {
+	cmd      *exec.Cmd
+	stdin    io.WriteCloser
+	lines    chan workerLine
+	done     chan struct{}
+	killOnce sync.Once
+	nextId   int64
+}
+
+func startConverterWorker(commandAndArgs []string, opts *converterOptions) (*converterWorker, error) {
+	cmd := exec.Command(commandAndArgs[0], commandAndArgs[1:]...)
+	if err := setupConverterCmd(cmd, opts); err != nil {
+		return nil, err
+	}
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	cmd.Stderr = &workerStderr{command: commandAndArgs[0]}
+	if err = cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	w := &converterWorker{
+		cmd:   cmd,
+		stdin: stdin,
+		lines: make(chan workerLine),
+		done:  make(chan struct{}),
+	}
+	go w.readLines(stdout, opts.maxOutputSize)
+	return w, nil
+}
+
+func (w *converterWorker) readLines(stdout io.Reader, maxSize int) {
+	scanner := bufio.NewScanner(stdout)
+	scanner.Buffer(nil, maxSize)
+	for scanner.Scan() {
+		line := append([]byte(nil), scanner.Bytes()...)
+		select {
+		case w.lines <- workerLine{line: line}:
+		case <-w.done:
+		}
+	}
+	err := scanner.Err()
+	if err == nil {
+		err = errWorkerExited
+	} else if errors.Is(err, bufio.ErrTooLong) {
+		err = errConverterOutputTooLarge
+	}
+	select {
+	case w.lines <- workerLine{err: err}:
+	case <-w.done:
+	}
+	// stdout is read till the end, so the worker can be waited for
+	w.cmd.Wait()
+}
+
+// call sends the request to the worker and waits for the response
+func (w *converterWorker) call(method, content string, timeout time.Duration) (resp workerResponse, err error) {
+	w.nextId++
+	req, err := json.Marshal(workerRequest{Id: w.nextId, Method: method, Content: content})
+	if err != nil {
+		return
+	}
+	// the worker may not read its stdin, so writing is limited by the timeout too
+	written := make(chan error, 1)
+	go func() {
+		_, err := w.stdin.Write(append(req, '\n'))
+		written <- err
+	}()
+	defer func() {
+		// the worker is killed if the request isn't written yet,
+		// so the writing goroutine doesn't hang on its stdin
+		if err != nil && written != nil {
+			w.kill()
+		}
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		select {
+		case err = <-written:
+			if err != nil {
+				return resp, fmt.Errorf("%w: %s", errWorkerExited, err)
+			}
+			written = nil
+		case l := <-w.lines:
+			if l.err != nil {
+				return resp, l.err
+			}
+			if err = json.Unmarshal(l.line, &resp); err != nil {
+				return resp, fmt.Errorf("%w: %s", errWorkerProtocol, err)
+			}
+			if resp.Id != w.nextId {
+				return resp, fmt.Errorf("%w: expected id %d, got %d", errWorkerProtocol, w.nextId, resp.Id)
+			}
+			return resp, nil
+		case <-timer.C:
+			return resp, fmt.Errorf("%w: worker didn't answer %s request in %s", errConverterTimeout, method, timeout)
+		}
+	}
+}
+
+// kill stops the worker with all the processes it started,
+// the killed worker may be killed again
+func (w *converterWorker) kill() {
+	w.killOnce.Do(func() {
+		close(w.done)
+		syscall.Kill(-w.cmd.Process.Pid, syscall.SIGKILL)
+		w.stdin.Close()
+	})
+}
+
+// converterWorkerPool runs up to size workers for a schema.
+// The workers are started on demand, the crashed ones are replaced
+// by the new ones.
+type converterWorkerPool struct {
+	command []string
+	size    int
+	opts    *converterOptions
+	// the time given to the started worker to answer hello request
+	handshakeTimeout time.Duration
+
+	mtx         sync.Mutex
+	cond        *sync.Cond
+	idle        []*converterWorker
+	running     int
+	unsupported bool
+	stopped     bool
+}
+
+func newConverterWorkerPool(command []string, size int, opts *converterOptions) *converterWorkerPool {
+	p := &converterWorkerPool{
+		command:          command,
+		size:             size,
+		opts:             opts,
+		handshakeTimeout: WORKER_HANDSHAKE_TIMEOUT,
+	}
+	p.cond = sync.NewCond(&p.mtx)
+	return p
+}
+
+func extractWorkerPool(configFile map[string]any, opts *converterOptions) (*converterWorkerPool, error) {
+	// A configFile section could contain "worker" property describing
+	// the long-lived process used instead of toJSON and fromJSON commands:
+	// "worker": {
+	//     "command": ["/usr/lib/some-converter", "--worker"],
+	//     "poolSize": 2
+	// }
+	v, found := configFile["worker"]
+	if !found {
+		return nil, nil
+	}
+	worker, ok := v.(map[string]any)
+	if !ok {
+		return nil, errors.New("bad worker spec")
+	}
+	command, err := extractStringOrStringList(worker, "command")
+	if err != nil {
+		return nil, err
+	}
+	if len(command) == 0 {
+		return nil, errors.New("no worker command")
+	}
+	size := DEFAULT_WORKER_POOL_SIZE
+	if v, found := worker["poolSize"]; found {
+		n, ok := v.(float64)
+		if !ok || n < 1 {
+			return nil, fmt.Errorf("bad worker pool size %v", v)
+		}
+		size = int(n)
+	}
+	return newConverterWorkerPool(command, size, opts), nil
+}
+
+func (p *converterWorkerPool) acquire() (*converterWorker, error) {
+	p.mtx.Lock()
+	for {
+		switch {
+		case p.unsupported:
+			p.mtx.Unlock()
+			return nil, errWorkerUnsupported
+		case p.stopped:
+			// the schema is removed while being used,
+			// so the one-shot commands are used
+			p.mtx.Unlock()
+			return nil, errWorkerUnsupported
+		case len(p.idle) > 0:
+			w := p.idle[len(p.idle)-1]
+			p.idle = p.idle[:len(p.idle)-1]
+			p.mtx.Unlock()
+			return w, nil
+		case p.running < p.size:
+			p.running++
+			p.mtx.Unlock()
+			w, err := p.start()
+			if err != nil {
+				p.release(nil, true)
+			}
+			return w, err
+		}
+		p.cond.Wait()
+	}
+}
+
+// start runs a new worker and checks that it speaks the protocol.
+// The pool is marked unsupported if the worker doesn't answer hello in time
+// (e.g. a one-shot converter waiting for EOF) or answers it wrong.
+// The worker failed to start or exited is tried again on the next request.
+func (p *converterWorkerPool) start() (*converterWorker, error) {
+	w, err := startConverterWorker(p.command, p.opts)
+	if err != nil {
+		wbgong.Warn.Printf("failed to start converter worker %s: %s", p.command[0], err)
+		return nil, fmt.Errorf("%w: %s", errWorkerUnavailable, err)
+	}
+	resp, err := w.call(WORKER_METHOD_HELLO, "", p.handshakeTimeout)
+	if err == nil && (resp.Error != "" || resp.Result != WORKER_READY) {
+		err = fmt.Errorf("%w: unexpected hello response %+v", errWorkerProtocol, resp)
+	}
+	if err == nil {
+		return w, nil
+	}
+	w.kill()
+	if !errors.Is(err, errWorkerProtocol) && !errors.Is(err, errConverterTimeout) {
+		wbgong.Warn.Printf("converter worker %s exited before answering hello: %s", p.command[0], err)
+		return nil, fmt.Errorf("%w: %s", errWorkerUnavailable, err)
+	}
+	wbgong.Warn.Printf("converter worker %s isn't used: %s", p.command[0], err)
+	p.mtx.Lock()
+	p.unsupported = true
+	p.mtx.Unlock()
+	return nil, errWorkerUnsupported
+}
+
+// release returns the worker to the pool or kills the broken one.
+// w is nil if the worker failed to start.
+func (p *converterWorkerPool) release(w *converterWorker, broken bool) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	defer p.cond.Signal()
+	if w != nil && !broken && !p.stopped {
+		p.idle = append(p.idle, w)
+		return
+	}
+	if w != nil {
+		w.kill()
+	}
+	p.running--
+}
+
+// convert runs the request on a worker. The request failed because
+// of the crashed worker is retried once on the new worker.
+func (p *converterWorkerPool) convert(method string, content []byte) (RunCommandResult, error) {
+	var res RunCommandResult
+	for attempt := 0; ; attempt++ {
+		w, err := p.acquire()
+		if err != nil {
+			return res, err
+		}
+		resp, err := w.call(method, string(content), p.opts.timeout)
+		p.release(w, err != nil)
+		if errors.Is(err, errWorkerExited) && attempt == 0 {
+			wbgong.Warn.Printf("converter worker %s exited, restarting", p.command[0])
+			continue
+		}
+		if err != nil {
+			return res, err
+		}
+		res.stderr.WriteString(resp.Stderr)
+		if resp.Error != "" {
+			return res, fmt.Errorf("%s %s failed: %s", p.command[0], method, resp.Error)
+		}
+		res.stdout.WriteString(resp.Result)
+		return res, nil
+	}
+}
+
+// stop kills all the workers, the running requests are finished first
+func (p *converterWorkerPool) stop() {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	p.stopped = true
+	for _, w := range p.idle {
+		w.kill()
+		p.running--
+	}
+	p.idle = nil
+	p.cond.Broadcast()
+}
+
+// toJSON converts the config file to JSON on a worker and strips the comments
+// like convertToJSON does
+func (p *converterWorkerPool) toJSON(raw []byte) (res LoadConfigResult, err error) {
+	res.revision = contentHash(raw)
+	output, err := p.convert(WORKER_METHOD_TO_JSON, raw)
+	res.preprocessorErrors = output.stderr.String()
+	if err != nil {
+		return
+	}
+	res.content, err = io.ReadAll(JsonConfigReader.New(bytes.NewReader(output.stdout.Bytes())))
+	return
+}
+
+func (p *converterWorkerPool) fromJSON(content []byte) (res LoadConfigResult, err error) {
+	output, err := p.convert(WORKER_METHOD_FROM_JSON, content)
+	res.content = output.stdout.Bytes()
+	res.preprocessorErrors = output.stderr.String()
+	return
+}
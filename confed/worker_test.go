@@ -0,0 +1,209 @@
+package confed
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// the worker answers toJSON request with its pid
+// and crashes or hangs if asked to
+const TEST_WORKER_SCRIPT = `
+while IFS= read -r line; do
+	id=${line#*\"id\":}
+	id=${id%%,*}
+	case "$line" in
+	*'"method":"hello"'*) echo "{\"id\":$id,\"result\":\"ready\"}" ;;
+	*'"content":"crash'*) exit 1 ;;
+	*'"content":"hang'*) sleep 30 ;;
+	*'"method":"toJSON"'*) echo "{\"id\":$id,\"result\":\"{\\\"pid\\\": $$}\",\"stderr\":\"converted\"}" ;;
+	*'"method":"fromJSON"'*) echo "{\"id\":$id,\"result\":\"written by worker\"}" ;;
+	*) echo "{\"id\":$id,\"error\":\"unknown method\"}" ;;
+	esac
+done
+`
+
+func newTestWorkerPool(t *testing.T, size int, opts *converterOptions) *converterWorkerPool {
+	script := filepath.Join(t.TempDir(), "worker.sh")
+	if err := os.WriteFile(script, []byte(TEST_WORKER_SCRIPT), 0644); err != nil {
+		t.Fatal(err)
+	}
+	p := newConverterWorkerPool([]string{"sh", script}, size, opts)
+	t.Cleanup(p.stop)
+	return p
+}
+
+func workerPid(t *testing.T, p *converterWorkerPool, raw string) (float64, error) {
+	res, err := p.toJSON([]byte(raw))
+	if err != nil {
+		return 0, err
+	}
+	var v map[string]float64
+	if err = json.Unmarshal(res.content, &v); err != nil {
+		t.Fatalf("bad worker output %q", res.content)
+	}
+	if res.preprocessorErrors != "converted" {
+		t.Errorf("worker's stderr isn't passed: %q", res.preprocessorErrors)
+	}
+	return v["pid"], nil
+}
+
+func TestConverterWorkerPool(t *testing.T) {
+	opts := defaultConverterOptions()
+	opts.timeout = 500 * time.Millisecond
+	p := newTestWorkerPool(t, 1, opts)
+
+	pid, err := workerPid(t, p, "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the worker is reused
+	if next, err := workerPid(t, p, "config"); err != nil || next != pid {
+		t.Errorf("expected the same worker %v, got %v, %v", pid, next, err)
+	}
+	res, err := p.fromJSON([]byte(`{}`))
+	if err != nil || string(res.content) != "written by worker" {
+		t.Errorf("unexpected fromJSON result %q, %v", res.content, err)
+	}
+
+	// the crashed worker is restarted, the request is retried once
+	if _, err = p.toJSON([]byte("crash")); !errors.Is(err, errWorkerExited) {
+		t.Errorf("worker exit error expected, got %v", err)
+	}
+	next, err := workerPid(t, p, "config")
+	if err != nil || next == pid {
+		t.Errorf("expected new worker, got %v, %v", next, err)
+	}
+
+	// the hung worker is killed
+	if _, err = p.toJSON([]byte("hang")); !errors.Is(err, errConverterTimeout) {
+		t.Errorf("timeout error expected, got %v", err)
+	}
+	if pid, err = workerPid(t, p, "config"); err != nil || pid == next {
+		t.Errorf("expected new worker, got %v, %v", pid, err)
+	}
+
+	p.stop()
+	if _, err = p.toJSON([]byte("config")); !errors.Is(err, errWorkerUnsupported) {
+		t.Errorf("stopped pool must not be used, got %v", err)
+	}
+}
+
+func TestConverterWorkerPoolSize(t *testing.T) {
+	p := newTestWorkerPool(t, 2, defaultConverterOptions())
+	var wg sync.WaitGroup
+	var mtx sync.Mutex
+	pids := make(map[float64]bool)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			pid, err := workerPid(t, p, "config")
+			if err != nil {
+				t.Error(err)
+			}
+			mtx.Lock()
+			pids[pid] = true
+			mtx.Unlock()
+		}()
+	}
+	wg.Wait()
+	if len(pids) > 2 {
+		t.Errorf("expected 2 workers at most, got %d", len(pids))
+	}
+}
+
+func TestConverterWorkerUnsupported(t *testing.T) {
+	p := newConverterWorkerPool([]string{"cat"}, 1, defaultConverterOptions())
+	defer p.stop()
+	for i := 0; i < 2; i++ {
+		if _, err := p.toJSON([]byte("{}")); !errors.Is(err, errWorkerUnsupported) {
+			t.Errorf("unsupported worker error expected, got %v", err)
+		}
+	}
+	// the worker isn't started again
+	if p.running != 0 || !p.unsupported {
+		t.Errorf("the pool must be marked unsupported")
+	}
+}
+
+func TestConverterWorkerHangingOnHello(t *testing.T) {
+	// e.g. a one-shot converter waiting for EOF
+	p := newConverterWorkerPool([]string{"sleep", "60"}, 1, defaultConverterOptions())
+	p.handshakeTimeout = 100 * time.Millisecond
+	defer p.stop()
+	for i := 0; i < 2; i++ {
+		start := time.Now()
+		if _, err := p.toJSON([]byte("{}")); !errors.Is(err, errWorkerUnsupported) {
+			t.Errorf("unsupported worker error expected, got %v", err)
+		}
+		// the worker isn't started and waited for again
+		if i > 0 && time.Since(start) >= p.handshakeTimeout {
+			t.Errorf("the worker is started again")
+		}
+	}
+	if p.running != 0 || !p.unsupported {
+		t.Errorf("the pool must be marked unsupported")
+	}
+}
+
+func TestConverterWorkerNotReadingStdin(t *testing.T) {
+	w, err := startConverterWorker([]string{"sleep", "60"}, defaultConverterOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the request doesn't fit into the pipe buffer
+	content := strings.Repeat("x", 1<<20)
+	if _, err = w.call(WORKER_METHOD_TO_JSON, content, 100*time.Millisecond); !errors.Is(err, errConverterTimeout) {
+		t.Errorf("timeout error expected, got %v", err)
+	}
+	// the worker is killed, so the request isn't being written anymore
+	written := make(chan error, 1)
+	go func() {
+		_, err := w.stdin.Write([]byte("\n"))
+		written <- err
+	}()
+	select {
+	case err = <-written:
+		if err == nil {
+			t.Errorf("stdin of the timed out worker must be closed")
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("the timed out worker isn't killed")
+	}
+	w.kill()
+}
+
+func TestConverterWorkerUnavailable(t *testing.T) {
+	for _, command := range [][]string{{"true"}, {"--no-such-command--"}} {
+		p := newConverterWorkerPool(command, 1, defaultConverterOptions())
+		for i := 0; i < 2; i++ {
+			if _, err := p.toJSON([]byte("{}")); !errors.Is(err, errWorkerUnavailable) || !isWorkerFallback(err) {
+				t.Errorf("%v: unavailable worker error expected, got %v", command, err)
+			}
+		}
+		p.stop()
+	}
+
+	// the worker crashed on start is started again on the next request
+	dir := t.TempDir()
+	script := filepath.Join(dir, "worker.sh")
+	marker := filepath.Join(dir, "started")
+	err := os.WriteFile(script, []byte(`[ -e `+marker+` ] || { touch `+marker+`; exit 1; }`+TEST_WORKER_SCRIPT), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := newConverterWorkerPool([]string{"sh", script}, 1, defaultConverterOptions())
+	defer p.stop()
+	if _, err = p.toJSON([]byte("config")); !errors.Is(err, errWorkerUnavailable) {
+		t.Errorf("unavailable worker error expected, got %v", err)
+	}
+	if _, err = workerPid(t, p, "config"); err != nil {
+		t.Errorf("the worker must be restarted, got %v", err)
+	}
+}
@@ -58,6 +58,115 @@ func runValidation(schemaPath, configPath, absRoot string) error {
 	return nil
 }
 
+// runCheckAll checks all the configs of the schemas
+// and prints the report. Returns false if any of the configs is broken.
+func runCheckAll(schemaPaths []string, absRoot string) bool {
+	editor := confed.NewEditor(absRoot)
+	defer confed.StopEditorWatchers(editor)
+	watcher := wbgong.NewDirWatcher("\\.schema.json$", confed.NewEditorDirWatcherClient(editor))
+	defer watcher.Stop()
+	for _, path := range schemaPaths {
+		if err := watcher.Load(path); err != nil {
+			wbgong.Error.Printf("error loading schema file/dir %s: %s", path, err)
+		}
+	}
+
+	var report []confed.ConfigCheckResult
+	if err := editor.Check(&confed.EditorCheckArgs{}, &report); err != nil {
+		wbgong.Error.Fatalf("failed to check configs: %s", err)
+	}
+	ok := true
+	for _, res := range report {
+		fmt.Printf("%s: %s (%s)\n", res.ConfigPath, res.Status, res.SchemaPath)
+		if res.Error != "" {
+			fmt.Printf("  %s\n", res.Error)
+		}
+		for _, line := range strings.Split(strings.TrimSpace(res.PreprocessorErrors), "\n") {
+			if line != "" {
+				fmt.Printf("  %s\n", line)
+			}
+		}
+		for _, e := range res.Errors {
+			fmt.Printf("  - %s: %s\n", e.Pointer, e.Message)
+		}
+		ok = ok && res.Ok()
+	}
+	return ok
+}
+
+// roundTripSchemas loads the schemas found by the DirWatcher for -roundtrip
+type roundTripSchemas struct {
+	absRoot string
+	schemas []*confed.JSONSchema
+	failed  bool
+}
+
+func (c *roundTripSchemas) LoadFile(path string) error {
+	schema, err := confed.NewJSONSchemaWithRoot(path, c.absRoot)
+	if err != nil {
+		wbgong.Error.Printf("failed to load schema %s: %s", path, err)
+		c.failed = true
+		return err
+	}
+	c.schemas = append(c.schemas, schema)
+	return nil
+}
+
+func (c *roundTripSchemas) LiveLoadFile(path string) error {
+	return nil
+}
+
+func (c *roundTripSchemas) LiveRemoveFile(path string) error {
+	return nil
+}
+
+// stop stops the watchers and converter workers of the loaded schemas
+func (c *roundTripSchemas) stop() {
+	for _, schema := range c.schemas {
+		schema.StopWatchingDependentFiles()
+	}
+}
+
+// runRoundTrip converts the config files of the schemas to JSON and back
+// and prints the lost values. The schemas are loaded from the files
+// and directories like in -check-all mode. Returns false if any of
+// the configs isn't read back the same.
+func runRoundTrip(schemaPaths []string, absRoot string) bool {
+	loaded := &roundTripSchemas{absRoot: absRoot}
+	defer loaded.stop()
+	watcher := wbgong.NewDirWatcher("\\.schema.json$", loaded)
+	defer watcher.Stop()
+	for _, path := range schemaPaths {
+		if err := watcher.Load(path); err != nil {
+			wbgong.Error.Printf("error loading schema file/dir %s: %s", path, err)
+			loaded.failed = true
+		}
+	}
+
+	ok := !loaded.failed
+	for _, schema := range loaded.schemas {
+		res, err := confed.CheckRoundTrip(schema)
+		if err != nil {
+			fmt.Printf("%s: error (%s)\n  %s\n", schema.ConfigPath(), schema.Path(), err)
+			ok = false
+			continue
+		}
+		status := "ok"
+		if !res.Ok() {
+			status = "changed"
+		}
+		fmt.Printf("%s: %s (%s)\n", res.ConfigPath, status, res.SchemaPath)
+		for _, change := range res.Changes {
+			fmt.Printf("  - %s %s\n", change.Op, change.Path)
+		}
+		if res.TextDiff != "" {
+			fmt.Print(res.TextDiff)
+		}
+		ok = ok && res.Ok()
+	}
+	return ok
+}
+
 var version = "unknown"
 
 func main() {
@@ -71,9 +180,14 @@ func main() {
 	debug := flag.Bool("debug", false, "Enable debugging")
 	useSyslog := flag.Bool("syslog", false, "Use syslog for logging")
 	validate := flag.Bool("validate", false, "Validate specified config file and exit")
+	checkAll := flag.Bool("check-all", false, "Check config files of all the specified schemas and exit")
 	dump := flag.Bool("dump", false, "Dump preprocessed schema and exit")
+	roundTrip := flag.Bool("roundtrip", false,
+		"Convert config files of the specified schema files and directories to JSON and back, report lost values and exit")
 	wbgoso := flag.String("wbgo", WBGO_FILE, "Location to wbgo.so file")
 	profile := flag.String("profile", "", "Run pprof server")
+	serviceManagerName := flag.String("service-manager", confed.SERVICE_MANAGER_SYSTEMCTL,
+		"Service manager used to restart services: systemctl, systemd (D-Bus), sysvinit or none")
 	flag.Parse()
 
 	if *profile != "" {
@@ -116,6 +230,18 @@ func main() {
 
 		os.Exit(0)
 	}
+	if *checkAll {
+		if !runCheckAll(flag.Args(), absRoot) {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	if *roundTrip {
+		if !runRoundTrip(flag.Args(), absRoot) {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
 	if *dump {
 		if flag.NArg() != 1 {
 			wbgong.Error.Fatal("must specify schema file")
@@ -147,7 +273,11 @@ func main() {
 	if !gotSome {
 		wbgong.Error.Fatalf("no valid schemas found")
 	}
-	confed.RunRequestHandler(editor.RequestCh)
+	serviceManager, err := confed.NewServiceManager(*serviceManagerName)
+	if err != nil {
+		wbgong.Error.Fatalf("%s", err)
+	}
+	confed.RunRequestHandler(editor.RequestCh, serviceManager)
 
 	// prepare exit signal channel
 	exitCh := make(chan os.Signal, 1)
@@ -159,6 +289,7 @@ func main() {
 	}
 
 	mqttClient := wbgong.NewPahoMQTTClient(*brokerAddress, DRIVER_CLIENT_ID)
+	confed.SetEditorMQTTClient(editor, mqttClient)
 	rpc := wbgong.NewMQTTRPCServer("confed", mqttClient)
 	err = rpc.Register(editor)
 	if err != nil {